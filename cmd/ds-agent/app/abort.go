@@ -0,0 +1,102 @@
+package app
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const abortWindowBuckets = 10
+
+type AbortPolicy struct {
+	ErrorRate         float64
+	Window            time.Duration
+	ConsecutiveErrors int64
+}
+
+func (p AbortPolicy) Enabled() bool {
+	return (p.ErrorRate > 0 && p.Window > 0) || p.ConsecutiveErrors > 0
+}
+
+type abortBucket struct {
+	epoch  int64
+	total  int64
+	failed int64
+}
+
+// abortMonitor keeps track of iteration results, the error rate is calculated over a sliding window made of
+// abortWindowBuckets buckets, and only evaluated once a full window has been observed.
+type abortMonitor struct {
+	mu          sync.Mutex
+	policy      AbortPolicy
+	startedAt   time.Time
+	bucketSize  time.Duration
+	buckets     []abortBucket
+	consecutive int64
+}
+
+func newAbortMonitor(policy AbortPolicy, startedAt time.Time) *abortMonitor {
+	m := &abortMonitor{
+		policy:    policy,
+		startedAt: startedAt,
+		buckets:   make([]abortBucket, abortWindowBuckets),
+	}
+	if policy.Window > 0 {
+		m.bucketSize = policy.Window / abortWindowBuckets
+		if m.bucketSize <= 0 {
+			m.bucketSize = 1
+		}
+	}
+	return m
+}
+
+// Record adds an iteration result, returns a non-empty reason if the job should be aborted
+func (m *abortMonitor) Record(now time.Time, failed bool) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if failed {
+		m.consecutive++
+	} else {
+		m.consecutive = 0
+	}
+
+	if m.policy.ConsecutiveErrors > 0 && m.consecutive >= m.policy.ConsecutiveErrors {
+		return fmt.Sprintf("%d consecutive errors", m.consecutive)
+	}
+
+	if m.policy.ErrorRate <= 0 || m.bucketSize <= 0 {
+		return ""
+	}
+
+	epoch := int64(now.Sub(m.startedAt) / m.bucketSize)
+	b := &m.buckets[epoch%abortWindowBuckets]
+	if b.epoch != epoch {
+		*b = abortBucket{epoch: epoch}
+	}
+	b.total++
+	if failed {
+		b.failed++
+	}
+
+	if now.Sub(m.startedAt) < m.policy.Window {
+		return ""
+	}
+
+	var total, totalFailed int64
+	for i := range m.buckets {
+		if m.buckets[i].epoch > epoch-abortWindowBuckets {
+			total += m.buckets[i].total
+			totalFailed += m.buckets[i].failed
+		}
+	}
+	if total == 0 {
+		return ""
+	}
+
+	rate := float64(totalFailed) / float64(total)
+	if rate >= m.policy.ErrorRate {
+		return fmt.Sprintf("error rate %.2f%% over last %s exceeds %.2f%%", rate*100, m.policy.Window, m.policy.ErrorRate*100)
+	}
+	return ""
+}
@@ -0,0 +1,41 @@
+package app
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAbortMonitorConsecutiveErrors(t *testing.T) {
+	now := time.Now()
+	m := newAbortMonitor(AbortPolicy{ConsecutiveErrors: 3}, now)
+	assert.Equal(t, "", m.Record(now, true))
+	assert.Equal(t, "", m.Record(now, true))
+	assert.Equal(t, "", m.Record(now, false))
+	assert.Equal(t, "", m.Record(now, true))
+	assert.Equal(t, "", m.Record(now, true))
+	assert.NotEqual(t, "", m.Record(now, true))
+}
+
+func TestAbortMonitorErrorRate(t *testing.T) {
+	now := time.Now()
+	m := newAbortMonitor(AbortPolicy{ErrorRate: 0.5, Window: time.Second * 10}, now)
+
+	// not evaluated before a full window is observed
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, "", m.Record(now.Add(time.Second*time.Duration(i)), true))
+	}
+
+	// errors slide out of the window
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, "", m.Record(now.Add(time.Second*6+time.Millisecond*time.Duration(i*100)), false))
+	}
+
+	// new errors push rate over the limit
+	var reason string
+	for i := 0; i < 200 && reason == ""; i++ {
+		reason = m.Record(now.Add(time.Second*16+time.Millisecond*time.Duration(i)), true)
+	}
+	assert.NotEqual(t, "", reason)
+}
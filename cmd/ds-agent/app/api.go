@@ -0,0 +1,124 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type apiStatus struct {
+	State        string  `json:"state"`
+	VUs          int32   `json:"vus"`
+	Iterations   int64   `json:"iterations"`
+	Elapsed      string  `json:"elapsed"`
+	ElapsedSec   float64 `json:"elapsed_seconds"`
+	AsyncPending int64   `json:"async_pending"`
+	Aborted      bool    `json:"aborted"`
+	AbortReason  string  `json:"abort_reason,omitempty"`
+}
+
+type apiVUs struct {
+	VUs      int    `json:"vus"`
+	Scenario string `json:"scenario,omitempty"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// NewAPIHandler creates a http handler controls engine with JSON endpoints
+//
+//	GET  /v1/status
+//	PUT  /v1/vus     {"vus": 10, "scenario": "browse"}, scenario is required if job has multiple scenarios
+//	POST /v1/pause
+//	POST /v1/resume
+//	POST /v1/stop
+func NewAPIHandler(engine *Engine) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/status", apiMethod(http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+		writeAPIStatus(w, engine)
+	}))
+	mux.HandleFunc("/v1/vus", apiMethod(http.MethodPut, func(w http.ResponseWriter, r *http.Request) {
+		var req apiVUs
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeAPIError(w, http.StatusBadRequest, errors.Wrap(err, "unable to decode body"))
+			return
+		}
+		scale := engine.Scale
+		if req.Scenario != "" {
+			scale = func(concurrency int) error {
+				return engine.ScaleScenario(req.Scenario, concurrency)
+			}
+		}
+		if err := scale(req.VUs); err != nil {
+			writeAPIError(w, apiErrorStatus(err), err)
+			return
+		}
+		writeAPIStatus(w, engine)
+	}))
+	mux.HandleFunc("/v1/pause", apiMethod(http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+		if err := engine.Pause(); err != nil {
+			writeAPIError(w, apiErrorStatus(err), err)
+			return
+		}
+		writeAPIStatus(w, engine)
+	}))
+	mux.HandleFunc("/v1/resume", apiMethod(http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+		if err := engine.Resume(); err != nil {
+			writeAPIError(w, apiErrorStatus(err), err)
+			return
+		}
+		writeAPIStatus(w, engine)
+	}))
+	mux.HandleFunc("/v1/stop", apiMethod(http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+		engine.Stop()
+		writeAPIStatus(w, engine)
+	}))
+	return mux
+}
+
+func apiMethod(method string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			writeAPIError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func apiErrorStatus(err error) int {
+	if errors.Is(err, errNoJob) {
+		return http.StatusConflict
+	}
+	return http.StatusBadRequest
+}
+
+func writeAPIStatus(w http.ResponseWriter, engine *Engine) {
+	status := engine.Status()
+	elapsed := time.Duration(status.GetElapsedNs())
+	writeAPIJSON(w, http.StatusOK, &apiStatus{
+		State:        strings.ToLower(strings.TrimPrefix(status.GetState().String(), "JOB_STATE_")),
+		VUs:          status.GetConcurrency(),
+		Iterations:   status.GetFinishedAmount(),
+		Elapsed:      elapsed.String(),
+		ElapsedSec:   elapsed.Seconds(),
+		AsyncPending: status.GetAsyncPending(),
+		Aborted:      status.GetAborted(),
+		AbortReason:  status.GetAbortReason(),
+	})
+}
+
+func writeAPIError(w http.ResponseWriter, code int, err error) {
+	writeAPIJSON(w, code, &apiError{Error: err.Error()})
+}
+
+func writeAPIJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
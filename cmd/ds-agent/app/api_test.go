@@ -0,0 +1,72 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func apiDo(t *testing.T, server *httptest.Server, method, path, body string) (int, map[string]interface{}) {
+	req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+	assert.Nil(t, err)
+	res, err := server.Client().Do(req)
+	assert.Nil(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, "application/json", res.Header.Get("Content-Type"))
+
+	m := map[string]interface{}{}
+	assert.Nil(t, json.NewDecoder(res.Body).Decode(&m))
+	return res.StatusCode, m
+}
+
+func TestAPI(t *testing.T) {
+	engine := newTestEngine(t, `
+		function run(id)
+			sleep(1000000)()
+		end
+	`)
+	server := httptest.NewServer(NewAPIHandler(engine))
+	defer server.Close()
+
+	code, res := apiDo(t, server, http.MethodPost, "/v1/pause", "")
+	assert.Equal(t, http.StatusConflict, code)
+	assert.NotEmpty(t, res["error"])
+
+	assert.Nil(t, engine.Start(&StartOptions{
+		Entry:       "main.lua",
+		Concurrency: 2,
+		Duration:    time.Minute,
+	}))
+
+	code, res = apiDo(t, server, http.MethodPut, "/v1/vus", `{"vus": 4}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, float64(4), res["vus"])
+
+	code, _ = apiDo(t, server, http.MethodPut, "/v1/vus", `{"vus": 0}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, _ = apiDo(t, server, http.MethodGet, "/v1/pause", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, code)
+
+	_, res = apiDo(t, server, http.MethodPost, "/v1/pause", "")
+	assert.Equal(t, "paused", res["state"])
+
+	_, res = apiDo(t, server, http.MethodPost, "/v1/resume", "")
+	assert.Equal(t, "running", res["state"])
+
+	_, res = apiDo(t, server, http.MethodGet, "/v1/status", "")
+	assert.Contains(t, res, "iterations")
+	assert.Contains(t, res, "elapsed")
+	assert.Contains(t, res, "async_pending")
+
+	apiDo(t, server, http.MethodPost, "/v1/stop", "")
+	_, err := engine.Wait()
+	assert.Nil(t, err)
+	_, res = apiDo(t, server, http.MethodGet, "/v1/status", "")
+	assert.Equal(t, "finished", res["state"])
+}
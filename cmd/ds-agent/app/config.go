@@ -0,0 +1,617 @@
+package app
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+
+	luavm "github.com/joesonw/lte/pkg/lua/vm"
+	"github.com/joesonw/lte/pkg/stat"
+)
+
+const (
+	ExecutorIterations = "iterations"
+	ExecutorDuration   = "duration"
+	ExecutorRampingVUs = "ramping-vus"
+
+	OutputConsole = "console"
+	OutputJSON    = "json"
+)
+
+// Config describes a test, it is loaded from a yaml or json file given to `run --config`
+type Config struct {
+	// Entry is path of entry script inside bundle
+	Entry string `yaml:"entry"`
+	// Bundle is path of a directory or archive, relative to config file
+	Bundle   string            `yaml:"bundle"`
+	Env      map[string]string `yaml:"env"`
+	Tags     map[string]string `yaml:"tags"`
+	Executor ExecutorConfig    `yaml:"executor"`
+	// Scenarios run concurrently by name, top level executor is used only if there is no scenario
+	Scenarios  map[string]ScenarioConfig `yaml:"scenarios"`
+	Outputs    []OutputConfig            `yaml:"outputs"`
+	Thresholds map[string][]string       `yaml:"thresholds"`
+	HTTP       HTTPConfig                `yaml:"http"`
+	Abort      AbortConfig               `yaml:"abort"`
+	Async      AsyncConfig               `yaml:"async"`
+	Sandbox    SandboxConfig             `yaml:"sandbox"`
+	ModulePath string                    `yaml:"module_path"`
+	API        string                    `yaml:"api"`
+}
+
+type ExecutorConfig struct {
+	// Type is one of iterations, duration and ramping-vus, it is inferred from other fields if empty
+	Type       string        `yaml:"type"`
+	VUs        int           `yaml:"vus"`
+	Iterations int64         `yaml:"iterations"`
+	Duration   time.Duration `yaml:"duration"`
+	Rate       float64       `yaml:"rate"`
+	Stages     []StageConfig `yaml:"stages"`
+}
+
+type ScenarioConfig struct {
+	// Exec is global function called on each iteration, "run" if empty
+	Exec     string         `yaml:"exec"`
+	Executor ExecutorConfig `yaml:"executor"`
+	// StartTime delays scenario relative to start of test
+	StartTime time.Duration     `yaml:"start_time"`
+	Env       map[string]string `yaml:"env"`
+	Tags      map[string]string `yaml:"tags"`
+}
+
+type StageConfig struct {
+	Duration time.Duration `yaml:"duration"`
+	Target   int           `yaml:"target"`
+}
+
+type OutputConfig struct {
+	Type string `yaml:"type"`
+	// Path is file stats are written to, relative to config file
+	Path string `yaml:"path"`
+}
+
+type HTTPConfig struct {
+	Timeout            time.Duration     `yaml:"timeout"`
+	InsecureSkipVerify bool              `yaml:"insecure_skip_verify"`
+	Headers            map[string]string `yaml:"headers"`
+}
+
+type AbortConfig struct {
+	ErrorRate         float64       `yaml:"error_rate"`
+	Window            time.Duration `yaml:"window"`
+	ConsecutiveErrors int64         `yaml:"consecutive_errors"`
+}
+
+// AsyncConfig sizes the async pool of each vu, defaults are used for zero values
+type AsyncConfig struct {
+	Workers   int           `yaml:"workers"`
+	QueueSize int           `yaml:"queue_size"`
+	Timeout   time.Duration `yaml:"timeout"`
+}
+
+// SandboxConfig enables sandbox of vus, limits are unset for zero values
+type SandboxConfig struct {
+	Enabled           bool          `yaml:"enabled"`
+	Timeout           time.Duration `yaml:"timeout"`
+	InstructionBudget int64         `yaml:"instruction_budget"`
+	MemoryLimitMB     int           `yaml:"memory_limit_mb"`
+	CallStackSize     int           `yaml:"call_stack_size"`
+	RegistryMaxSize   int           `yaml:"registry_max_size"`
+}
+
+// Sandbox returns sandbox of vms, nil if it is disabled
+func (c SandboxConfig) Sandbox() *luavm.Sandbox {
+	if !c.Enabled {
+		return nil
+	}
+	return &luavm.Sandbox{
+		CallStackSize:     c.CallStackSize,
+		RegistryMaxSize:   c.RegistryMaxSize,
+		Timeout:           c.Timeout,
+		InstructionBudget: c.InstructionBudget,
+		MemoryLimit:       uint64(c.MemoryLimitMB) * 1024 * 1024,
+	}
+}
+
+// Validate checks limits of sandbox, it is also used by serve, which takes sandbox but no test config
+func (c SandboxConfig) Validate() error {
+	if c.Timeout < 0 {
+		return configErrorf("sandbox.timeout", "can not be negative")
+	}
+	if c.InstructionBudget < 0 {
+		return configErrorf("sandbox.instruction_budget", "can not be negative")
+	}
+	if c.MemoryLimitMB < 0 {
+		return configErrorf("sandbox.memory_limit_mb", "can not be negative")
+	}
+	if c.CallStackSize < 0 {
+		return configErrorf("sandbox.call_stack_size", "can not be negative")
+	}
+	if c.RegistryMaxSize < 0 {
+		return configErrorf("sandbox.registry_max_size", "can not be negative")
+	}
+	return nil
+}
+
+// ConfigError points at the offending key of a config
+type ConfigError struct {
+	Key     string
+	Message string
+}
+
+func (e *ConfigError) Error() string {
+	if e.Key == "" {
+		return e.Message
+	}
+	return e.Key + ": " + e.Message
+}
+
+func configErrorf(key, format string, args ...interface{}) error {
+	return &ConfigError{Key: key, Message: fmt.Sprintf(format, args...)}
+}
+
+// LoadConfig reads config from a yaml or json file (by extension), relative paths are resolved against directory of the file
+func LoadConfig(path string) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read config")
+	}
+
+	cfg, err := ParseConfig(b, strings.EqualFold(filepath.Ext(path), ".json"))
+	if err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Dir(path)
+	if cfg.Bundle != "" && !filepath.IsAbs(cfg.Bundle) {
+		cfg.Bundle = filepath.Join(dir, cfg.Bundle)
+	}
+	for i := range cfg.Outputs {
+		if p := cfg.Outputs[i].Path; p != "" && !filepath.IsAbs(p) {
+			cfg.Outputs[i].Path = filepath.Join(dir, p)
+		}
+	}
+	return cfg, nil
+}
+
+// ParseConfig decodes config, unknown keys and mismatched types are reported with their keys
+func ParseConfig(b []byte, isJSON bool) (*Config, error) {
+	var raw interface{}
+	if isJSON {
+		if err := json.Unmarshal(b, &raw); err != nil {
+			return nil, errors.Wrap(err, "unable to parse json")
+		}
+	} else {
+		if err := yaml.Unmarshal(b, &raw); err != nil {
+			return nil, errors.Wrap(err, "unable to parse yaml")
+		}
+	}
+
+	cfg := &Config{}
+	if raw == nil {
+		return cfg, nil
+	}
+	if err := decodeConfigValue("", raw, reflect.ValueOf(cfg).Elem()); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+func joinKey(parent, key string) string {
+	if parent == "" {
+		return key
+	}
+	return parent + "." + key
+}
+
+func toStringMap(key string, in interface{}) (map[string]interface{}, error) {
+	switch m := in.(type) {
+	case map[string]interface{}:
+		return m, nil
+	case map[interface{}]interface{}:
+		result := make(map[string]interface{}, len(m))
+		for k, v := range m {
+			result[fmt.Sprint(k)] = v
+		}
+		return result, nil
+	default:
+		return nil, configErrorf(key, "expect a map, got %s", describe(in))
+	}
+}
+
+func describe(in interface{}) string {
+	switch in.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "string"
+	case bool:
+		return "bool"
+	case int, int64, float64:
+		return "number"
+	case []interface{}:
+		return "list"
+	case map[string]interface{}, map[interface{}]interface{}:
+		return "map"
+	default:
+		return fmt.Sprintf("%T", in)
+	}
+}
+
+func toFloat(in interface{}) (float64, bool) {
+	switch n := in.(type) {
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	default:
+		return 0, false
+	}
+}
+
+func decodeConfigValue(key string, in interface{}, out reflect.Value) error {
+	if out.Type() == durationType {
+		s, ok := in.(string)
+		if !ok {
+			return configErrorf(key, "expect a duration like \"30s\", got %s", describe(in))
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return configErrorf(key, "invalid duration \"%s\"", s)
+		}
+		out.SetInt(int64(d))
+		return nil
+	}
+
+	switch out.Kind() {
+	case reflect.String:
+		switch v := in.(type) {
+		case string:
+			out.SetString(v)
+		case bool, int, int64, float64:
+			out.SetString(fmt.Sprint(v))
+		default:
+			return configErrorf(key, "expect a string, got %s", describe(in))
+		}
+
+	case reflect.Bool:
+		v, ok := in.(bool)
+		if !ok {
+			return configErrorf(key, "expect a bool, got %s", describe(in))
+		}
+		out.SetBool(v)
+
+	case reflect.Int, reflect.Int64:
+		f, ok := toFloat(in)
+		if !ok || f != math.Trunc(f) {
+			return configErrorf(key, "expect an integer, got %s", describe(in))
+		}
+		out.SetInt(int64(f))
+
+	case reflect.Float64:
+		f, ok := toFloat(in)
+		if !ok {
+			return configErrorf(key, "expect a number, got %s", describe(in))
+		}
+		out.SetFloat(f)
+
+	case reflect.Slice:
+		list, ok := in.([]interface{})
+		if !ok {
+			return configErrorf(key, "expect a list, got %s", describe(in))
+		}
+		slice := reflect.MakeSlice(out.Type(), len(list), len(list))
+		for i, item := range list {
+			if err := decodeConfigValue(fmt.Sprintf("%s[%d]", key, i), item, slice.Index(i)); err != nil {
+				return err
+			}
+		}
+		out.Set(slice)
+
+	case reflect.Map:
+		m, err := toStringMap(key, in)
+		if err != nil {
+			return err
+		}
+		result := reflect.MakeMapWithSize(out.Type(), len(m))
+		for k, v := range m {
+			value := reflect.New(out.Type().Elem()).Elem()
+			if err := decodeConfigValue(joinKey(key, k), v, value); err != nil {
+				return err
+			}
+			result.SetMapIndex(reflect.ValueOf(k), value)
+		}
+		out.Set(result)
+
+	case reflect.Struct:
+		m, err := toStringMap(key, in)
+		if err != nil {
+			return err
+		}
+		fields := map[string]int{}
+		for i := 0; i < out.NumField(); i++ {
+			fields[out.Type().Field(i).Tag.Get("yaml")] = i
+		}
+		// sorted so the first offending key is reported consistently
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			i, ok := fields[k]
+			if !ok {
+				return configErrorf(joinKey(key, k), "unknown key")
+			}
+			if err := decodeConfigValue(joinKey(key, k), m[k], out.Field(i)); err != nil {
+				return err
+			}
+		}
+
+	default:
+		return configErrorf(key, "unsupported type %s", out.Type())
+	}
+	return nil
+}
+
+// Validate checks config semantically and fills inferred executor type
+func (c *Config) Validate() error {
+	if c.Entry == "" {
+		return configErrorf("entry", "is required")
+	}
+	if c.Bundle == "" {
+		return configErrorf("bundle", "is required")
+	}
+
+	if err := validateExecutor("executor", &c.Executor); err != nil {
+		return err
+	}
+	for _, name := range c.scenarioNames() {
+		key := "scenarios." + name
+		scenario := c.Scenarios[name]
+		if err := validateExecutor(key+".executor", &scenario.Executor); err != nil {
+			return err
+		}
+		if scenario.StartTime < 0 {
+			return configErrorf(key+".start_time", "can not be negative")
+		}
+		c.Scenarios[name] = scenario
+	}
+
+	for i, o := range c.Outputs {
+		switch o.Type {
+		case OutputConsole:
+		case OutputJSON:
+			if o.Path == "" {
+				return configErrorf(fmt.Sprintf("outputs[%d].path", i), "is required by output %s", o.Type)
+			}
+		default:
+			return configErrorf(fmt.Sprintf("outputs[%d].type", i), "unknown output \"%s\", expect one of %s and %s",
+				o.Type, OutputConsole, OutputJSON)
+		}
+	}
+
+	if _, err := c.ParseThresholds(); err != nil {
+		return err
+	}
+
+	if c.HTTP.Timeout < 0 {
+		return configErrorf("http.timeout", "can not be negative")
+	}
+
+	if c.Abort.ErrorRate < 0 || c.Abort.ErrorRate > 1 {
+		return configErrorf("abort.error_rate", "has to be between 0 and 1")
+	}
+	if c.Abort.Window < 0 {
+		return configErrorf("abort.window", "can not be negative")
+	}
+	if c.Abort.ConsecutiveErrors < 0 {
+		return configErrorf("abort.consecutive_errors", "can not be negative")
+	}
+
+	if c.Async.Workers < 0 {
+		return configErrorf("async.workers", "can not be negative")
+	}
+	if c.Async.QueueSize < 0 {
+		return configErrorf("async.queue_size", "can not be negative")
+	}
+	if c.Async.Timeout < 0 {
+		return configErrorf("async.timeout", "can not be negative")
+	}
+
+	return c.Sandbox.Validate()
+}
+
+// validateExecutor checks executor under key and fills inferred type
+func validateExecutor(key string, e *ExecutorConfig) error {
+	if e.Type == "" {
+		switch {
+		case len(e.Stages) > 0:
+			e.Type = ExecutorRampingVUs
+		case e.Duration > 0:
+			e.Type = ExecutorDuration
+		default:
+			e.Type = ExecutorIterations
+		}
+	}
+	switch e.Type {
+	case ExecutorIterations:
+		if e.Iterations < 0 {
+			return configErrorf(key+".iterations", "can not be negative")
+		}
+	case ExecutorDuration:
+		if e.Duration <= 0 {
+			return configErrorf(key+".duration", "is required by executor %s", e.Type)
+		}
+	case ExecutorRampingVUs:
+		if len(e.Stages) == 0 {
+			return configErrorf(key+".stages", "is required by executor %s", e.Type)
+		}
+		for i, s := range e.Stages {
+			if s.Duration <= 0 {
+				return configErrorf(fmt.Sprintf("%s.stages[%d].duration", key, i), "has to be positive")
+			}
+			if s.Target < 0 {
+				return configErrorf(fmt.Sprintf("%s.stages[%d].target", key, i), "can not be negative")
+			}
+		}
+	default:
+		return configErrorf(key+".type", "unknown executor \"%s\", expect one of %s, %s and %s",
+			e.Type, ExecutorIterations, ExecutorDuration, ExecutorRampingVUs)
+	}
+	if e.VUs < 0 {
+		return configErrorf(key+".vus", "can not be negative")
+	}
+	if e.Rate < 0 {
+		return configErrorf(key+".rate", "can not be negative")
+	}
+	return nil
+}
+
+func (c *Config) scenarioNames() []string {
+	names := make([]string, 0, len(c.Scenarios))
+	for name := range c.Scenarios {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// scenario converts executor of validated config to a scenario, settings not used by its type are left zero
+func (e *ExecutorConfig) scenario(name string) Scenario {
+	s := Scenario{
+		Name:        name,
+		Concurrency: e.VUs,
+		Rate:        e.Rate,
+	}
+	switch e.Type {
+	case ExecutorDuration:
+		s.Duration = e.Duration
+	case ExecutorRampingVUs:
+		for _, stage := range e.Stages {
+			s.Stages = append(s.Stages, Stage{Duration: stage.Duration, Target: stage.Target})
+		}
+	default:
+		s.Amount = e.Iterations
+	}
+	return s
+}
+
+// StartOptions converts validated config to options of a job, unset settings are left zero to be filled from script options
+func (c *Config) StartOptions() *StartOptions {
+	top := c.Executor.scenario(DefaultScenario)
+	opts := &StartOptions{
+		Entry:       c.Entry,
+		Concurrency: top.Concurrency,
+		Amount:      top.Amount,
+		Duration:    top.Duration,
+		Stages:      top.Stages,
+		Rate:        top.Rate,
+		Envs:        c.Env,
+		AbortPolicy: AbortPolicy{
+			ErrorRate:         c.Abort.ErrorRate,
+			Window:            c.Abort.Window,
+			ConsecutiveErrors: c.Abort.ConsecutiveErrors,
+		},
+		HTTPClient: c.HTTP.NewHTTPClient(),
+		Async: AsyncOptions{
+			Workers:   c.Async.Workers,
+			QueueSize: c.Async.QueueSize,
+			Timeout:   c.Async.Timeout,
+		},
+		Tags:       c.Tags,
+		Thresholds: c.Thresholds,
+		ModulePath: c.ModulePath,
+		Sandbox:    c.Sandbox.Sandbox(),
+	}
+	if opts.AbortPolicy.Window == 0 {
+		opts.AbortPolicy.Window = time.Second * 30
+	}
+
+	for _, name := range c.scenarioNames() {
+		sc := c.Scenarios[name]
+		s := sc.Executor.scenario(name)
+		s.Exec = sc.Exec
+		s.StartAfter = sc.StartTime
+		s.Envs = sc.Env
+		s.Tags = sc.Tags
+		opts.Scenarios = append(opts.Scenarios, s)
+	}
+	return opts
+}
+
+// ParseThresholds parses thresholds ordered by metric
+func (c *Config) ParseThresholds() ([]*stat.Threshold, error) {
+	return parseThresholds(c.Thresholds)
+}
+
+func parseThresholds(thresholds map[string][]string) ([]*stat.Threshold, error) {
+	metrics := make([]string, 0, len(thresholds))
+	for metric := range thresholds {
+		metrics = append(metrics, metric)
+	}
+	sort.Strings(metrics)
+
+	var result []*stat.Threshold
+	for _, metric := range metrics {
+		for i, expression := range thresholds[metric] {
+			t, err := stat.ParseThreshold(metric, expression)
+			if err != nil {
+				return nil, configErrorf(fmt.Sprintf("thresholds.%s[%d]", metric, i), "%s", err.Error())
+			}
+			result = append(result, t)
+		}
+	}
+	return result, nil
+}
+
+// NewHTTPClient creates client used by http module, nil if defaults are not changed
+func (c *HTTPConfig) NewHTTPClient() *http.Client {
+	if c.Timeout == 0 && !c.InsecureSkipVerify && len(c.Headers) == 0 {
+		return nil
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if c.InsecureSkipVerify {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true} //nolint:gosec
+	}
+	var rt http.RoundTripper = transport
+	if len(c.Headers) > 0 {
+		rt = &headerTransport{RoundTripper: transport, headers: c.Headers}
+	}
+	return &http.Client{
+		Timeout:   c.Timeout,
+		Transport: rt,
+	}
+}
+
+// headerTransport sets default headers, headers set by scripts are kept
+type headerTransport struct {
+	http.RoundTripper
+	headers map[string]string
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	for k, v := range t.headers {
+		if req.Header.Get(k) == "" {
+			req.Header.Set(k, v)
+		}
+	}
+	return t.RoundTripper.RoundTrip(req)
+}
@@ -0,0 +1,177 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	luavm "github.com/joesonw/lte/pkg/lua/vm"
+)
+
+func TestParseConfig(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`
+entry: main.lua
+bundle: ./scripts
+env:
+  HOST: example.com
+  PORT: 8080
+tags:
+  team: search
+executor:
+  vus: 2
+  rate: 10
+  stages:
+    - duration: 10s
+      target: 5
+    - duration: 1m
+      target: 0
+outputs:
+  - type: json
+    path: out.jsonl
+thresholds:
+  http.duration_ns: ["p(95) < 200ms"]
+  http.success: ["rate > 0.99"]
+http:
+  timeout: 5s
+  headers:
+    User-Agent: lte
+abort:
+  consecutive_errors: 10
+async:
+  workers: 16
+  queue_size: 256
+sandbox:
+  enabled: true
+  instruction_budget: 1000000
+  memory_limit_mb: 512
+`), false)
+	assert.Nil(t, err)
+	assert.Nil(t, cfg.Validate())
+	assert.Equal(t, ExecutorRampingVUs, cfg.Executor.Type)
+	assert.Equal(t, "8080", cfg.Env["PORT"])
+	assert.Equal(t, time.Minute, cfg.Executor.Stages[1].Duration)
+	assert.Equal(t, time.Second*5, cfg.HTTP.Timeout)
+	assert.Equal(t, int64(10), cfg.Abort.ConsecutiveErrors)
+	assert.Equal(t, AsyncOptions{Workers: 16, QueueSize: 256}, cfg.StartOptions().Async)
+	assert.Equal(t, &luavm.Sandbox{InstructionBudget: 1000000, MemoryLimit: 512 << 20}, cfg.StartOptions().Sandbox)
+
+	thresholds, err := cfg.ParseThresholds()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(thresholds))
+
+	cfg, err = ParseConfig([]byte(`{"entry": "main.lua", "bundle": "b.zip", "executor": {"duration": "1m"}}`), true)
+	assert.Nil(t, err)
+	assert.Nil(t, cfg.Validate())
+	assert.Equal(t, ExecutorDuration, cfg.Executor.Type)
+}
+
+func TestParseConfigErrorKey(t *testing.T) {
+	for src, key := range map[string]string{
+		"executor:\n  vu: 1":     "executor.vu",
+		"executor:\n  vus: many": "executor.vus",
+		"executor:\n  stages:\n    - target: 1\n    - duration: soon": "executor.stages[1].duration",
+		"outputs: console":                "outputs",
+		"http:\n  headers:\n    X-A: [1]": "http.headers.X-A",
+	} {
+		_, err := ParseConfig([]byte(src), false)
+		configErr, ok := err.(*ConfigError)
+		if assert.True(t, ok, src) {
+			assert.Equal(t, key, configErr.Key, src)
+		}
+	}
+}
+
+func TestConfigValidateErrorKey(t *testing.T) {
+	base := "entry: main.lua\nbundle: b.zip\n"
+	for src, key := range map[string]string{
+		"bundle: b.zip":                                "entry",
+		base + "executor:\n  type: constant":           "executor.type",
+		base + "executor:\n  type: ramping-vus":        "executor.stages",
+		base + "executor:\n  stages:\n    - target: 1": "executor.stages[0].duration",
+		base + "outputs:\n  - type: json":              "outputs[0].path",
+		base + "thresholds:\n  run.cost: [fast]":       "thresholds.run.cost[0]",
+		base + "abort:\n  error_rate: 2":               "abort.error_rate",
+		base + "async:\n  workers: -1":                 "async.workers",
+		base + "sandbox:\n  timeout: -1s":              "sandbox.timeout",
+	} {
+		cfg, err := ParseConfig([]byte(src), false)
+		assert.Nil(t, err, src)
+		configErr, ok := cfg.Validate().(*ConfigError)
+		if assert.True(t, ok, src) {
+			assert.Equal(t, key, configErr.Key, src)
+		}
+	}
+}
+
+func TestConfigScenarios(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`
+entry: main.lua
+bundle: b.zip
+executor:
+  vus: 3
+scenarios:
+  checkout:
+    exec: checkout
+    executor:
+      stages:
+        - duration: 1m
+          target: 2
+    start_time: 30s
+    tags:
+      flow: write
+  browse:
+    exec: browse
+    executor:
+      vus: 8
+      duration: 2m
+      rate: 100
+`), false)
+	assert.Nil(t, err)
+	assert.Nil(t, cfg.Validate())
+
+	opts := cfg.StartOptions()
+	assert.Equal(t, 3, opts.Concurrency)
+	assert.Equal(t, time.Second*30, opts.AbortPolicy.Window)
+	assert.Equal(t, 2, len(opts.Scenarios))
+	browse, checkout := opts.Scenarios[0], opts.Scenarios[1]
+	assert.Equal(t, "browse", browse.Name)
+	assert.Equal(t, 8, browse.Concurrency)
+	assert.Equal(t, time.Minute*2, browse.Duration)
+	assert.Equal(t, float64(100), browse.Rate)
+	assert.Equal(t, "checkout", checkout.Name)
+	assert.Equal(t, []Stage{{Duration: time.Minute, Target: 2}}, checkout.Stages)
+	assert.Equal(t, time.Second*30, checkout.StartAfter)
+	assert.Equal(t, "write", checkout.Tags["flow"])
+}
+
+func TestHTTPConfigHeaders(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Header.Get("User-Agent") + "," + r.Header.Get("X-Token")))
+	}))
+	defer server.Close()
+
+	cfg := &HTTPConfig{Headers: map[string]string{"User-Agent": "lte", "X-Token": "default"}}
+	client := cfg.NewHTTPClient()
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	req.Header.Set("X-Token", "script")
+	res, err := client.Do(req)
+	assert.Nil(t, err)
+	defer res.Body.Close()
+	b := make([]byte, 64)
+	n, _ := res.Body.Read(b)
+	assert.Equal(t, "lte,script", string(b[:n]))
+
+	assert.Nil(t, (&HTTPConfig{}).NewHTTPClient())
+}
+
+func TestStageTarget(t *testing.T) {
+	stages := []Stage{{Duration: time.Second * 10, Target: 10}, {Duration: time.Second * 10, Target: 0}}
+	assert.Equal(t, 1, stageTarget(stages, 1, 0))
+	assert.Equal(t, 5, stageTarget(stages, 0, time.Second*5))
+	assert.Equal(t, 10, stageTarget(stages, 0, time.Second*10))
+	assert.Equal(t, 5, stageTarget(stages, 0, time.Second*15))
+	assert.Equal(t, 0, stageTarget(stages, 0, time.Minute))
+}
@@ -0,0 +1,80 @@
+package app
+
+import (
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+
+	"github.com/joesonw/lte/pkg/convert"
+)
+
+const convertFromHAR = "har"
+
+func MakeCmdConvert(
+	pLogger **zap.Logger,
+) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "convert --from har <file>",
+		Short: "convert recorded requests to a script, which is written to stdout unless --out is given",
+	}
+
+	pFrom := cmd.Flags().String("from", convertFromHAR, "format of input, only har is supported")
+	pOut := cmd.Flags().StringP("out", "o", "", "file script is written to")
+	filter, options := addConvertFlags(cmd)
+
+	cmd.Args = cobra.ExactArgs(1)
+	cmd.Run = func(cmd *cobra.Command, args []string) {
+		logger := *pLogger
+		if *pFrom != convertFromHAR {
+			logger.Fatal("unsupported format " + *pFrom)
+		}
+
+		f, err := os.Open(args[0])
+		if err != nil {
+			logger.Fatal("unable to open input", zap.Error(err))
+		}
+		defer f.Close()
+		requests, err := convert.ReadHAR(f)
+		if err != nil {
+			logger.Fatal("unable to read input", zap.Error(err))
+		}
+
+		groups := convert.GroupByPage(convert.Select(requests, *filter))
+		if err := writeScript(*pOut, groups, *options); err != nil {
+			logger.Fatal("unable to write script", zap.Error(err))
+		}
+	}
+
+	return cmd
+}
+
+// addConvertFlags adds flags filtering requests and shaping script, values are filled once flags are parsed
+func addConvertFlags(cmd *cobra.Command) (*convert.Filter, *convert.Options) {
+	filter := &convert.Filter{}
+	options := &convert.Options{}
+	cmd.Flags().StringArrayVar(&filter.Domains, "domain", nil, "only convert requests to this domain and its subdomains, repeatable")
+	cmd.Flags().BoolVar(&filter.ExcludeStatic, "exclude-static", false, "drop scripts, styles, images, fonts and media")
+	cmd.Flags().BoolVar(&options.ThinkTime, "think-time", false, "sleep for gaps between recorded requests")
+	cmd.Flags().DurationVar(&options.MinThinkTime, "min-think-time", convert.DefaultMinThinkTime, "shortest gap slept for with --think-time")
+	return filter, options
+}
+
+// writeScript writes script of groups to path, or stdout if path is empty
+func writeScript(path string, groups []*convert.Group, options convert.Options) error {
+	if len(groups) == 0 {
+		return errors.New("no request to convert")
+	}
+	var w io.Writer = os.Stdout
+	if path != "" {
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	return convert.Generate(w, groups, options)
+}
@@ -0,0 +1,282 @@
+package app
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	apiv1 "github.com/joesonw/lte/pkg/api/v1"
+	luacontext "github.com/joesonw/lte/pkg/lua/context"
+	luavm "github.com/joesonw/lte/pkg/lua/vm"
+	"github.com/joesonw/lte/pkg/stat"
+)
+
+const statsBufferSize = 4096
+
+var (
+	errJobRunning = errors.New("a job is running")
+	errNoJob      = errors.New("no job started")
+)
+
+// StartOptions are settings of a job, zero values are filled from script options, see mergeScriptOptions
+type StartOptions struct {
+	Entry string
+	// Concurrency is initial amount of vms, 0 for script options or 1
+	Concurrency int
+	Amount      int64
+	Duration    time.Duration
+	Stages      []Stage
+	Rate        float64
+	Envs        map[string]string
+	StartAt     time.Time
+	AbortPolicy AbortPolicy
+	HTTPClient  *http.Client
+	Async       AsyncOptions
+	Tags        map[string]string
+	Thresholds  map[string][]string
+	// ModulePath is package.path searched by require in bundle, e.g. "?.lua;lib/?.lua"
+	ModulePath string
+	// Sandbox is applied to all vms of the job, scripts are trusted if nil
+	Sandbox *luavm.Sandbox
+	// Scenarios run concurrently, top level run mode, concurrency and rate are used only if there is no scenario
+	Scenarios []Scenario
+	// Barrier is shared by vms of the job, e.g. one coordinated by the controller across agents, local if nil
+	Barrier luacontext.Barrier
+}
+
+// Engine runs one job at a time on the loaded bundle, it backs both local runs and the agent server
+type Engine struct {
+	logger   *zap.Logger
+	reporter stat.Reporter
+	newFS    func() afero.Fs
+
+	mu    *sync.Mutex
+	fs    afero.Fs
+	job   *Job
+	state apiv1.JobState
+	stats *stat.Broadcaster
+	// nextStats is subscribed ahead of the job started next, it becomes stats of that job
+	nextStats  *stat.Broadcaster
+	logs       *logBroadcaster
+	chFinished chan struct{}
+}
+
+// NewEngine creates an engine, reporter receives stats of all jobs besides subscribers, newFS creates writable filesystem for vms
+func NewEngine(logger *zap.Logger, reporter stat.Reporter, newFS func() afero.Fs) *Engine {
+	return &Engine{
+		logger:   logger,
+		reporter: reporter,
+		newFS:    newFS,
+		mu:       &sync.Mutex{},
+	}
+}
+
+func (e *Engine) isBusy() bool {
+	return e.state == apiv1.JobState_JOB_STATE_WAITING || e.state == apiv1.JobState_JOB_STATE_RUNNING
+}
+
+// Load replaces bundle used by subsequent jobs
+func (e *Engine) Load(fs afero.Fs) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.isBusy() {
+		return errJobRunning
+	}
+	e.fs = fs
+	return nil
+}
+
+func (e *Engine) Start(opts *StartOptions) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.isBusy() {
+		return errJobRunning
+	}
+	if e.fs == nil {
+		return errors.New("no bundle loaded")
+	}
+	if opts.Concurrency < 0 {
+		return errors.New("concurrency can not be negative")
+	}
+
+	stats := e.nextStats
+	if stats == nil {
+		stats = stat.NewBroadcaster(statsBufferSize)
+	}
+	logs := newLogBroadcaster()
+	logger := e.logger.WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		return zapcore.NewTee(core, logs.Core())
+	}))
+	job, err := NewJob(logger, e.fs, opts, e.newFS, stat.Multi(stats, e.reporter))
+	if err != nil {
+		return err
+	}
+
+	e.job = job
+	e.stats = stats
+	e.nextStats = nil
+	e.logs = logs
+	e.state = apiv1.JobState_JOB_STATE_WAITING
+	e.chFinished = make(chan struct{})
+	go e.run(job, job.Options(), e.chFinished)
+	return nil
+}
+
+func (e *Engine) run(job *Job, opts *StartOptions, chFinished chan struct{}) {
+	defer func() {
+		job.Close()
+		e.mu.Lock()
+		e.state = apiv1.JobState_JOB_STATE_FINISHED
+		stats, logs := e.stats, e.logs
+		e.mu.Unlock()
+		if err := stats.Finish(); err != nil {
+			e.logger.Error("unable to finish stats", zap.Error(err))
+		}
+		logs.Finish()
+		close(chFinished)
+	}()
+
+	if !opts.StartAt.IsZero() {
+		timer := time.NewTimer(time.Until(opts.StartAt))
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-job.chStop:
+			return
+		}
+	}
+
+	e.mu.Lock()
+	e.state = apiv1.JobState_JOB_STATE_RUNNING
+	e.mu.Unlock()
+
+	job.Run()
+}
+
+// Wait blocks until current job is finished, returns the job
+func (e *Engine) Wait() (*Job, error) {
+	e.mu.Lock()
+	job, chFinished := e.job, e.chFinished
+	e.mu.Unlock()
+	if job == nil {
+		return nil, errNoJob
+	}
+	<-chFinished
+	return job, nil
+}
+
+func (e *Engine) currentJob() (*Job, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.job == nil {
+		return nil, errNoJob
+	}
+	return e.job, nil
+}
+
+func (e *Engine) Stop() {
+	if job, err := e.currentJob(); err == nil {
+		job.Stop()
+	}
+}
+
+// Cancel stops current job and cancels its running async tasks
+func (e *Engine) Cancel() {
+	if job, err := e.currentJob(); err == nil {
+		job.Cancel()
+	}
+}
+
+func (e *Engine) Pause() error {
+	job, err := e.currentJob()
+	if err != nil {
+		return err
+	}
+	job.Pause()
+	return nil
+}
+
+func (e *Engine) Resume() error {
+	job, err := e.currentJob()
+	if err != nil {
+		return err
+	}
+	job.Resume()
+	return nil
+}
+
+func (e *Engine) Scale(concurrency int) error {
+	job, err := e.currentJob()
+	if err != nil {
+		return err
+	}
+	return job.SetConcurrency(concurrency)
+}
+
+// ScaleScenario changes concurrency of a scenario of current job
+func (e *Engine) ScaleScenario(name string, concurrency int) error {
+	job, err := e.currentJob()
+	if err != nil {
+		return err
+	}
+	return job.ScaleScenario(name, concurrency)
+}
+
+func (e *Engine) Status() *apiv1.StatusResponse {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	res := &apiv1.StatusResponse{
+		State: e.state,
+	}
+	if e.job == nil {
+		return res
+	}
+
+	res.FinishedAmount = e.job.FinishedAmount()
+	res.Concurrency = int32(e.job.Concurrency())
+	res.ElapsedNs = e.job.Elapsed().Nanoseconds()
+	res.AsyncPending = e.job.AsyncPending()
+	if e.state == apiv1.JobState_JOB_STATE_RUNNING && e.job.Paused() {
+		res.State = apiv1.JobState_JOB_STATE_PAUSED
+	}
+	if e.state == apiv1.JobState_JOB_STATE_FINISHED {
+		res.Aborted = e.job.Aborted()
+		res.AbortReason = e.job.AbortReason()
+	}
+	return res
+}
+
+// SubscribeStats subscribes to stats of current job, or the job started next if next is set, the channel is closed when
+// the job finishes
+func (e *Engine) SubscribeStats(next bool) (<-chan *stat.Stat, func(), error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if next {
+		if e.nextStats == nil {
+			e.nextStats = stat.NewBroadcaster(statsBufferSize)
+		}
+		ch, unsubscribe := e.nextStats.Subscribe()
+		return ch, unsubscribe, nil
+	}
+	if e.stats == nil {
+		return nil, nil, errNoJob
+	}
+	ch, unsubscribe := e.stats.Subscribe()
+	return ch, unsubscribe, nil
+}
+
+// SubscribeLogs subscribes to logs of current job, the channel is closed when job finishes
+func (e *Engine) SubscribeLogs(level zapcore.Level) (<-chan *apiv1.LogEntry, func(), error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.logs == nil {
+		return nil, nil, errNoJob
+	}
+	ch, unsubscribe := e.logs.Subscribe(level)
+	return ch, unsubscribe, nil
+}
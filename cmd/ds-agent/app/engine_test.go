@@ -0,0 +1,190 @@
+package app
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	apiv1 "github.com/joesonw/lte/pkg/api/v1"
+	"github.com/joesonw/lte/pkg/stat"
+)
+
+func newTestEngine(t *testing.T, script string) *Engine {
+	fs := afero.NewMemMapFs()
+	assert.Nil(t, afero.WriteFile(fs, "main.lua", []byte(script), 0600))
+	engine := NewEngine(zap.NewNop(), stat.Noop(), afero.NewMemMapFs)
+	assert.Nil(t, engine.Load(fs))
+	return engine
+}
+
+func TestEngineControl(t *testing.T) {
+	engine := newTestEngine(t, `
+		function run(id)
+			sleep(1000000)()
+		end
+	`)
+	assert.Nil(t, engine.Start(&StartOptions{
+		Entry:       "main.lua",
+		Concurrency: 1,
+		Duration:    time.Minute,
+	}))
+	assert.Equal(t, errJobRunning, engine.Start(&StartOptions{Entry: "main.lua", Concurrency: 1}))
+
+	assert.Nil(t, engine.Scale(3))
+	assert.Eventually(t, func() bool {
+		return engine.Status().GetConcurrency() == 3 && engine.Status().GetFinishedAmount() > 10
+	}, time.Second, time.Millisecond*10)
+
+	assert.Nil(t, engine.Pause())
+	assert.Equal(t, apiv1.JobState_JOB_STATE_PAUSED, engine.Status().GetState())
+	time.Sleep(time.Millisecond * 10)
+	paused := engine.Status().GetFinishedAmount()
+	time.Sleep(time.Millisecond * 50)
+	assert.Equal(t, paused, engine.Status().GetFinishedAmount())
+
+	assert.Nil(t, engine.Resume())
+	assert.Eventually(t, func() bool {
+		return engine.Status().GetFinishedAmount() > paused
+	}, time.Second, time.Millisecond*10)
+
+	assert.Nil(t, engine.Scale(1))
+	assert.NotNil(t, engine.Scale(0))
+
+	engine.Stop()
+	job, err := engine.Wait()
+	assert.Nil(t, err)
+	assert.False(t, job.Aborted())
+	assert.Equal(t, apiv1.JobState_JOB_STATE_FINISHED, engine.Status().GetState())
+}
+
+func TestEngineLogs(t *testing.T) {
+	engine := newTestEngine(t, `
+		function run(id)
+			print("hello " .. id)
+		end
+	`)
+	assert.Nil(t, engine.Start(&StartOptions{
+		Entry:       "main.lua",
+		Concurrency: 1,
+		Amount:      3,
+		StartAt:     time.Now().Add(time.Millisecond * 50),
+	}))
+
+	ch, unsubscribe, err := engine.SubscribeLogs(zapcore.InfoLevel)
+	assert.Nil(t, err)
+	defer unsubscribe()
+
+	var messages []string
+	for entry := range ch {
+		if entry.GetLevel() == "info" && len(entry.GetMessage()) > 6 && entry.GetMessage()[:6] == "hello " {
+			messages = append(messages, entry.GetMessage())
+		}
+	}
+	assert.Equal(t, []string{"hello 1", "hello 2", "hello 3"}, messages)
+}
+
+func TestEngineStages(t *testing.T) {
+	engine := newTestEngine(t, `
+		function run(id)
+			sleep(1000000)()
+		end
+	`)
+	assert.Nil(t, engine.Start(&StartOptions{
+		Entry:       "main.lua",
+		Concurrency: 1,
+		Stages:      []Stage{{Duration: time.Millisecond * 600, Target: 4}, {Duration: time.Millisecond * 600, Target: 4}},
+	}))
+	assert.Eventually(t, func() bool {
+		return engine.Status().GetConcurrency() == 4
+	}, time.Second*2, time.Millisecond*10)
+
+	job, err := engine.Wait()
+	assert.Nil(t, err)
+	assert.True(t, job.FinishedAmount() > 0)
+}
+
+func TestEngineAbortPolicyDelayedStart(t *testing.T) {
+	for name, opts := range map[string]*StartOptions{
+		"start at": {
+			Duration: time.Millisecond * 100,
+			StartAt:  time.Now().Add(time.Millisecond * 300),
+		},
+		"start after": {
+			Scenarios: []Scenario{{
+				Name:       DefaultScenario,
+				Duration:   time.Millisecond * 100,
+				StartAfter: time.Millisecond * 300,
+			}},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			engine := newTestEngine(t, `
+				function run(id)
+					sleep(1000000)()
+					error("failed")
+				end
+			`)
+			opts.Entry = "main.lua"
+			// the job runs shorter than the window, which is never fully observed unless the delay counts
+			opts.AbortPolicy = AbortPolicy{ErrorRate: 0.5, Window: time.Millisecond * 200}
+			assert.Nil(t, engine.Start(opts))
+
+			job, err := engine.Wait()
+			assert.Nil(t, err)
+			assert.False(t, job.Aborted(), job.AbortReason())
+			assert.True(t, job.FinishedAmount() > 0)
+		})
+	}
+}
+
+type collectReporter struct {
+	mu    sync.Mutex
+	stats []*stat.Stat
+}
+
+func (r *collectReporter) Report(stats ...*stat.Stat) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stats = append(r.stats, stats...)
+}
+
+func (r *collectReporter) Finish() error { return nil }
+
+func TestEngineAsyncPoolStat(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	assert.Nil(t, afero.WriteFile(fs, "main.lua", []byte(`
+		function run(id)
+			local a, b = sleep(50000000), sleep(50000000)
+			a()
+			b()
+		end
+	`), 0600))
+	reporter := &collectReporter{}
+	engine := NewEngine(zap.NewNop(), reporter, afero.NewMemMapFs)
+	assert.Nil(t, engine.Load(fs))
+	assert.Nil(t, engine.Start(&StartOptions{
+		Entry:       "main.lua",
+		Concurrency: 2,
+		Duration:    time.Millisecond * 1200,
+		Async:       AsyncOptions{Workers: 1},
+	}))
+	_, err := engine.Wait()
+	assert.Nil(t, err)
+
+	reporter.mu.Lock()
+	defer reporter.mu.Unlock()
+	var found bool
+	for _, s := range reporter.stats {
+		if s.Name == "async_pool" {
+			found = true
+			// with a single worker the second sleep of each run waits for the first one
+			assert.True(t, s.Fields["wait_avg_ns"] > float64(time.Millisecond*10), s.Fields)
+		}
+	}
+	assert.True(t, found)
+}
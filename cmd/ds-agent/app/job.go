@@ -1,13 +1,15 @@
 package app
 
 import (
-	"fmt"
+	"net/http"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
 	"github.com/spf13/afero"
+	lua "github.com/yuin/gopher-lua"
 	"go.uber.org/zap"
 
 	luacontext "github.com/joesonw/lte/pkg/lua/context"
@@ -16,108 +18,446 @@ import (
 	"github.com/joesonw/lte/pkg/stat"
 )
 
+const (
+	// rampInterval is how often concurrency is adjusted while running stages
+	rampInterval = time.Millisecond * 250
+	// asyncStatInterval is how often queue depth and wait time of async pools are reported
+	asyncStatInterval = time.Second
+
+	DefaultAsyncWorkers   = 4
+	DefaultAsyncQueueSize = 64
+	DefaultAsyncTimeout   = time.Second * 30
+)
+
+// AsyncOptions sizes the async pool of each vm, zero values are replaced with defaults
+type AsyncOptions struct {
+	Workers   int
+	QueueSize int
+	Timeout   time.Duration
+}
+
+func (o AsyncOptions) withDefaults() AsyncOptions {
+	if o.Workers <= 0 {
+		o.Workers = DefaultAsyncWorkers
+	}
+	if o.QueueSize <= 0 {
+		o.QueueSize = DefaultAsyncQueueSize
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = DefaultAsyncTimeout
+	}
+	return o
+}
+
+// Stage ramps concurrency linearly to Target over Duration
+type Stage struct {
+	Duration time.Duration
+	Target   int
+}
+
+type vu struct {
+	vm     *luavm.VM
+	chStop chan struct{}
+}
+
+// Job runs scenarios of a script concurrently, vms of all scenarios share unique values, each vm has its own async pool
 type Job struct {
-	logger       *zap.Logger
-	fs           afero.Fs
-	vms          []*luavm.VM
-	concurrency  int
-	global       *luacontext.Global
-	statReporter stat.Reporter
+	logger     *zap.Logger
+	fs         afero.Fs
+	newFS      func() afero.Fs
+	httpClient *http.Client
+	proto      *lua.FunctionProto
+	async      AsyncOptions
+	modulePath string
+	sandbox    *luavm.Sandbox
+	reporter   stat.Reporter
+	global     *luacontext.Global
+	options    *StartOptions
+	thresholds *stat.ThresholdReporter
+	scenarios  []*scenario
 
+	mu        *sync.Mutex
+	vms       []*luavm.VM
+	running   bool
+	chResume  chan struct{}
+	startedAt time.Time
+
+	counter        int64
 	finishedAmount int64
-	startedAt      time.Time
-	totalAmount    int64
-	totalDuration  time.Duration
+
+	stopOnce     *sync.Once
+	chStop       chan struct{}
+	abortMonitor *abortMonitor
+	abortReason  string
 }
 
+// NewJob compiles entry and evaluates it once to read script options, which are merged with opts, see mergeScriptOptions
 func NewJob(
 	logger *zap.Logger,
 	fs afero.Fs,
-	entry string,
-	concurrency int,
-	envs map[string]string,
+	opts *StartOptions,
 	newFS func() afero.Fs,
 	reporter stat.Reporter,
 ) (*Job, error) {
-	source, err := afero.ReadFile(fs, entry)
+	source, err := afero.ReadFile(fs, opts.Entry)
 	if err != nil {
 		return nil, errors.Wrap(err, "unable to open entry file")
 	}
 
-	proto, err := luavm.Compile(string(source), entry)
+	proto, err := luavm.Compile(string(source), opts.Entry)
 	if err != nil {
 		return nil, errors.Wrap(err, "unable to compile")
 	}
 
-	global := luacontext.NewGlobal(reporter)
-	vms := make([]*luavm.VM, concurrency)
-	asyncPool := libpool.NewAsync(logger, 4, time.Second*30, 64)
-	for i := 0; i < concurrency; i++ {
+	j := &Job{
+		logger:     logger,
+		fs:         fs,
+		newFS:      newFS,
+		httpClient: opts.HTTPClient,
+		proto:      proto,
+		async:      opts.Async.withDefaults(),
+		modulePath: opts.ModulePath,
+		sandbox:    opts.Sandbox,
+		global:     luacontext.NewGlobal(reporter),
+		mu:         &sync.Mutex{},
+		startedAt:  time.Now(),
+		stopOnce:   &sync.Once{},
+		chStop:     make(chan struct{}),
+	}
+
+	probe, err := j.newVM(j.global, opts.Envs, "")
+	if err != nil {
+		return nil, err
+	}
+	scriptOptions, err := readScriptOptions(probe)
+	probe.Stop()
+	j.global.Close()
+	j.vms = nil
+	if err != nil {
+		return nil, err
+	}
 
-		vms[i] = luavm.New(logger, asyncPool, global, luavm.Parameters{
-			EnvVars:    envs,
-			Filesystem: afero.NewCopyOnWriteFs(fs, newFS()),
-		})
-		if err := vms[i].Load(proto); err != nil {
+	opts = mergeScriptOptions(opts, scriptOptions)
+	thresholds, err := parseThresholds(opts.Thresholds)
+	if err != nil {
+		return nil, err
+	}
+	if len(thresholds) > 0 {
+		j.thresholds = stat.NewThresholdReporter(thresholds)
+		reporter = stat.Multi(reporter, j.thresholds)
+	}
+	reporter = stat.Tagged(reporter, opts.Tags)
+	j.reporter = reporter
+	j.options = opts
+	j.global = luacontext.NewGlobal(reporter)
+	if opts.Barrier != nil {
+		j.global.SetBarrier(opts.Barrier)
+	}
+	scenarios := opts.Scenarios
+	if len(scenarios) == 0 {
+		scenarios = []Scenario{{
+			Name:        DefaultScenario,
+			Concurrency: opts.Concurrency,
+			Amount:      opts.Amount,
+			Duration:    opts.Duration,
+			Stages:      opts.Stages,
+			Rate:        opts.Rate,
+		}}
+	}
+	names := map[string]bool{}
+	for _, options := range scenarios {
+		if names[options.Name] {
+			return nil, errors.Errorf("duplicated scenario %s", options.Name)
+		}
+		names[options.Name] = true
+		s, err := newScenario(j, options, opts.Envs, reporter)
+		if err != nil {
 			return nil, err
 		}
+		j.scenarios = append(j.scenarios, s)
 	}
+	sort.Slice(j.scenarios, func(a, b int) bool {
+		return j.scenarios[a].options.Name < j.scenarios[b].options.Name
+	})
 
-	return &Job{
-		logger:       logger,
-		fs:           fs,
-		vms:          vms,
-		concurrency:  concurrency,
-		statReporter: reporter,
-		global:       global,
-		startedAt:    time.Now(),
-	}, nil
+	return j, nil
 }
 
-func (j *Job) RunDuration(duration time.Duration) {
-	j.logger.Info(fmt.Sprintf("run in time constraint mode: %s, conncurency: %d", duration.String(), j.concurrency))
-	j.totalDuration = duration
-	stopAt := time.Now().Add(duration)
-	j.Run(func() bool {
-		return time.Now().After(stopAt)
+func (j *Job) newVM(global *luacontext.Global, envs map[string]string, exec string) (*luavm.VM, error) {
+	asyncPool := libpool.NewAsync(j.logger, j.async.Workers, j.async.Timeout, j.async.QueueSize)
+	vm := luavm.New(j.logger, asyncPool, global, luavm.Parameters{
+		EnvVars:    envs,
+		Filesystem: afero.NewCopyOnWriteFs(j.fs, j.newFS()),
+		HTTPClient: j.httpClient,
+		ModulePath: j.modulePath,
+		Sandbox:    j.sandbox,
 	})
+	j.mu.Lock()
+	j.vms = append(j.vms, vm)
+	j.mu.Unlock()
+	if err := vm.Load(j.proto, exec); err != nil {
+		return nil, err
+	}
+	return vm, nil
+}
+
+// Options returns options merged with script options
+func (j *Job) Options() *StartOptions {
+	return j.options
+}
+
+// ThresholdResults evaluates thresholds over stats reported so far, nil if there is no threshold
+func (j *Job) ThresholdResults() []stat.ThresholdResult {
+	if j.thresholds == nil {
+		return nil
+	}
+	return j.thresholds.Results()
+}
+
+// Scenarios returns names of scenarios ordered by name
+func (j *Job) Scenarios() []string {
+	names := make([]string, len(j.scenarios))
+	for i, s := range j.scenarios {
+		names[i] = s.options.Name
+	}
+	return names
+}
+
+func (j *Job) scenario(name string) (*scenario, error) {
+	for _, s := range j.scenarios {
+		if s.options.Name == name {
+			return s, nil
+		}
+	}
+	return nil, errors.Errorf("scenario %s not found", name)
 }
 
-func (j *Job) RunAmount(amount int64) {
-	j.logger.Info(fmt.Sprintf("run in amount mode: %d, conncurency: %d", amount, j.concurrency))
-	var count int64
-	j.totalAmount = amount
-	j.Run(func() bool {
-		return atomic.AddInt64(&count, 1) > amount
+// Stop stops dispatching new iterations, running iterations are allowed to finish
+func (j *Job) Stop() {
+	j.stopOnce.Do(func() {
+		close(j.chStop)
 	})
 }
 
-func (j *Job) Run(shouldStop func() bool) {
-	wg := &sync.WaitGroup{}
-	var counter int64
+// Cancel stops job and cancels running async tasks, e.g. in flight requests
+func (j *Job) Cancel() {
+	j.Stop()
+	j.cancelAsync()
+}
 
+func (j *Job) cancelAsync() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
 	for _, vm := range j.vms {
+		vm.AsyncPool().Cancel()
+	}
+}
+
+func (j *Job) abort(reason string) {
+	j.stopOnce.Do(func() {
+		j.abortReason = reason
+		j.logger.Warn("aborting job: " + reason)
+		close(j.chStop)
+		j.cancelAsync()
+	})
+}
+
+func (j *Job) isStopped() bool {
+	select {
+	case <-j.chStop:
+		return true
+	default:
+		return false
+	}
+}
+
+// Aborted returns if job was stopped due to abort policy
+func (j *Job) Aborted() bool {
+	return j.abortReason != ""
+}
+
+func (j *Job) AbortReason() string {
+	return j.abortReason
+}
+
+func (j *Job) FinishedAmount() int64 {
+	return atomic.LoadInt64(&j.finishedAmount)
+}
+
+func (j *Job) nextIteration() int64 {
+	return atomic.AddInt64(&j.counter, 1)
+}
+
+// record counts a finished iteration and checks abort policy
+func (j *Job) record(failed bool) {
+	if j.abortMonitor != nil {
+		if reason := j.abortMonitor.Record(time.Now(), failed); reason != "" {
+			j.abort(reason)
+		}
+	}
+	atomic.AddInt64(&j.finishedAmount, 1)
+}
+
+// Pause stops dispatching new iterations until Resume is called, running iterations are allowed to finish
+func (j *Job) Pause() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.chResume == nil {
+		j.chResume = make(chan struct{})
+	}
+}
+
+func (j *Job) Resume() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.chResume != nil {
+		close(j.chResume)
+		j.chResume = nil
+	}
+}
+
+func (j *Job) Paused() bool {
+	return j.resumeChan() != nil
+}
+
+func (j *Job) resumeChan() chan struct{} {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.chResume
+}
+
+// Concurrency returns amount of vms running concurrently across scenarios
+func (j *Job) Concurrency() int {
+	var concurrency int
+	for _, s := range j.scenarios {
+		concurrency += s.Concurrency()
+	}
+	return concurrency
+}
+
+// SetConcurrency changes amount of vms running concurrently, vms are created on demand and kept for reuse when scaled down.
+// Stopped vms are allowed to finish their current iteration. Jobs of multiple scenarios have to be scaled by ScaleScenario.
+func (j *Job) SetConcurrency(concurrency int) error {
+	if len(j.scenarios) > 1 {
+		return errors.New("job has multiple scenarios, scale a scenario instead")
+	}
+	return j.scenarios[0].SetConcurrency(concurrency)
+}
+
+// ScaleScenario changes concurrency of a scenario, see SetConcurrency
+func (j *Job) ScaleScenario(name string, concurrency int) error {
+	s, err := j.scenario(name)
+	if err != nil {
+		return err
+	}
+	return s.SetConcurrency(concurrency)
+}
+
+// Run runs all scenarios and blocks until they are finished
+func (j *Job) Run() {
+	j.mu.Lock()
+	j.running = true
+	j.startedAt = time.Now()
+	j.mu.Unlock()
+
+	// abort policy observes the job from its first iteration on, rather than from creation or a delayed start
+	if j.options.AbortPolicy.Enabled() {
+		j.abortMonitor = newAbortMonitor(j.options.AbortPolicy, j.startedAt.Add(j.firstStartAfter()))
+	}
+
+	chDone := make(chan struct{})
+	defer close(chDone)
+	go j.reportAsync(chDone)
+
+	wg := &sync.WaitGroup{}
+	for _, s := range j.scenarios {
 		wg.Add(1)
-		go func(vm *luavm.VM) {
+		go func(s *scenario) {
 			defer wg.Done()
-			for {
-				if shouldStop() {
-					return
-				}
-				start := time.Now()
-				if err := vm.Run(atomic.AddInt64(&counter, 1)); err != nil {
-					j.logger.Error("error running script", zap.Error(err))
-				}
-				since := time.Since(start)
-				j.statReporter.Report(stat.New("run").Int64Field("cost", since.Nanoseconds()))
-				atomic.AddInt64(&j.finishedAmount, 1)
-				vm.Reset()
-			}
-		}(vm)
+			s.run()
+		}(s)
 	}
-
 	wg.Wait()
 }
 
+// firstStartAfter returns the earliest start offset of scenarios
+func (j *Job) firstStartAfter() time.Duration {
+	first := j.scenarios[0].options.StartAfter
+	for _, s := range j.scenarios[1:] {
+		if s.options.StartAfter < first {
+			first = s.options.StartAfter
+		}
+	}
+	return first
+}
+
+// AsyncPending returns amount of async tasks queued or running
+func (j *Job) AsyncPending() int64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	var pending int64
+	for _, vm := range j.vms {
+		pending += vm.AsyncPool().Len()
+	}
+	return pending
+}
+
+// reportAsync reports stat async_pool of all vms periodically, wait_avg_ns is the average time tasks picked up in
+// the interval spent in queue
+func (j *Job) reportAsync(chDone <-chan struct{}) {
+	ticker := time.NewTicker(asyncStatInterval)
+	defer ticker.Stop()
+	var lastWaited int64
+	var lastWait time.Duration
+	for {
+		select {
+		case <-ticker.C:
+		case <-chDone:
+			return
+		}
+
+		var queued int
+		var pending, waited int64
+		var wait time.Duration
+		j.mu.Lock()
+		for _, vm := range j.vms {
+			pool := vm.AsyncPool()
+			queued += pool.QueueLen()
+			pending += pool.Len()
+			n, d := pool.Waited()
+			waited += n
+			wait += d
+		}
+		j.mu.Unlock()
+
+		s := stat.New("async_pool").
+			IntField("queue_depth", queued).
+			Int64Field("pending", pending).
+			Int64Field("waited", waited-lastWaited)
+		if waited > lastWaited {
+			s.Int64Field("wait_avg_ns", int64(wait-lastWait)/(waited-lastWaited))
+		}
+		lastWaited, lastWait = waited, wait
+		j.reporter.Report(s)
+	}
+}
+
+// Elapsed returns time passed since job started running
+func (j *Job) Elapsed() time.Duration {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if !j.running {
+		return 0
+	}
+	return time.Since(j.startedAt)
+}
+
 func (j *Job) Close() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, vm := range j.vms {
+		vm.AsyncPool().Cancel()
+		vm.Stop()
+	}
+	j.global.Close()
 }
@@ -0,0 +1,146 @@
+package app
+
+import (
+	"fmt"
+	"sync"
+
+	"go.uber.org/zap/zapcore"
+
+	apiv1 "github.com/joesonw/lte/pkg/api/v1"
+)
+
+const logsBufferSize = 1024
+
+type logSubscriber struct {
+	level zapcore.Level
+	ch    chan *apiv1.LogEntry
+}
+
+// logBroadcaster fans log entries out to subscribers, entries are dropped if a subscriber is falling behind
+type logBroadcaster struct {
+	mu          *sync.RWMutex
+	idCounter   int64
+	subscribers map[int64]*logSubscriber
+	finished    bool
+}
+
+func newLogBroadcaster() *logBroadcaster {
+	return &logBroadcaster{
+		mu:          &sync.RWMutex{},
+		subscribers: map[int64]*logSubscriber{},
+	}
+}
+
+func (b *logBroadcaster) Subscribe(level zapcore.Level) (<-chan *apiv1.LogEntry, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s := &logSubscriber{
+		level: level,
+		ch:    make(chan *apiv1.LogEntry, logsBufferSize),
+	}
+	if b.finished {
+		close(s.ch)
+		return s.ch, func() {}
+	}
+
+	b.idCounter++
+	id := b.idCounter
+	b.subscribers[id] = s
+	return s.ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.subscribers, id)
+	}
+}
+
+func (b *logBroadcaster) enabled(level zapcore.Level) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, s := range b.subscribers {
+		if s.level.Enabled(level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *logBroadcaster) publish(level zapcore.Level, entry *apiv1.LogEntry) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, s := range b.subscribers {
+		if !s.level.Enabled(level) {
+			continue
+		}
+		select {
+		case s.ch <- entry:
+		default:
+		}
+	}
+}
+
+func (b *logBroadcaster) Finish() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.finished {
+		return
+	}
+	b.finished = true
+	for id, s := range b.subscribers {
+		close(s.ch)
+		delete(b.subscribers, id)
+	}
+}
+
+func (b *logBroadcaster) Core() zapcore.Core {
+	return &logCore{broadcaster: b}
+}
+
+type logCore struct {
+	broadcaster *logBroadcaster
+	fields      []zapcore.Field
+}
+
+func (c *logCore) Enabled(level zapcore.Level) bool {
+	return c.broadcaster.enabled(level)
+}
+
+func (c *logCore) With(fields []zapcore.Field) zapcore.Core {
+	return &logCore{
+		broadcaster: c.broadcaster,
+		fields:      append(append([]zapcore.Field{}, c.fields...), fields...),
+	}
+}
+
+func (c *logCore) Check(entry zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(entry.Level) {
+		return ce.AddCore(entry, c)
+	}
+	return ce
+}
+
+func (c *logCore) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	enc := zapcore.NewMapObjectEncoder()
+	for _, f := range c.fields {
+		f.AddTo(enc)
+	}
+	for _, f := range fields {
+		f.AddTo(enc)
+	}
+
+	strFields := map[string]string{}
+	for k, v := range enc.Fields {
+		strFields[k] = fmt.Sprint(v)
+	}
+	c.broadcaster.publish(entry.Level, &apiv1.LogEntry{
+		Level:             entry.Level.String(),
+		TimestampUnixNano: entry.Time.UnixNano(),
+		Message:           entry.Message,
+		Fields:            strFields,
+	})
+	return nil
+}
+
+func (c *logCore) Sync() error {
+	return nil
+}
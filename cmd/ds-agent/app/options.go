@@ -0,0 +1,161 @@
+package app
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	lua "github.com/yuin/gopher-lua"
+
+	luavalue "github.com/joesonw/lte/pkg/lua/value"
+	luavm "github.com/joesonw/lte/pkg/lua/vm"
+)
+
+// ScriptOptions is the global `options` table defined by entry script, e.g.
+//
+//	options = {
+//		vus = 10,
+//		stages = { { duration = "30s", target = 50 } },
+//		thresholds = { ["http.duration_ns"] = { "p(95) < 200ms" } },
+//		tags = { team = "search" },
+//		env = { HOST = "example.com" },
+//		scenarios = {
+//			browse = { exec = "browse", vus = 8, duration = "1m", rate = 100 },
+//			checkout = { exec = "checkout", stages = { { duration = "1m", target = 2 } }, start_time = "10s" },
+//		},
+//	}
+type ScriptOptions struct {
+	VUs        int                        `json:"vus"`
+	Iterations int64                      `json:"iterations"`
+	Duration   time.Duration              `json:"duration"`
+	Rate       float64                    `json:"rate"`
+	Stages     []*ScriptStage             `json:"stages"`
+	Thresholds map[string][]string        `json:"thresholds"`
+	Tags       map[string]string          `json:"tags"`
+	Env        map[string]string          `json:"env"`
+	Scenarios  map[string]*ScriptScenario `json:"scenarios"`
+}
+
+type ScriptScenario struct {
+	Exec       string            `json:"exec"`
+	VUs        int               `json:"vus"`
+	Iterations int64             `json:"iterations"`
+	Duration   time.Duration     `json:"duration"`
+	Rate       float64           `json:"rate"`
+	Stages     []*ScriptStage    `json:"stages"`
+	StartTime  time.Duration     `json:"start_time"`
+	Env        map[string]string `json:"env"`
+	Tags       map[string]string `json:"tags"`
+}
+
+type ScriptStage struct {
+	Duration time.Duration `json:"duration"`
+	Target   int           `json:"target"`
+}
+
+// readScriptOptions reads global `options` of a loaded vm, an empty options is returned if it is not defined
+func readScriptOptions(vm *luavm.VM) (*ScriptOptions, error) {
+	options := &ScriptOptions{}
+	value := vm.LState().GetGlobal("options")
+	switch value.Type() {
+	case lua.LTNil:
+		return options, nil
+	case lua.LTTable:
+	default:
+		return nil, errors.Errorf("global options has to be a table, got %s", value.Type().String())
+	}
+
+	if err := luavalue.Unmarshal(value, options); err != nil {
+		return nil, errors.Wrap(err, "invalid options")
+	}
+	if err := validateScriptStages("stages", options.Stages); err != nil {
+		return nil, err
+	}
+	for name, scenario := range options.Scenarios {
+		if err := validateScriptStages("scenarios."+name+".stages", scenario.Stages); err != nil {
+			return nil, err
+		}
+	}
+	return options, nil
+}
+
+func validateScriptStages(key string, stages []*ScriptStage) error {
+	for i, s := range stages {
+		if s.Duration <= 0 {
+			return errors.Errorf("invalid options: %s[%d].duration has to be positive", key, i)
+		}
+		if s.Target < 0 {
+			return errors.Errorf("invalid options: %s[%d].target can not be negative", key, i)
+		}
+	}
+	return nil
+}
+
+func toStages(stages []*ScriptStage) []Stage {
+	var result []Stage
+	for _, s := range stages {
+		result = append(result, Stage{Duration: s.Duration, Target: s.Target})
+	}
+	return result
+}
+
+// mergeScriptOptions fills settings not given in opts from script options, it returns a copy of opts.
+// Settings are taken in order of script options, config file and command line flags, the later wins.
+// Run mode (iterations, duration or stages) is taken from script as a whole, only if opts specifies none of them.
+// Scenarios are taken from script only if opts has none.
+// Env, tags and thresholds are merged by key.
+func mergeScriptOptions(opts *StartOptions, script *ScriptOptions) *StartOptions {
+	merged := *opts
+
+	if merged.Concurrency == 0 {
+		merged.Concurrency = script.VUs
+	}
+	if merged.Concurrency < 1 {
+		merged.Concurrency = 1
+	}
+	if merged.Rate == 0 {
+		merged.Rate = script.Rate
+	}
+	if merged.Amount == 0 && merged.Duration == 0 && len(merged.Stages) == 0 {
+		merged.Amount = script.Iterations
+		merged.Duration = script.Duration
+		merged.Stages = toStages(script.Stages)
+	}
+	if len(merged.Scenarios) == 0 {
+		for name, s := range script.Scenarios {
+			merged.Scenarios = append(merged.Scenarios, Scenario{
+				Name:        name,
+				Exec:        s.Exec,
+				Concurrency: s.VUs,
+				Amount:      s.Iterations,
+				Duration:    s.Duration,
+				Stages:      toStages(s.Stages),
+				Rate:        s.Rate,
+				StartAfter:  s.StartTime,
+				Envs:        s.Env,
+				Tags:        s.Tags,
+			})
+		}
+	}
+
+	merged.Envs = mergeStringMap(script.Env, opts.Envs)
+	merged.Tags = mergeStringMap(script.Tags, opts.Tags)
+	merged.Thresholds = map[string][]string{}
+	for metric, expressions := range script.Thresholds {
+		merged.Thresholds[metric] = expressions
+	}
+	for metric, expressions := range opts.Thresholds {
+		merged.Thresholds[metric] = expressions
+	}
+	return &merged
+}
+
+func mergeStringMap(base, override map[string]string) map[string]string {
+	result := map[string]string{}
+	for k, v := range base {
+		result[k] = v
+	}
+	for k, v := range override {
+		result[k] = v
+	}
+	return result
+}
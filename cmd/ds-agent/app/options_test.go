@@ -0,0 +1,101 @@
+package app
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/joesonw/lte/pkg/stat"
+)
+
+const optionsScript = `
+	options = {
+		vus = 2,
+		iterations = 5,
+		tags = { team = "search", env = "staging" },
+		env = { HOST = "script.local" },
+		thresholds = { ["run.cost"] = { "count == 5" } },
+	}
+
+	function run(id)
+		assert(HOST == expected_host, "HOST")
+	end
+`
+
+type tagReporter struct {
+	mu   sync.Mutex
+	tags []map[string]string
+}
+
+func (r *tagReporter) Report(stats ...*stat.Stat) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, s := range stats {
+		r.tags = append(r.tags, s.Tags)
+	}
+}
+
+func (r *tagReporter) Finish() error { return nil }
+
+func runOptionsScript(t *testing.T, opts *StartOptions) (*Job, *tagReporter) {
+	fs := afero.NewMemMapFs()
+	assert.Nil(t, afero.WriteFile(fs, "main.lua", []byte(optionsScript), 0600))
+	reporter := &tagReporter{}
+	engine := NewEngine(zap.NewNop(), reporter, afero.NewMemMapFs)
+	assert.Nil(t, engine.Load(fs))
+
+	opts.Entry = "main.lua"
+	opts.AbortPolicy = AbortPolicy{ConsecutiveErrors: 1}
+	assert.Nil(t, engine.Start(opts))
+	job, err := engine.Wait()
+	assert.Nil(t, err)
+	assert.False(t, job.Aborted(), job.AbortReason())
+	return job, reporter
+}
+
+func TestScriptOptions(t *testing.T) {
+	job, reporter := runOptionsScript(t, &StartOptions{
+		Envs: map[string]string{"expected_host": "script.local"},
+		Tags: map[string]string{"env": "prod"},
+	})
+	assert.Equal(t, 2, job.Options().Concurrency)
+	assert.Equal(t, int64(5), job.FinishedAmount())
+	assert.Equal(t, 5, len(reporter.tags))
+	for _, tags := range reporter.tags {
+		assert.Equal(t, "search", tags["team"])
+		assert.Equal(t, "prod", tags["env"])
+	}
+	results := job.ThresholdResults()
+	assert.Equal(t, 1, len(results))
+	assert.True(t, results[0].Passed)
+}
+
+func TestScriptOptionsOverridden(t *testing.T) {
+	job, _ := runOptionsScript(t, &StartOptions{
+		Concurrency: 1,
+		Duration:    time.Millisecond * 50,
+		Envs:        map[string]string{"HOST": "flag.local", "expected_host": "flag.local"},
+		Thresholds:  map[string][]string{"run.cost": {"count > 5"}},
+	})
+	assert.Equal(t, 1, job.Options().Concurrency)
+	assert.Equal(t, int64(0), job.Options().Amount)
+	assert.True(t, job.FinishedAmount() > 5)
+	results := job.ThresholdResults()
+	assert.Equal(t, 1, len(results))
+	assert.True(t, results[0].Passed)
+}
+
+func TestScriptOptionsInvalid(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	assert.Nil(t, afero.WriteFile(fs, "main.lua", []byte(`
+		options = { stages = { { target = 10 } } }
+		function run() end
+	`), 0600))
+	engine := NewEngine(zap.NewNop(), stat.Noop(), afero.NewMemMapFs)
+	assert.Nil(t, engine.Load(fs))
+	assert.NotNil(t, engine.Start(&StartOptions{Entry: "main.lua"}))
+}
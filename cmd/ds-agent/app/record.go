@@ -0,0 +1,131 @@
+package app
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+
+	"github.com/joesonw/lte/pkg/convert"
+	"github.com/joesonw/lte/pkg/record"
+)
+
+func MakeCmdRecord(
+	pLogger **zap.Logger,
+) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "record",
+		Short: "record requests through a forward proxy until interrupted, then write them as a script",
+	}
+
+	pListen := cmd.Flags().StringP("listen", "l", "127.0.0.1:8888", "proxy listen address, it is reachable only from this host by default as it intercepts https")
+	pOut := cmd.Flags().StringP("out", "o", "", "file script is written to, stdout if empty")
+	pIdle := cmd.Flags().Duration("idle", time.Second*2, "start a new group after requests are idle for this long")
+	pCACert := cmd.Flags().String("ca-cert", "", "pem certificate of CA intercepting https, generated if empty")
+	pCAKey := cmd.Flags().String("ca-key", "", "pem ecdsa key of --ca-cert")
+	pCAOut := cmd.Flags().String("ca-out", "ds-agent-ca.pem", "file certificate of generated CA is written to, it has to be trusted by the browser")
+	pCAKeyOut := cmd.Flags().String("ca-key-out", "", "file key of generated CA is written to, readable only by the user, ds-agent/ca-key.pem of user config directory if empty")
+	filter, options := addConvertFlags(cmd)
+
+	cmd.Args = cobra.NoArgs
+	cmd.Run = func(cmd *cobra.Command, args []string) {
+		logger := *pLogger
+
+		ca, err := loadOrCreateCA(logger, *pCACert, *pCAKey, *pCAOut, *pCAKeyOut)
+		if err != nil {
+			logger.Fatal("unable to prepare CA", zap.Error(err))
+		}
+
+		lis, err := net.Listen("tcp", *pListen)
+		if err != nil {
+			logger.Fatal("unable to listen", zap.Error(err))
+		}
+		proxy := record.NewProxy(logger, ca, nil)
+		server := &http.Server{Handler: proxy}
+		go func() {
+			if err := server.Serve(lis); err != nil && err != http.ErrServerClosed {
+				logger.Error("unable to serve", zap.Error(err))
+			}
+		}()
+		logger.Info("recording, interrupt to write script", zap.String("addr", lis.Addr().String()))
+
+		chSignal := make(chan os.Signal, 1)
+		signal.Notify(chSignal, os.Interrupt, syscall.SIGTERM)
+		<-chSignal
+		signal.Stop(chSignal)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			logger.Warn("unable to shutdown proxy", zap.Error(err))
+		}
+
+		groups := convert.GroupByIdle(convert.Select(proxy.Requests(), *filter), *pIdle)
+		if err := writeScript(*pOut, groups, *options); err != nil {
+			logger.Fatal("unable to write script", zap.Error(err))
+		}
+	}
+
+	return cmd
+}
+
+// loadOrCreateCA loads CA from certPath and keyPath, or generates one and writes its certificate to certOut and key to
+// keyOut, so it can be loaded by later recordings. Key is kept out of working directory by default, as anyone holding it
+// can intercept https of browsers trusting the CA
+func loadOrCreateCA(logger *zap.Logger, certPath, keyPath, certOut, keyOut string) (*record.CA, error) {
+	if certPath != "" {
+		certPEM, err := ioutil.ReadFile(certPath)
+		if err != nil {
+			return nil, err
+		}
+		keyPEM, err := ioutil.ReadFile(keyPath)
+		if err != nil {
+			return nil, err
+		}
+		return record.LoadCA(certPEM, keyPEM)
+	}
+
+	ca, err := record.NewCA()
+	if err != nil {
+		return nil, err
+	}
+	if certOut == "" {
+		return ca, nil
+	}
+	if keyOut == "" {
+		dir, err := os.UserConfigDir()
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to find user config directory, set --ca-key-out")
+		}
+		keyOut = filepath.Join(dir, "ds-agent", "ca-key.pem")
+	}
+
+	if err := ioutil.WriteFile(certOut, ca.CertPEM(), 0600); err != nil {
+		return nil, err
+	}
+	keyPEM, err := ca.KeyPEM()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(keyOut), 0700); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(keyOut, keyPEM, 0600); err != nil {
+		return nil, err
+	}
+	// permissions of an existing file are kept by WriteFile
+	if err := os.Chmod(keyOut, 0600); err != nil {
+		return nil, err
+	}
+	logger.Info("generated CA, pass it back with --ca-cert and --ca-key to keep it across recordings",
+		zap.String("cert", certOut), zap.String("key", keyOut))
+	return ca, nil
+}
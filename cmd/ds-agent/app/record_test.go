@@ -0,0 +1,32 @@
+package app
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestLoadOrCreateCA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ds-agent-ca")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	certOut := filepath.Join(dir, "ca.pem")
+	keyOut := filepath.Join(dir, "private", "ca-key.pem")
+	// an existing key file loosened by hand is tightened again
+	assert.Nil(t, os.MkdirAll(filepath.Dir(keyOut), 0700))
+	assert.Nil(t, ioutil.WriteFile(keyOut, nil, 0644))
+
+	ca, err := loadOrCreateCA(zap.NewNop(), "", "", certOut, keyOut)
+	assert.Nil(t, err)
+	info, err := os.Stat(keyOut)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	loaded, err := loadOrCreateCA(zap.NewNop(), certOut, keyOut, "", "")
+	assert.Nil(t, err)
+	assert.Equal(t, ca.CertPEM(), loaded.CertPEM())
+}
@@ -0,0 +1,369 @@
+package app
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/afero"
+	"github.com/spf13/cobra"
+	lua "github.com/yuin/gopher-lua"
+	"go.uber.org/zap"
+
+	luacontext "github.com/joesonw/lte/pkg/lua/context"
+	libasync "github.com/joesonw/lte/pkg/lua/lib/async"
+	libpool "github.com/joesonw/lte/pkg/lua/lib/pool"
+	luavm "github.com/joesonw/lte/pkg/lua/vm"
+	"github.com/joesonw/lte/pkg/stat"
+)
+
+const (
+	replChunkName = "repl"
+	// replLineWidth is the width tables are printed in one line within
+	replLineWidth = 80
+)
+
+var identifierRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func MakeCmdRepl(
+	pLogger **zap.Logger,
+) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "repl [entry]",
+		Short: "evaluate lua interactively in a vu of the bundle, entry is loaded first if given",
+	}
+
+	pEnvs := cmd.Flags().StringArrayP("env", "e", nil, "set lua script environment variables")
+	pFile := cmd.Flags().StringP("file", "f", "", "zip file of contents")
+	pDirectory := cmd.Flags().StringP("directory", "d", ".", "directory of contents")
+	pModulePath := cmd.Flags().String("module-path", "", "package.path searched by require in bundle, default \"?.lua;?/init.lua\"")
+	pAwait := cmd.Flags().Bool("await", false, "await deferreds evaluated, toggled by .await")
+	pHistory := cmd.Flags().String("history", defaultHistoryPath(), "file history is kept in, empty to disable")
+
+	cmd.Args = cobra.MaximumNArgs(1)
+	cmd.Run = func(cmd *cobra.Command, args []string) {
+		logger := *pLogger
+
+		bundle := *pDirectory
+		if *pFile != "" {
+			bundle = *pFile
+		}
+		fs, newFSPath, err := openBundle(bundle)
+		if err != nil {
+			logger.Fatal("unable to open bundle", zap.Error(err))
+		}
+
+		envs := map[string]string{}
+		for _, env := range *pEnvs {
+			kvs := strings.Split(env, "=")
+			if len(kvs) >= 2 {
+				envs[kvs[0]] = strings.Join(kvs[1:], "=")
+			}
+		}
+
+		asyncPool := libpool.NewAsync(logger, DefaultAsyncWorkers, DefaultAsyncTimeout, DefaultAsyncQueueSize)
+		vm := luavm.New(logger, asyncPool, luacontext.NewGlobal(stat.Noop()), luavm.Parameters{
+			EnvVars:    envs,
+			Filesystem: afero.NewCopyOnWriteFs(fs, afero.NewBasePathFs(afero.NewOsFs(), newFSPath)),
+			ModulePath: *pModulePath,
+		})
+		defer vm.Stop()
+
+		if len(args) > 0 {
+			source, err := afero.ReadFile(fs, args[0])
+			if err != nil {
+				logger.Fatal("unable to open entry file", zap.Error(err))
+			}
+			proto, err := luavm.Compile(string(source), args[0])
+			if err != nil {
+				logger.Fatal("unable to compile", zap.Error(err))
+			}
+			if err := vm.Load(proto, ""); err != nil {
+				logger.Fatal("unable to load entry", zap.Error(err))
+			}
+		}
+
+		r := newREPL(vm, os.Stdout)
+		r.await = *pAwait
+		if *pHistory != "" {
+			if err := r.openHistory(*pHistory); err != nil {
+				logger.Warn("unable to open history", zap.Error(err))
+			}
+		}
+		if err := r.run(os.Stdin); err != nil {
+			logger.Error("unable to read input", zap.Error(err))
+		}
+		r.closeHistory()
+	}
+
+	return cmd
+}
+
+func defaultHistoryPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".ds-agent_history")
+}
+
+// repl evaluates chunks in a vm, lines are joined until they compile
+type repl struct {
+	vm      *luavm.VM
+	out     io.Writer
+	await   bool
+	history []string
+	// historyFile is appended with each evaluated chunk, nil if history is not kept
+	historyFile *os.File
+}
+
+func newREPL(vm *luavm.VM, out io.Writer) *repl {
+	return &repl{
+		vm:  vm,
+		out: out,
+	}
+}
+
+func (r *repl) openHistory(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, entry := range strings.Split(string(b), "\x00\n") {
+		if entry != "" {
+			r.history = append(r.history, entry)
+		}
+	}
+	r.historyFile, err = os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	return err
+}
+
+func (r *repl) closeHistory() {
+	if r.historyFile != nil {
+		r.historyFile.Close()
+	}
+}
+
+// record keeps chunk in history, entries of the file are separated by NUL and newline as chunks span lines
+func (r *repl) record(chunk string) {
+	r.history = append(r.history, chunk)
+	if r.historyFile != nil {
+		fmt.Fprint(r.historyFile, chunk+"\x00\n")
+	}
+}
+
+func (r *repl) prompt(pending string) {
+	if pending == "" {
+		fmt.Fprint(r.out, "> ")
+	} else {
+		fmt.Fprint(r.out, ">> ")
+	}
+}
+
+// run reads lines until input ends or .exit
+func (r *repl) run(in io.Reader) error {
+	scanner := bufio.NewScanner(in)
+	pending := ""
+	r.prompt(pending)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if pending == "" && strings.HasPrefix(strings.TrimSpace(line), ".") {
+			if r.command(strings.Fields(line)) {
+				return nil
+			}
+		} else if pending != "" || strings.TrimSpace(line) != "" {
+			pending += line + "\n"
+			if !r.eval(pending) {
+				r.record(strings.TrimSuffix(pending, "\n"))
+				pending = ""
+			}
+		}
+		r.prompt(pending)
+	}
+	return scanner.Err()
+}
+
+// command runs a dot command, it returns true to exit
+func (r *repl) command(fields []string) bool {
+	switch fields[0] {
+	case ".exit":
+		return true
+	case ".await":
+		if len(fields) > 1 {
+			r.await = fields[1] == "on"
+		}
+		if r.await {
+			fmt.Fprintln(r.out, "await on")
+		} else {
+			fmt.Fprintln(r.out, "await off")
+		}
+	case ".history":
+		for i, entry := range r.history {
+			fmt.Fprintf(r.out, "%d\t%s\n", i+1, strings.ReplaceAll(entry, "\n", "\n\t"))
+		}
+	case ".help":
+		fmt.Fprintln(r.out, ".await [on|off]\tawait deferreds evaluated")
+		fmt.Fprintln(r.out, ".history\tlist evaluated chunks")
+		fmt.Fprintln(r.out, ".exit\t\texit")
+	default:
+		fmt.Fprintln(r.out, "unknown command "+fields[0]+", see .help")
+	}
+	return false
+}
+
+// eval evaluates chunk as an expression first then as statements, and prints values of expressions. It returns true if
+// chunk is incomplete and more lines are needed
+func (r *repl) eval(chunk string) bool {
+	expression := true
+	proto, err := luavm.Compile("return "+chunk, replChunkName)
+	if err != nil {
+		expression = false
+		proto, err = luavm.Compile(chunk, replChunkName)
+	}
+	if err != nil {
+		if strings.Contains(err.Error(), "at EOF") {
+			return true
+		}
+		fmt.Fprintln(r.out, "error: "+err.Error())
+		return false
+	}
+
+	L := r.vm.LState()
+	values, err := r.vm.Call(L.NewFunctionFromProto(proto))
+	if err != nil {
+		fmt.Fprintln(r.out, "error: "+err.Error())
+		return false
+	}
+	// statements print nothing, gopher-lua reports a nil for coroutines returning nothing
+	if !expression {
+		return false
+	}
+	if r.await {
+		values, err = r.awaitValues(values)
+		if err != nil {
+			fmt.Fprintln(r.out, "error: "+err.Error())
+			return false
+		}
+	}
+
+	if len(values) > 0 {
+		formatted := make([]string, len(values))
+		for i, v := range values {
+			formatted[i] = formatLuaValue(L, v, "", map[*lua.LTable]bool{})
+		}
+		fmt.Fprintln(r.out, strings.Join(formatted, "\t"))
+	}
+	return false
+}
+
+// awaitValues replaces deferreds with values they resolve as
+func (r *repl) awaitValues(values []lua.LValue) ([]lua.LValue, error) {
+	// d is not awaited in a tail call, gopher-lua drops the frame of the wrapper before d is done then
+	proto, err := luavm.Compile(`
+		local function pack(...) return { n = select("#", ...), ... } end
+		local r = pack((...)())
+		return unpack(r, 1, r.n)
+	`, replChunkName)
+	if err != nil {
+		return nil, err
+	}
+	L := r.vm.LState()
+	var awaited []lua.LValue
+	for _, v := range values {
+		if !libasync.IsDeferred(v) {
+			awaited = append(awaited, v)
+			continue
+		}
+		results, err := r.vm.Call(L.NewFunctionFromProto(proto), v)
+		if err != nil {
+			return nil, err
+		}
+		awaited = append(awaited, results...)
+	}
+	return awaited, nil
+}
+
+// formatLuaValue prints tables with their fields, tables of more than replLineWidth are printed over lines
+func formatLuaValue(L *lua.LState, v lua.LValue, indent string, seen map[*lua.LTable]bool) string {
+	switch val := v.(type) {
+	case lua.LString:
+		return strconv.Quote(string(val))
+	case *lua.LFunction:
+		if libasync.IsDeferred(val) {
+			return "deferred"
+		}
+		return "function"
+	case *lua.LUserData:
+		return formatLuaUserData(L, val)
+	case *lua.LTable:
+		if L.GetMetaField(val, "__tostring") != lua.LNil {
+			return L.ToStringMeta(val).String()
+		}
+		if seen[val] {
+			return "<cycle>"
+		}
+		seen[val] = true
+		defer delete(seen, val)
+		return formatLuaTable(L, val, indent, seen)
+	default:
+		return v.String()
+	}
+}
+
+func formatLuaUserData(L *lua.LState, ud *lua.LUserData) string {
+	if L.GetMetaField(ud, "__tostring") != lua.LNil {
+		return L.ToStringMeta(ud).String()
+	}
+	name := fmt.Sprintf("userdata<%T>", ud.Value)
+	index, ok := L.GetMetaField(ud, "__index").(*lua.LTable)
+	if !ok {
+		return name
+	}
+	var methods []string
+	index.ForEach(func(k, _ lua.LValue) {
+		methods = append(methods, k.String())
+	})
+	sort.Strings(methods)
+	return name + "{ " + strings.Join(methods, ", ") + " }"
+}
+
+func formatLuaTable(L *lua.LState, tb *lua.LTable, indent string, seen map[*lua.LTable]bool) string {
+	inner := indent + "  "
+	var entries []string
+	n := tb.Len()
+	for i := 1; i <= n; i++ {
+		entries = append(entries, formatLuaValue(L, tb.RawGetInt(i), inner, seen))
+	}
+
+	var fields []string
+	tb.ForEach(func(k, v lua.LValue) {
+		if num, ok := k.(lua.LNumber); ok && float64(num) == float64(int(num)) && int(num) >= 1 && int(num) <= n {
+			return
+		}
+		key := ""
+		if s, ok := k.(lua.LString); ok && identifierRegexp.MatchString(string(s)) {
+			key = string(s)
+		} else {
+			key = "[" + formatLuaValue(L, k, inner, seen) + "]"
+		}
+		fields = append(fields, key+" = "+formatLuaValue(L, v, inner, seen))
+	})
+	sort.Strings(fields)
+	entries = append(entries, fields...)
+
+	if len(entries) == 0 {
+		return "{}"
+	}
+	line := "{ " + strings.Join(entries, ", ") + " }"
+	if len(indent)+len(line) <= replLineWidth && !strings.Contains(line, "\n") {
+		return line
+	}
+	return "{\n" + inner + strings.Join(entries, ",\n"+inner) + "\n" + indent + "}"
+}
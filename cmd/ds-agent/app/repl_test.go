@@ -0,0 +1,64 @@
+package app
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	luacontext "github.com/joesonw/lte/pkg/lua/context"
+	libpool "github.com/joesonw/lte/pkg/lua/lib/pool"
+	luavm "github.com/joesonw/lte/pkg/lua/vm"
+	"github.com/joesonw/lte/pkg/stat"
+)
+
+func TestREPL(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	assert.Nil(t, afero.WriteFile(fs, "lib.lua", []byte(`return { answer = 42 }`), 0600))
+	vm := luavm.New(zap.NewNop(), libpool.NewAsync(zap.NewNop(), 4, 0, 16), luacontext.NewGlobal(stat.Noop()), luavm.Parameters{
+		Filesystem: fs,
+		EnvVars:    map[string]string{"HOST": "example.com"},
+	})
+	defer vm.Stop()
+
+	out := &bytes.Buffer{}
+	r := newREPL(vm, out)
+	start := time.Now()
+	assert.Nil(t, r.run(strings.NewReader(strings.Join([]string{
+		`x = 1 + 2`,
+		`x, HOST`,
+		`require("lib").answer`,
+		`function f(n)`,
+		`  return { n, n * 2, name = "f", nested = { ok = true } }`,
+		`end`,
+		`f(1)`,
+		`t = {} t.self = t`,
+		`t`,
+		`spawn(function() return 7 end)`,
+		`.await on`,
+		`spawn(function() return 7 end)`,
+		`local y = require("http")`,
+		`sleep(300000000)`,
+		`error("boom")`,
+		`.history`,
+		`.exit`,
+		`print("not evaluated")`,
+	}, "\n"))))
+
+	output := out.String()
+	assert.Contains(t, output, "> 3\t\"example.com\"\n")
+	assert.Contains(t, output, "> 42\n")
+	assert.Contains(t, output, `{ 1, 2, name = "f", nested = { ok = true } }`)
+	assert.Contains(t, output, ">> >> ")
+	assert.Contains(t, output, `{ self = <cycle> }`)
+	assert.Contains(t, output, "> deferred\n")
+	// statements print nothing, sleep is awaited and resolves as nil
+	assert.Contains(t, output, "> nil\t7\n> > nil\n> error: repl:1: boom")
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(300*time.Millisecond))
+	assert.Contains(t, output, "4\tfunction f(n)\n\t  return")
+	assert.Equal(t, 12, len(r.history))
+}
@@ -1,10 +1,13 @@
 package app
 
 import (
-	"fmt"
+	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/spf13/afero"
 	"github.com/spf13/cobra"
@@ -14,88 +17,237 @@ import (
 	goutil "github.com/joesonw/lte/pkg/util"
 )
 
+const (
+	exitCodeAborted    = 3
+	exitCodeThresholds = 4
+)
+
 func MakeCmdRun(
 	pLogger **zap.Logger,
 	pDebug *bool,
 ) *cobra.Command {
 	cmd := &cobra.Command{
-		Use: "run",
+		Use:   "run [entry]",
+		Short: "run a test, options defined by script are overridden by --config, which is overridden by flags",
 	}
 
+	pConfig := cmd.Flags().String("config", "", "yaml or json test configuration file")
 	pEnvs := cmd.PersistentFlags().StringArrayP("env", "e", nil, "set lua script environment variables")
 	pDuration := cmd.Flags().DurationP("duration", "t", 0, "run amount of take, takes precedence of --amount/-n")
 	pAmount := cmd.Flags().IntP("amount", "n", 1, "amount of requests/runs to be made")
 	pConcurrency := cmd.Flags().IntP("concurrency", "c", 1, "run concurrency")
+	pRate := cmd.Flags().Float64P("rate", "r", 0, "max runs per second, 0 for unlimited")
 	pFile := cmd.Flags().StringP("file", "f", "", "zip file of contents")
 	pDirectory := cmd.Flags().StringP("directory", "d", "", "directory of contents")
-	pOut := cmd.Flags().StringP("out", "o", "console", "stats output target")
+	pOut := cmd.Flags().StringP("out", "o", OutputConsole, "stats output target, console or json=<path>")
+	pAbortErrorRate := cmd.Flags().Float64("abort-on-error-rate", 0, "abort when error rate (0-1) over --abort-window reaches this value")
+	pAbortWindow := cmd.Flags().Duration("abort-window", time.Second*30, "sliding window used by --abort-on-error-rate")
+	pAbortConsecutive := cmd.Flags().Int64("abort-after-consecutive-errors", 0, "abort after this many consecutive failed runs")
+	pAsyncWorkers := cmd.Flags().Int("async-workers", DefaultAsyncWorkers, "async tasks run concurrently by each vu")
+	pAsyncQueueSize := cmd.Flags().Int("async-queue-size", DefaultAsyncQueueSize, "async tasks queued by each vu, scripts block when it is full")
+	pAsyncTimeout := cmd.Flags().Duration("async-timeout", DefaultAsyncTimeout, "timeout of each async task")
+	pModulePath := cmd.Flags().String("module-path", "", "package.path searched by require in bundle, default \"?.lua;?/init.lua\"")
+	sandbox := addSandboxFlags(cmd, false)
+	pAPI := cmd.Flags().String("api", "", "listen address of http api controlling the running test, e.g. :6565")
 
-	cmd.Args = cobra.ExactValidArgs(1)
+	cmd.Args = cobra.MaximumNArgs(1)
 	cmd.Run = func(cmd *cobra.Command, args []string) {
 		logger := *pLogger
-		var reporter stat.Reporter
-		switch *pOut {
-		case "console":
-			reporter = stat.Console()
-		default:
-			logger.Fatal(fmt.Sprintf("output \"%s\" is not supoprted", *pOut))
+
+		cfg := &Config{}
+		if *pConfig != "" {
+			var err error
+			cfg, err = LoadConfig(*pConfig)
+			if err != nil {
+				logger.Fatal("invalid config", zap.Error(err))
+			}
 		}
 
-		envs := map[string]string{}
+		flags := cmd.Flags()
+		if len(args) > 0 {
+			cfg.Entry = args[0]
+		}
+		if len(*pEnvs) > 0 && cfg.Env == nil {
+			cfg.Env = map[string]string{}
+		}
 		for _, env := range *pEnvs {
 			kvs := strings.Split(env, "=")
 			if len(kvs) >= 2 {
-				envs[kvs[0]] = strings.Join(kvs[1:], "=")
+				cfg.Env[kvs[0]] = strings.Join(kvs[1:], "=")
+			}
+		}
+		if flags.Changed("file") {
+			cfg.Bundle = *pFile
+		}
+		if flags.Changed("directory") {
+			cfg.Bundle = *pDirectory
+		}
+		if flags.Changed("duration") {
+			cfg.Executor.Type = ExecutorDuration
+			cfg.Executor.Duration = *pDuration
+			cfg.Executor.Stages = nil
+		} else if flags.Changed("amount") {
+			cfg.Executor.Type = ExecutorIterations
+			cfg.Executor.Iterations = int64(*pAmount)
+			cfg.Executor.Stages = nil
+		}
+		if flags.Changed("concurrency") {
+			cfg.Executor.VUs = *pConcurrency
+		}
+		if flags.Changed("rate") {
+			cfg.Executor.Rate = *pRate
+		}
+		if flags.Changed("out") {
+			kv := strings.SplitN(*pOut, "=", 2)
+			cfg.Outputs = []OutputConfig{{Type: kv[0]}}
+			if len(kv) == 2 {
+				cfg.Outputs[0].Path = kv[1]
 			}
 		}
+		if flags.Changed("abort-on-error-rate") {
+			cfg.Abort.ErrorRate = *pAbortErrorRate
+		}
+		if flags.Changed("abort-window") {
+			cfg.Abort.Window = *pAbortWindow
+		}
+		if flags.Changed("abort-after-consecutive-errors") {
+			cfg.Abort.ConsecutiveErrors = *pAbortConsecutive
+		}
+		if flags.Changed("async-workers") {
+			cfg.Async.Workers = *pAsyncWorkers
+		}
+		if flags.Changed("async-queue-size") {
+			cfg.Async.QueueSize = *pAsyncQueueSize
+		}
+		if flags.Changed("async-timeout") {
+			cfg.Async.Timeout = *pAsyncTimeout
+		}
+		if flags.Changed("module-path") {
+			cfg.ModulePath = *pModulePath
+		}
+		sandbox.merge(cmd, &cfg.Sandbox)
+		if flags.Changed("api") {
+			cfg.API = *pAPI
+		}
 
-		var fs afero.Fs
-		var newFSPath string
-		var err error
+		if cfg.Bundle == "" {
+			logger.Fatal("either --file/-f, --directory/-d or bundle in --config has to be specified")
+		}
+		if err := cfg.Validate(); err != nil {
+			logger.Fatal("invalid config", zap.Error(err))
+		}
 
-		if *pDirectory != "" {
-			dir := *pDirectory
-			if !strings.HasPrefix(dir, "/") {
-				cwd, _ := os.Getwd()
-				dir = filepath.Join(cwd, dir)
-			}
-			fs = afero.NewBasePathFs(afero.NewOsFs(), dir)
-			newFSPath = *pDirectory
-		} else if *pFile != "" {
-			fs, err = goutil.NewAferoFsByPath(*pFile)
-			if err != nil {
-				logger.Error("unable to open file", zap.Error(err))
+		var reporters []stat.Reporter
+		if len(cfg.Outputs) == 0 {
+			cfg.Outputs = []OutputConfig{{Type: OutputConsole}}
+		}
+		for _, output := range cfg.Outputs {
+			switch output.Type {
+			case OutputConsole:
+				reporters = append(reporters, stat.Console())
+			case OutputJSON:
+				f, err := os.Create(output.Path)
+				if err != nil {
+					logger.Fatal("unable to create output", zap.Error(err))
+				}
+				reporters = append(reporters, stat.JSON(f))
 			}
-			newFSPath = filepath.Dir(*pFile)
-		} else {
-			logger.Fatal("either --file/-f or --directory/-d has to be specified")
 		}
+		reporter := stat.Multi(reporters...)
 
-		concurrency := 1
-		if *pConcurrency > 1 {
-			concurrency = *pConcurrency
+		fs, newFSPath, err := openBundle(cfg.Bundle)
+		if err != nil {
+			logger.Fatal("unable to open bundle", zap.Error(err))
 		}
 
-		job, err := NewJob(logger, fs, args[0], concurrency, envs, func() afero.Fs {
+		opts := cfg.StartOptions()
+
+		engine := NewEngine(logger, reporter, func() afero.Fs {
 			return afero.NewBasePathFs(afero.NewOsFs(), newFSPath)
-		}, reporter)
-		if err != nil {
+		})
+		if err := engine.Load(fs); err != nil {
+			logger.Fatal("unable to load", zap.Error(err))
+		}
+
+		if err := engine.Start(opts); err != nil {
 			logger.Fatal("unable to create job", zap.Error(err))
 		}
 
-		if *pDuration > 0 {
-			job.RunDuration(*pDuration)
-		} else {
-			amount := int64(1)
-			if *pAmount > 0 {
-				amount = int64(*pAmount)
+		var apiServer *http.Server
+		if cfg.API != "" {
+			apiServer = &http.Server{Addr: cfg.API, Handler: NewAPIHandler(engine)}
+			go func() {
+				logger.Info("api listening", zap.String("addr", cfg.API))
+				if err := apiServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+					logger.Error("unable to serve api", zap.Error(err))
+				}
+			}()
+		}
+
+		chSignal := make(chan os.Signal, 1)
+		signal.Notify(chSignal, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-chSignal
+			logger.Info("interrupted, waiting for running scripts to finish, interrupt again to cancel them")
+			engine.Stop()
+			<-chSignal
+			logger.Info("interrupted again, cancelling running scripts")
+			engine.Cancel()
+		}()
+
+		job, err := engine.Wait()
+		if err != nil {
+			logger.Fatal("unable to run job", zap.Error(err))
+		}
+		signal.Stop(chSignal)
+		if apiServer != nil {
+			if err := apiServer.Close(); err != nil {
+				logger.Error("unable to close api", zap.Error(err))
 			}
-			job.RunAmount(amount)
 		}
 		if err := reporter.Finish(); err != nil {
 			logger.Error("unable to report stast", zap.Error(err))
 		}
+		if job.Aborted() {
+			logger.Error("job aborted: " + job.AbortReason())
+			os.Exit(exitCodeAborted)
+		}
+
+		failed := false
+		for _, result := range job.ThresholdResults() {
+			if result.Passed {
+				logger.Info("threshold passed", zap.String("threshold", result.Threshold.String()), zap.Float64("actual", result.Actual))
+			} else {
+				failed = true
+				logger.Error("threshold failed", zap.String("threshold", result.Threshold.String()), zap.Float64("actual", result.Actual))
+			}
+		}
+		if failed {
+			os.Exit(exitCodeThresholds)
+		}
 	}
 
 	return cmd
 }
+
+// openBundle opens a directory or an archive, returns it along with path of directory used for writable filesystem
+func openBundle(path string) (afero.Fs, string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if info.IsDir() {
+		dir, err := filepath.Abs(path)
+		if err != nil {
+			return nil, "", err
+		}
+		return afero.NewBasePathFs(afero.NewOsFs(), dir), path, nil
+	}
+
+	fs, err := goutil.NewAferoFsByPath(path)
+	if err != nil {
+		return nil, "", err
+	}
+	return fs, filepath.Dir(path), nil
+}
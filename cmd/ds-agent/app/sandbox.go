@@ -0,0 +1,51 @@
+package app
+
+import (
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// sandboxFlags are flags of sandbox shared by run and serve
+type sandboxFlags struct {
+	enabled           *bool
+	timeout           *time.Duration
+	instructionBudget *int64
+	memoryLimitMB     *int
+}
+
+func addSandboxFlags(cmd *cobra.Command, enabled bool) *sandboxFlags {
+	return &sandboxFlags{
+		enabled:           cmd.Flags().Bool("sandbox", enabled, "strip os functions reaching the host and cap stack sizes of vus"),
+		timeout:           cmd.Flags().Duration("sandbox-timeout", 0, "abort iterations running longer in sandbox, 0 for no timeout"),
+		instructionBudget: cmd.Flags().Int64("sandbox-instruction-budget", 0, "abort iterations executing more lua instructions in sandbox, 0 for no budget"),
+		memoryLimitMB:     cmd.Flags().Int("sandbox-memory-limit-mb", 0, "abort iterations while heap of the process is larger in sandbox, 0 for no limit"),
+	}
+}
+
+// config returns sandbox described by flags regardless whether they are set
+func (f *sandboxFlags) config() SandboxConfig {
+	return SandboxConfig{
+		Enabled:           *f.enabled,
+		Timeout:           *f.timeout,
+		InstructionBudget: *f.instructionBudget,
+		MemoryLimitMB:     *f.memoryLimitMB,
+	}
+}
+
+// merge overrides cfg with flags which are set
+func (f *sandboxFlags) merge(cmd *cobra.Command, cfg *SandboxConfig) {
+	flags := cmd.Flags()
+	if flags.Changed("sandbox") {
+		cfg.Enabled = *f.enabled
+	}
+	if flags.Changed("sandbox-timeout") {
+		cfg.Timeout = *f.timeout
+	}
+	if flags.Changed("sandbox-instruction-budget") {
+		cfg.InstructionBudget = *f.instructionBudget
+	}
+	if flags.Changed("sandbox-memory-limit-mb") {
+		cfg.MemoryLimitMB = *f.memoryLimitMB
+	}
+}
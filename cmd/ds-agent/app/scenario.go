@@ -0,0 +1,401 @@
+package app
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	luacontext "github.com/joesonw/lte/pkg/lua/context"
+	libdata "github.com/joesonw/lte/pkg/lua/lib/data"
+	luavm "github.com/joesonw/lte/pkg/lua/vm"
+	"github.com/joesonw/lte/pkg/stat"
+)
+
+const (
+	// DefaultScenario is name of the scenario built from top level options when no scenario is given
+	DefaultScenario = "default"
+	// DefaultExec is global function called by scenarios without exec
+	DefaultExec = "run"
+)
+
+// Scenario is a named workload of a job, scenarios of a job run concurrently
+type Scenario struct {
+	Name string
+	// Exec is name of global function called on each iteration, DefaultExec if empty
+	Exec string
+	// Concurrency is initial amount of vms, 1 if 0
+	Concurrency int
+	// Stages take precedence over Duration, which takes precedence over Amount, 1 iteration is run if none is set
+	Amount   int64
+	Duration time.Duration
+	Stages   []Stage
+	Rate     float64
+	// StartAfter delays scenario relative to start of job
+	StartAfter time.Duration
+	Envs       map[string]string
+	Tags       map[string]string
+}
+
+// scenario runs vms of a Scenario, vms are created on demand and kept for reuse when scaled down
+type scenario struct {
+	job      *Job
+	logger   *zap.Logger
+	options  Scenario
+	envs     map[string]string
+	global   *luacontext.Global
+	reporter stat.Reporter
+
+	mu          *sync.Mutex
+	idle        []*luavm.VM
+	vus         []*vu
+	alive       int
+	concurrency int
+	running     bool
+	finished    bool
+	chFinished  chan struct{}
+	chTicket    chan struct{}
+	shouldStop  func() bool
+	// exhausted is set once a feed of policy once has no row left, vms exit rather than run further iterations
+	exhausted bool
+}
+
+func newScenario(j *Job, options Scenario, envs map[string]string, reporter stat.Reporter) (*scenario, error) {
+	if options.Exec == "" {
+		options.Exec = DefaultExec
+	}
+	if options.Concurrency < 1 {
+		options.Concurrency = 1
+	}
+
+	tags := map[string]string{"scenario": options.Name}
+	for k, v := range options.Tags {
+		tags[k] = v
+	}
+	reporter = stat.Tagged(reporter, tags)
+
+	s := &scenario{
+		job:         j,
+		logger:      j.logger.With(zap.String("scenario", options.Name)),
+		options:     options,
+		envs:        mergeStringMap(envs, options.Envs),
+		global:      j.global.WithReporter(reporter),
+		reporter:    reporter,
+		mu:          &sync.Mutex{},
+		concurrency: options.Concurrency,
+		chFinished:  make(chan struct{}),
+	}
+
+	for i := 0; i < s.concurrency; i++ {
+		vm, err := j.newVM(s.global, s.envs, options.Exec)
+		if err != nil {
+			return nil, errors.Wrapf(err, "scenario %s", options.Name)
+		}
+		s.idle = append(s.idle, vm)
+	}
+	return s, nil
+}
+
+func (s *scenario) Concurrency() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.concurrency
+}
+
+// SetConcurrency changes amount of vms running concurrently, stopped vms are allowed to finish their current iteration
+func (s *scenario) SetConcurrency(concurrency int) error {
+	if concurrency < 1 {
+		return errors.New("concurrency has to be at least 1")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.finished {
+		return errors.New("scenario is finished")
+	}
+
+	s.logger.Info(fmt.Sprintf("scale concurrency from %d to %d", s.concurrency, concurrency))
+	s.concurrency = concurrency
+	if !s.running {
+		return nil
+	}
+
+	for len(s.vus) > concurrency {
+		v := s.vus[len(s.vus)-1]
+		s.vus = s.vus[:len(s.vus)-1]
+		close(v.chStop)
+	}
+	for len(s.vus) < concurrency {
+		if err := s.spawnLocked(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// run waits for start offset, then runs in mode of options
+func (s *scenario) run() {
+	if s.options.StartAfter > 0 {
+		timer := time.NewTimer(s.options.StartAfter)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-s.job.chStop:
+			return
+		}
+	}
+
+	switch {
+	case len(s.options.Stages) > 0:
+		s.runStages(s.options.Stages)
+	case s.options.Duration > 0:
+		s.runDuration(s.options.Duration)
+	default:
+		amount := int64(1)
+		if s.options.Amount > 0 {
+			amount = s.options.Amount
+		}
+		s.runAmount(amount)
+	}
+}
+
+func (s *scenario) runDuration(duration time.Duration) {
+	s.logger.Info(fmt.Sprintf("run in time constraint mode: %s, conncurency: %d", duration.String(), s.Concurrency()))
+	stopAt := time.Now().Add(duration)
+	s.runUntil(func() bool {
+		return time.Now().After(stopAt)
+	})
+}
+
+func (s *scenario) runAmount(amount int64) {
+	s.logger.Info(fmt.Sprintf("run in amount mode: %d, conncurency: %d", amount, s.Concurrency()))
+	var count int64
+	s.runUntil(func() bool {
+		return atomic.AddInt64(&count, 1) > amount
+	})
+}
+
+// runStages runs for total duration of stages, concurrency starts at current value and follows targets of stages.
+// Concurrency never drops below 1, a target of 0 keeps a single vm running.
+func (s *scenario) runStages(stages []Stage) {
+	var total time.Duration
+	for _, stage := range stages {
+		total += stage.Duration
+	}
+	s.logger.Info(fmt.Sprintf("run in stages mode: %d stages, %s", len(stages), total.String()))
+
+	startedAt := time.Now()
+	stopAt := startedAt.Add(total)
+	from := s.Concurrency()
+	chDone := make(chan struct{})
+	defer close(chDone)
+	go func() {
+		ticker := time.NewTicker(rampInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				target := stageTarget(stages, from, now.Sub(startedAt))
+				if target < 1 {
+					target = 1
+				}
+				if target != s.Concurrency() {
+					_ = s.SetConcurrency(target)
+				}
+			case <-chDone:
+				return
+			case <-s.job.chStop:
+				return
+			}
+		}
+	}()
+
+	s.runUntil(func() bool {
+		return time.Now().After(stopAt)
+	})
+}
+
+// stageTarget interpolates concurrency at elapsed time, from is the concurrency before first stage
+func stageTarget(stages []Stage, from int, elapsed time.Duration) int {
+	for _, s := range stages {
+		if elapsed < s.Duration {
+			return from + int(float64(s.Target-from)*float64(elapsed)/float64(s.Duration))
+		}
+		elapsed -= s.Duration
+		from = s.Target
+	}
+	return from
+}
+
+func (s *scenario) runUntil(shouldStop func() bool) {
+	chDone := make(chan struct{})
+	defer close(chDone)
+	if s.options.Rate > 0 {
+		s.chTicket = make(chan struct{})
+		go s.dispatch(s.chTicket, chDone)
+	}
+
+	s.mu.Lock()
+	s.shouldStop = shouldStop
+	s.running = true
+	for len(s.vus) < s.concurrency {
+		if err := s.spawnLocked(); err != nil {
+			s.logger.Error("unable to create vm", zap.Error(err))
+			break
+		}
+	}
+	if s.alive == 0 {
+		s.finished = true
+		close(s.chFinished)
+	}
+	s.mu.Unlock()
+
+	<-s.chFinished
+}
+
+func (s *scenario) spawnLocked() error {
+	var vm *luavm.VM
+	if n := len(s.idle); n > 0 {
+		vm = s.idle[n-1]
+		s.idle = s.idle[:n-1]
+	} else {
+		var err error
+		vm, err = s.job.newVM(s.global, s.envs, s.options.Exec)
+		if err != nil {
+			return err
+		}
+	}
+
+	v := &vu{
+		vm:     vm,
+		chStop: make(chan struct{}),
+	}
+	s.vus = append(s.vus, v)
+	s.alive++
+	go s.loop(v)
+	return nil
+}
+
+func (s *scenario) exit(v *vu) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.vus {
+		if s.vus[i] == v {
+			s.vus = append(s.vus[:i], s.vus[i+1:]...)
+			break
+		}
+	}
+	s.idle = append(s.idle, v.vm)
+	s.alive--
+	if s.alive == 0 && !s.finished {
+		s.finished = true
+		close(s.chFinished)
+	}
+}
+
+// wait blocks while job is paused or waiting for a rate ticket, returns false if vu should exit
+func (s *scenario) wait(v *vu) bool {
+	if chResume := s.job.resumeChan(); chResume != nil {
+		select {
+		case <-chResume:
+		case <-v.chStop:
+			return false
+		case <-s.job.chStop:
+			return false
+		}
+	}
+
+	if s.isExhausted() || s.shouldStop() {
+		return false
+	}
+
+	if s.chTicket != nil {
+		select {
+		case <-s.chTicket:
+		case <-v.chStop:
+			return false
+		case <-s.job.chStop:
+			return false
+		}
+	}
+	return true
+}
+
+func (s *scenario) loop(v *vu) {
+	defer s.exit(v)
+	for {
+		select {
+		case <-v.chStop:
+			return
+		case <-s.job.chStop:
+			return
+		default:
+		}
+
+		if !s.wait(v) {
+			return
+		}
+
+		start := time.Now()
+		err := v.vm.Run(s.job.nextIteration())
+		if libdata.IsExhausted(err) {
+			s.exhaust()
+			v.vm.Reset()
+			return
+		}
+		if err != nil {
+			s.logger.Error("error running script", zap.Error(err))
+		}
+		s.job.record(err != nil)
+		since := time.Since(start)
+		s.reporter.Report(stat.New("run").Int64Field("cost", since.Nanoseconds()))
+		v.vm.Reset()
+	}
+}
+
+// exhaust stops all vms of the scenario once data ran out, the iteration hitting it is neither counted nor failed
+func (s *scenario) exhaust() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.exhausted {
+		s.exhausted = true
+		s.logger.Info("data exhausted, stopping scenario")
+	}
+}
+
+func (s *scenario) isExhausted() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.exhausted
+}
+
+// tickInterval returns 1/rate seconds, at least a nanosecond since rates beyond 1e9/s truncate to 0
+func tickInterval(rate float64) time.Duration {
+	interval := time.Duration(float64(time.Second) / rate)
+	if interval < time.Nanosecond {
+		return time.Nanosecond
+	}
+	return interval
+}
+
+// dispatch hands out a ticket per 1/rate seconds, tickets are dropped if no vm is available to take them
+func (s *scenario) dispatch(chTicket chan<- struct{}, chDone <-chan struct{}) {
+	ticker := time.NewTicker(tickInterval(s.options.Rate))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			select {
+			case chTicket <- struct{}{}:
+			default:
+			}
+		case <-chDone:
+			return
+		case <-s.job.chStop:
+			return
+		}
+	}
+}
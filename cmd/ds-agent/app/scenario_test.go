@@ -0,0 +1,145 @@
+package app
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+const scenariosScript = `
+	function browse(id)
+		assert(KIND == "browse", "KIND")
+	end
+
+	function checkout(id)
+		assert(KIND == "checkout", "KIND")
+		sleep(1000000)()
+	end
+`
+
+func startScenarios(t *testing.T, script string, opts *StartOptions) (*Engine, *tagReporter) {
+	fs := afero.NewMemMapFs()
+	assert.Nil(t, afero.WriteFile(fs, "main.lua", []byte(script), 0600))
+	reporter := &tagReporter{}
+	engine := NewEngine(zap.NewNop(), reporter, afero.NewMemMapFs)
+	assert.Nil(t, engine.Load(fs))
+
+	opts.Entry = "main.lua"
+	opts.AbortPolicy = AbortPolicy{ConsecutiveErrors: 1}
+	assert.Nil(t, engine.Start(opts))
+	return engine, reporter
+}
+
+func countRuns(reporter *tagReporter) map[string]int {
+	reporter.mu.Lock()
+	defer reporter.mu.Unlock()
+	counts := map[string]int{}
+	for _, tags := range reporter.tags {
+		counts[tags["scenario"]+"/"+tags["flow"]]++
+	}
+	return counts
+}
+
+func TestScenarios(t *testing.T) {
+	engine, reporter := startScenarios(t, scenariosScript, &StartOptions{
+		Scenarios: []Scenario{{
+			Name:        "browse",
+			Exec:        "browse",
+			Concurrency: 2,
+			Amount:      8,
+			Envs:        map[string]string{"KIND": "browse"},
+			Tags:        map[string]string{"flow": "read"},
+		}, {
+			Name:        "checkout",
+			Exec:        "checkout",
+			Concurrency: 1,
+			Duration:    time.Millisecond * 100,
+			StartAfter:  time.Millisecond * 50,
+			Envs:        map[string]string{"KIND": "checkout"},
+			Tags:        map[string]string{"flow": "write"},
+		}},
+	})
+	assert.Equal(t, int32(3), engine.Status().GetConcurrency())
+	assert.NotNil(t, engine.Scale(2))
+	assert.Nil(t, engine.ScaleScenario("checkout", 2))
+	assert.NotNil(t, engine.ScaleScenario("unknown", 2))
+
+	job, err := engine.Wait()
+	assert.Nil(t, err)
+	assert.False(t, job.Aborted(), job.AbortReason())
+	assert.Equal(t, []string{"browse", "checkout"}, job.Scenarios())
+
+	counts := countRuns(reporter)
+	assert.Equal(t, 8, counts["browse/read"])
+	assert.True(t, counts["checkout/write"] > 0)
+	assert.Equal(t, 2, len(counts))
+	assert.True(t, job.Elapsed() >= time.Millisecond*150)
+}
+
+func TestScenariosFromScriptOptions(t *testing.T) {
+	engine, reporter := startScenarios(t, scenariosScript+`
+		options = {
+			scenarios = {
+				browse = { exec = "browse", iterations = 3, env = { KIND = "browse" } },
+				checkout = { exec = "checkout", iterations = 2, env = { KIND = "checkout" } },
+			},
+		}
+	`, &StartOptions{})
+	job, err := engine.Wait()
+	assert.Nil(t, err)
+	assert.False(t, job.Aborted(), job.AbortReason())
+	assert.Equal(t, map[string]int{"browse/": 3, "checkout/": 2}, countRuns(reporter))
+}
+
+func TestScenariosDefault(t *testing.T) {
+	engine, reporter := startScenarios(t, `function run(id) end`, &StartOptions{Amount: 2})
+	_, err := engine.Wait()
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]int{DefaultScenario + "/": 2}, countRuns(reporter))
+}
+
+func TestScenariosMissingExec(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	assert.Nil(t, afero.WriteFile(fs, "main.lua", []byte(scenariosScript), 0600))
+	engine := NewEngine(zap.NewNop(), &tagReporter{}, afero.NewMemMapFs)
+	assert.Nil(t, engine.Load(fs))
+	assert.NotNil(t, engine.Start(&StartOptions{
+		Entry:     "main.lua",
+		Scenarios: []Scenario{{Name: "browse", Exec: "missing"}},
+	}))
+}
+
+func TestScenarioDataExhausted(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	assert.Nil(t, afero.WriteFile(fs, "ids.json", []byte(`[1, 2, 3]`), 0600))
+	assert.Nil(t, afero.WriteFile(fs, "main.lua", []byte(`
+		local ids = require("data"):open("ids.json", { policy = "once" })
+		function run(id)
+			ids:next()
+		end
+	`), 0600))
+	engine := NewEngine(zap.NewNop(), &tagReporter{}, afero.NewMemMapFs)
+	assert.Nil(t, engine.Load(fs))
+	// exhaustion is no failure, the job would be aborted by the first one otherwise
+	assert.Nil(t, engine.Start(&StartOptions{
+		Entry:       "main.lua",
+		Concurrency: 2,
+		Duration:    time.Second * 10,
+		AbortPolicy: AbortPolicy{ConsecutiveErrors: 1},
+	}))
+
+	job, err := engine.Wait()
+	assert.Nil(t, err)
+	assert.False(t, job.Aborted(), job.AbortReason())
+	assert.Equal(t, int64(3), job.FinishedAmount())
+	assert.True(t, job.Elapsed() < time.Second*10)
+}
+
+func TestTickInterval(t *testing.T) {
+	assert.Equal(t, time.Millisecond*100, tickInterval(10))
+	assert.Equal(t, time.Nanosecond, tickInterval(1e9))
+	assert.Equal(t, time.Nanosecond, tickInterval(5e9))
+}
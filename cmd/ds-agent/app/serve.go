@@ -0,0 +1,75 @@
+package app
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+
+	apiv1 "github.com/joesonw/lte/pkg/api/v1"
+)
+
+func MakeCmdServe(
+	pLogger **zap.Logger,
+) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "serve",
+		Short: "run as an agent controlled by ds-controller",
+	}
+
+	pListen := cmd.Flags().StringP("listen", "l", ":7000", "grpc listen address")
+	pDirectory := cmd.Flags().StringP("directory", "d", "", "working directory for uploaded bundles, defaults to a temporary directory")
+	sandbox := addSandboxFlags(cmd, true)
+
+	cmd.Args = cobra.NoArgs
+	cmd.Run = func(cmd *cobra.Command, args []string) {
+		logger := *pLogger
+
+		dir := *pDirectory
+		if dir == "" {
+			tmp, err := ioutil.TempDir("", "ds-agent")
+			if err != nil {
+				logger.Fatal("unable to create working directory", zap.Error(err))
+			}
+			defer os.RemoveAll(tmp)
+			dir = tmp
+		}
+
+		lis, err := net.Listen("tcp", *pListen)
+		if err != nil {
+			logger.Fatal("unable to listen", zap.Error(err))
+		}
+
+		sandboxConfig := sandbox.config()
+		if err := sandboxConfig.Validate(); err != nil {
+			logger.Fatal("invalid sandbox", zap.Error(err))
+		}
+		agent := NewAgentServer(logger, dir, sandboxConfig.Sandbox())
+		server := grpc.NewServer()
+		apiv1.RegisterAgentServer(server, agent)
+
+		chSignal := make(chan os.Signal, 1)
+		signal.Notify(chSignal, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-chSignal
+			logger.Info("shutting down")
+			if _, err := agent.Stop(context.Background(), &apiv1.StopRequest{}); err != nil {
+				logger.Error("unable to stop job", zap.Error(err))
+			}
+			server.GracefulStop()
+		}()
+
+		logger.Info("agent listening", zap.String("addr", lis.Addr().String()))
+		if err := server.Serve(lis); err != nil {
+			logger.Error("unable to serve", zap.Error(err))
+		}
+	}
+
+	return cmd
+}
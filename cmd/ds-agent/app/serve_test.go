@@ -0,0 +1,61 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"google.golang.org/grpc"
+
+	apiv1 "github.com/joesonw/lte/pkg/api/v1"
+)
+
+func TestServe(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	// fatal errors fail the test instead of exiting
+	logger := zap.New(core, zap.OnFatal(zapcore.WriteThenPanic))
+	cmd := MakeCmdServe(&logger)
+	// flags are left to defaults but the address, which is picked by the system
+	cmd.SetArgs([]string{"--listen", "127.0.0.1:0"})
+
+	chDone := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				chDone <- fmt.Errorf("%v", r)
+			}
+		}()
+		chDone <- cmd.Execute()
+	}()
+
+	var addr string
+	assert.Eventually(t, func() bool {
+		for _, entry := range logs.FilterMessage("agent listening").All() {
+			addr = entry.ContextMap()["addr"].(string)
+		}
+		return addr != ""
+	}, time.Second*5, time.Millisecond*10, "%v", logs.All())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, addr, grpc.WithInsecure(), grpc.WithBlock())
+	assert.Nil(t, err)
+	defer conn.Close()
+	_, err = apiv1.NewAgentClient(conn).Status(ctx, &apiv1.StatusRequest{})
+	assert.Nil(t, err)
+
+	// serve shuts down on interrupt
+	assert.Nil(t, syscall.Kill(syscall.Getpid(), syscall.SIGINT))
+	select {
+	case err := <-chDone:
+		assert.Nil(t, err)
+	case <-time.After(time.Second * 5):
+		t.Fatal("serve did not shut down")
+	}
+}
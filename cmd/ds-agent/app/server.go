@@ -0,0 +1,234 @@
+package app
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	apiv1 "github.com/joesonw/lte/pkg/api/v1"
+	luacontext "github.com/joesonw/lte/pkg/lua/context"
+	luavm "github.com/joesonw/lte/pkg/lua/vm"
+	"github.com/joesonw/lte/pkg/stat"
+	goutil "github.com/joesonw/lte/pkg/util"
+)
+
+var errBarrierCoordinatorGone = errors.New("barrier coordinator is gone")
+
+type agentServer struct {
+	apiv1.UnimplementedAgentServer
+	logger  *zap.Logger
+	dir     string
+	sandbox *luavm.Sandbox
+	engine  *Engine
+
+	mu *sync.Mutex
+	// barrier is coordinated by the controller while it keeps Barriers open, jobs started meanwhile share it
+	barrier *luacontext.CoordinatedBarrier
+}
+
+// NewAgentServer creates an agent server, uploaded bundles are stored in dir, which is also used as writable
+// filesystem of scripts. Sandbox is applied to all jobs started by controller, scripts are trusted if nil
+func NewAgentServer(logger *zap.Logger, dir string, sandbox *luavm.Sandbox) apiv1.AgentServer {
+	return &agentServer{
+		logger:  logger,
+		dir:     dir,
+		sandbox: sandbox,
+		mu:      &sync.Mutex{},
+		engine: NewEngine(logger, stat.Noop(), func() afero.Fs {
+			return afero.NewBasePathFs(afero.NewOsFs(), dir)
+		}),
+	}
+}
+
+func toStatusError(err error) error {
+	if errors.Is(err, errJobRunning) || errors.Is(err, errNoJob) {
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return status.Error(codes.InvalidArgument, err.Error())
+}
+
+func (s *agentServer) Upload(ctx context.Context, req *apiv1.UploadRequest) (*apiv1.UploadResponse, error) {
+	path := filepath.Join(s.dir, filepath.Base(req.GetName()))
+	if err := ioutil.WriteFile(path, req.GetContent(), 0600); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	fs, err := goutil.NewAferoFsByPath(path)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := s.engine.Load(fs); err != nil {
+		return nil, toStatusError(err)
+	}
+	s.logger.Info("bundle uploaded", zap.String("name", req.GetName()), zap.Int("size", len(req.GetContent())))
+	return &apiv1.UploadResponse{}, nil
+}
+
+func (s *agentServer) Start(ctx context.Context, req *apiv1.StartRequest) (*apiv1.StartResponse, error) {
+	opts := &StartOptions{
+		Entry:       req.GetEntry(),
+		Concurrency: int(req.GetConcurrency()),
+		Amount:      req.GetAmount(),
+		Duration:    time.Duration(req.GetDurationNs()),
+		Rate:        req.GetRate(),
+		Envs:        req.GetEnvs(),
+		Sandbox:     s.sandbox,
+	}
+	if startAt := req.GetStartAtUnixNano(); startAt > 0 {
+		opts.StartAt = time.Unix(0, startAt)
+	}
+	if policy := req.GetAbortPolicy(); policy != nil {
+		opts.AbortPolicy = AbortPolicy{
+			ErrorRate:         policy.GetErrorRate(),
+			Window:            time.Duration(policy.GetWindowNs()),
+			ConsecutiveErrors: policy.GetConsecutiveErrors(),
+		}
+	}
+
+	s.mu.Lock()
+	if s.barrier != nil {
+		opts.Barrier = s.barrier
+	}
+	s.mu.Unlock()
+
+	if err := s.engine.Start(opts); err != nil {
+		return nil, toStatusError(err)
+	}
+	return &apiv1.StartResponse{}, nil
+}
+
+func (s *agentServer) Stop(ctx context.Context, req *apiv1.StopRequest) (*apiv1.StopResponse, error) {
+	s.engine.Stop()
+	return &apiv1.StopResponse{}, nil
+}
+
+func (s *agentServer) Pause(ctx context.Context, req *apiv1.PauseRequest) (*apiv1.PauseResponse, error) {
+	if err := s.engine.Pause(); err != nil {
+		return nil, toStatusError(err)
+	}
+	return &apiv1.PauseResponse{}, nil
+}
+
+func (s *agentServer) Resume(ctx context.Context, req *apiv1.ResumeRequest) (*apiv1.ResumeResponse, error) {
+	if err := s.engine.Resume(); err != nil {
+		return nil, toStatusError(err)
+	}
+	return &apiv1.ResumeResponse{}, nil
+}
+
+func (s *agentServer) Scale(ctx context.Context, req *apiv1.ScaleRequest) (*apiv1.ScaleResponse, error) {
+	if err := s.engine.Scale(int(req.GetConcurrency())); err != nil {
+		return nil, toStatusError(err)
+	}
+	return &apiv1.ScaleResponse{}, nil
+}
+
+func (s *agentServer) Status(ctx context.Context, req *apiv1.StatusRequest) (*apiv1.StatusResponse, error) {
+	return s.engine.Status(), nil
+}
+
+func (s *agentServer) Stats(req *apiv1.StatsRequest, stream apiv1.Agent_StatsServer) error {
+	ch, unsubscribe, err := s.engine.SubscribeStats(req.GetNext())
+	if err != nil {
+		return toStatusError(err)
+	}
+	defer unsubscribe()
+	// headers tell the client it is subscribed, e.g. before it starts the next job
+	if err := stream.SendHeader(metadata.MD{}); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case st, ok := <-ch:
+			if !ok {
+				return nil
+			}
+			if err := stream.Send(apiv1.NewStat(st)); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+	}
+}
+
+func (s *agentServer) Barriers(stream apiv1.Agent_BarriersServer) error {
+	sendMu := &sync.Mutex{}
+	barrier := luacontext.NewCoordinatedBarrier(func(arrival luacontext.BarrierArrival) error {
+		sendMu.Lock()
+		defer sendMu.Unlock()
+		return stream.Send(&apiv1.BarrierArrival{
+			Name:       arrival.Name,
+			Parties:    int32(arrival.Parties),
+			Generation: arrival.Generation,
+			Left:       arrival.Left,
+		})
+	})
+	s.mu.Lock()
+	s.barrier = barrier
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		if s.barrier == barrier {
+			s.barrier = nil
+		}
+		s.mu.Unlock()
+		barrier.Close(errBarrierCoordinatorGone)
+	}()
+	// headers tell the controller jobs started from now on are coordinated
+	if err := stream.SendHeader(metadata.MD{}); err != nil {
+		return err
+	}
+
+	for {
+		release, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		barrier.Release(release.GetName(), release.GetGeneration())
+	}
+}
+
+func (s *agentServer) Logs(req *apiv1.LogsRequest, stream apiv1.Agent_LogsServer) error {
+	level := zapcore.InfoLevel
+	if req.GetLevel() != "" {
+		if err := level.Set(req.GetLevel()); err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+
+	ch, unsubscribe, err := s.engine.SubscribeLogs(level)
+	if err != nil {
+		return toStatusError(err)
+	}
+	defer unsubscribe()
+
+	for {
+		select {
+		case entry, ok := <-ch:
+			if !ok {
+				return nil
+			}
+			if err := stream.Send(entry); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package app
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+	"github.com/spf13/cobra"
+	lua "github.com/yuin/gopher-lua"
+	"go.uber.org/zap"
+
+	luacontext "github.com/joesonw/lte/pkg/lua/context"
+	libpool "github.com/joesonw/lte/pkg/lua/lib/pool"
+	luavm "github.com/joesonw/lte/pkg/lua/vm"
+	"github.com/joesonw/lte/pkg/stat"
+)
+
+// importRegexp matches import and require of a literal name, e.g. `import("lib/a.lua")` and `require "lib.b"`
+var importRegexp = regexp.MustCompile(`\b(import|require)\s*\(?\s*["']([^"']+)["']`)
+
+func MakeCmdValidate(
+	pLogger **zap.Logger,
+) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "validate [entry]",
+		Short: "check a test without running it: compile, imports, options and exec functions, network is stubbed",
+	}
+
+	pConfig := cmd.Flags().String("config", "", "yaml or json test configuration file")
+	pEnvs := cmd.Flags().StringArrayP("env", "e", nil, "set lua script environment variables")
+	pFile := cmd.Flags().StringP("file", "f", "", "zip file of contents")
+	pDirectory := cmd.Flags().StringP("directory", "d", "", "directory of contents")
+	pModulePath := cmd.Flags().String("module-path", "", "package.path searched by require in bundle, default \"?.lua;?/init.lua\"")
+	pIterations := cmd.Flags().IntP("amount", "n", 0, "run this many iterations of each exec function with network and requests logged")
+
+	cmd.Args = cobra.MaximumNArgs(1)
+	cmd.Run = func(cmd *cobra.Command, args []string) {
+		logger := *pLogger
+
+		cfg := &Config{}
+		if *pConfig != "" {
+			var err error
+			cfg, err = LoadConfig(*pConfig)
+			if err != nil {
+				fmt.Fprintf(os.Stdout, "fail  config: %s\n", err)
+				os.Exit(1)
+			}
+		}
+		flags := cmd.Flags()
+		if len(args) > 0 {
+			cfg.Entry = args[0]
+		}
+		if len(*pEnvs) > 0 && cfg.Env == nil {
+			cfg.Env = map[string]string{}
+		}
+		for _, env := range *pEnvs {
+			kvs := strings.Split(env, "=")
+			if len(kvs) >= 2 {
+				cfg.Env[kvs[0]] = strings.Join(kvs[1:], "=")
+			}
+		}
+		if flags.Changed("file") {
+			cfg.Bundle = *pFile
+		}
+		if flags.Changed("directory") {
+			cfg.Bundle = *pDirectory
+		}
+		if flags.Changed("module-path") {
+			cfg.ModulePath = *pModulePath
+		}
+		if cfg.Bundle == "" {
+			logger.Fatal("either --file/-f, --directory/-d or bundle in --config has to be specified")
+		}
+
+		fs, _, err := openBundle(cfg.Bundle)
+		if err != nil {
+			logger.Fatal("unable to open bundle", zap.Error(err))
+		}
+
+		v := &validator{
+			logger: logger,
+			out:    os.Stdout,
+			fs:     fs,
+			cfg:    cfg,
+		}
+		if !v.validate(*pIterations) {
+			os.Exit(1)
+		}
+	}
+
+	return cmd
+}
+
+// validator checks a test step by step, each step is printed as ok or fail
+type validator struct {
+	logger *zap.Logger
+	out    io.Writer
+	fs     afero.Fs
+	cfg    *Config
+	failed bool
+}
+
+func (v *validator) check(name string, err error) bool {
+	if err != nil {
+		v.failed = true
+		fmt.Fprintf(v.out, "fail  %s: %s\n", name, err)
+		return false
+	}
+	fmt.Fprintf(v.out, "ok    %s\n", name)
+	return true
+}
+
+// validate returns true if all checks passed, iterations of each exec function are run with network if positive
+func (v *validator) validate(iterations int) bool {
+	if !v.check("config", v.cfg.Validate()) {
+		return false
+	}
+
+	entry := v.cfg.Entry
+	source, err := afero.ReadFile(v.fs, entry)
+	if !v.check("read "+entry, err) {
+		return false
+	}
+	proto, err := luavm.Compile(string(source), entry)
+	if !v.check("compile "+entry, err) {
+		return false
+	}
+
+	vm := v.newVM(true, nil)
+	defer vm.Stop()
+	v.check("imports", v.resolveImports(vm.LState(), entry, string(source), map[string]bool{}))
+	if !v.check("load "+entry+" (network stubbed)", vm.Load(proto, "")) {
+		return false
+	}
+
+	scriptOptions, err := readScriptOptions(vm)
+	if !v.check("options", err) {
+		return false
+	}
+	opts := mergeScriptOptions(v.cfg.StartOptions(), scriptOptions)
+	_, err = parseThresholds(opts.Thresholds)
+	v.check("thresholds", err)
+
+	execs := v.execs(opts)
+	var missing []string
+	for _, exec := range execs {
+		if _, ok := vm.LState().GetGlobal(exec).(*lua.LFunction); !ok {
+			missing = append(missing, exec+"()")
+		}
+	}
+	if len(missing) > 0 {
+		v.check("exec functions", errors.Errorf("expect global function %s", strings.Join(missing, ", ")))
+		return false
+	}
+	v.check("exec functions "+strings.Join(execs, ", "), nil)
+
+	if iterations > 0 {
+		client := opts.HTTPClient
+		if client == nil {
+			client = &http.Client{}
+		}
+		transport := client.Transport
+		if transport == nil {
+			transport = http.DefaultTransport
+		}
+		logged := *client
+		logged.Transport = &loggingTransport{RoundTripper: transport, logger: v.logger}
+		for _, exec := range execs {
+			runner := v.newVM(false, &logged)
+			err := runner.Load(proto, exec)
+			for i := 1; err == nil && i <= iterations; i++ {
+				err = runner.Run(int64(i))
+			}
+			runner.Stop()
+			v.check(fmt.Sprintf("run %s() %d times", exec, iterations), err)
+		}
+	}
+	return !v.failed
+}
+
+func (v *validator) newVM(stubNetwork bool, client *http.Client) *luavm.VM {
+	asyncPool := libpool.NewAsync(v.logger, DefaultAsyncWorkers, DefaultAsyncTimeout, DefaultAsyncQueueSize)
+	return luavm.New(v.logger, asyncPool, luacontext.NewGlobal(stat.Noop()), luavm.Parameters{
+		EnvVars:     v.cfg.Env,
+		Filesystem:  afero.NewCopyOnWriteFs(v.fs, afero.NewMemMapFs()),
+		HTTPClient:  client,
+		ModulePath:  v.cfg.ModulePath,
+		StubNetwork: stubNetwork,
+	})
+}
+
+// execs returns exec functions of scenarios, sorted and deduplicated
+func (v *validator) execs(opts *StartOptions) []string {
+	if len(opts.Scenarios) == 0 {
+		return []string{DefaultExec}
+	}
+	names := map[string]bool{}
+	for _, s := range opts.Scenarios {
+		exec := s.Exec
+		if exec == "" {
+			exec = DefaultExec
+		}
+		names[exec] = true
+	}
+	var execs []string
+	for name := range names {
+		execs = append(execs, name)
+	}
+	sort.Strings(execs)
+	return execs
+}
+
+// resolveImports finds files imported and modules required by literal names in source, recursively. Modules
+// already loaded (builtin ones) are skipped, others are searched in package.path of L
+func (v *validator) resolveImports(L *lua.LState, name, source string, visited map[string]bool) error {
+	visited[name] = true
+	loaded, _ := L.GetField(L.Get(lua.RegistryIndex), "_LOADED").(*lua.LTable)
+	modulePath := lua.LVAsString(L.GetField(L.GetGlobal("package"), "path"))
+
+	var problems []string
+	for _, match := range importRegexp.FindAllStringSubmatch(source, -1) {
+		path := match[2]
+		if match[1] == "require" {
+			if loaded != nil && loaded.RawGetString(path) != lua.LNil {
+				continue
+			}
+			path = v.findModule(modulePath, path)
+			if path == "" {
+				problems = append(problems, fmt.Sprintf("%s: module %s not found in %s", name, match[2], modulePath))
+				continue
+			}
+		}
+		if visited[path] {
+			continue
+		}
+
+		b, err := afero.ReadFile(v.fs, path)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s %s: %s", name, match[1], path, err))
+			continue
+		}
+		if _, err := luavm.Compile(string(b), path); err != nil {
+			problems = append(problems, err.Error())
+			visited[path] = true
+			continue
+		}
+		if err := v.resolveImports(L, path, string(b), visited); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// findModule returns the first file of package.path existing for module name, empty if none
+func (v *validator) findModule(modulePath, name string) string {
+	for _, template := range strings.Split(modulePath, ";") {
+		path := strings.ReplaceAll(template, "?", strings.ReplaceAll(name, ".", "/"))
+		if ok, _ := afero.Exists(v.fs, path); ok {
+			return path
+		}
+	}
+	return ""
+}
+
+// loggingTransport logs each request with its status and duration
+type loggingTransport struct {
+	http.RoundTripper
+	logger *zap.Logger
+}
+
+func (t *loggingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	res, err := t.RoundTripper.RoundTrip(req)
+	fields := []zap.Field{
+		zap.String("method", req.Method),
+		zap.String("url", req.URL.String()),
+		zap.Duration("duration", time.Since(start)),
+	}
+	if err != nil {
+		t.logger.Info("request failed", append(fields, zap.Error(err))...)
+		return nil, err
+	}
+	t.logger.Info("request", append(fields, zap.Int("status", res.StatusCode))...)
+	return res, nil
+}
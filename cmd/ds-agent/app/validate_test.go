@@ -0,0 +1,124 @@
+package app
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func newTestValidator(t *testing.T, files map[string]string) (*validator, *bytes.Buffer) {
+	fs := afero.NewMemMapFs()
+	for name, content := range files {
+		assert.Nil(t, afero.WriteFile(fs, name, []byte(content), 0600))
+	}
+	out := &bytes.Buffer{}
+	return &validator{
+		logger: zap.NewNop(),
+		out:    out,
+		fs:     fs,
+		cfg:    &Config{Entry: "main.lua", Bundle: "."},
+	}, out
+}
+
+func TestValidate(t *testing.T) {
+	v, out := newTestValidator(t, map[string]string{
+		"main.lua": `
+			local http = require "http"
+			local net = require "net"
+			local auth = require "lib.auth"
+			import("helpers.lua")
+			options = { vus = 2, thresholds = { ["http.success"] = { "rate > 0.9" } } }
+			-- network is stubbed while validating, placeholders are handed out
+			local err, body, _, status = http:get("http://127.0.0.1:1")()
+			assert(err == nil and body:size() == 0 and status == 200, err)
+			local err, conn = net:tcp("127.0.0.1:1")()
+			assert(err == nil, err)
+			assert(conn:write("ping")() == nil)
+			assert(conn:close()() == nil)
+			function run() end
+		`,
+		"lib/auth.lua": `return {}`,
+		"helpers.lua":  `require "lib.auth"`,
+	})
+	assert.True(t, v.validate(0), out.String())
+	assert.Contains(t, out.String(), "ok    exec functions run")
+}
+
+func TestValidateExamples(t *testing.T) {
+	dirs, err := ioutil.ReadDir("../../../examples")
+	assert.Nil(t, err)
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		fs, _, err := openBundle(filepath.Join("../../../examples", dir.Name()))
+		assert.Nil(t, err)
+		out := &bytes.Buffer{}
+		v := &validator{
+			logger: zap.NewNop(),
+			out:    out,
+			fs:     fs,
+			cfg:    &Config{Entry: "main.lua", Bundle: dir.Name()},
+		}
+		assert.True(t, v.validate(0), "%s: %s", dir.Name(), out.String())
+	}
+}
+
+func TestValidateRun(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+	}))
+	defer server.Close()
+
+	v, out := newTestValidator(t, map[string]string{
+		"main.lua": `
+			local http = require "http"
+			function run() assert(http:get(HOST)() == nil) end
+		`,
+	})
+	v.cfg.Env = map[string]string{"HOST": server.URL}
+	assert.True(t, v.validate(2), out.String())
+	assert.Contains(t, out.String(), "ok    run run() 2 times")
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+}
+
+func TestValidateFailures(t *testing.T) {
+	for name, c := range map[string]struct {
+		files    map[string]string
+		expected string
+	}{
+		"syntax": {
+			files:    map[string]string{"main.lua": `function run(`},
+			expected: "fail  compile main.lua",
+		},
+		"require": {
+			files:    map[string]string{"main.lua": `function run() require("lib.missing") end`},
+			expected: "fail  imports: main.lua: module lib.missing not found in ?.lua;?/init.lua",
+		},
+		"imported syntax": {
+			files:    map[string]string{"main.lua": `function run() import("a.lua") end`, "a.lua": `local = 1`},
+			expected: "fail  imports: a.lua",
+		},
+		"exec": {
+			files:    map[string]string{"main.lua": `options = { scenarios = { a = { exec = "browse" } } } function run() end`},
+			expected: "fail  exec functions: expect global function browse()",
+		},
+		"thresholds": {
+			files:    map[string]string{"main.lua": `options = { thresholds = { ["http.success"] = { "fast" } } } function run() end`},
+			expected: "fail  thresholds",
+		},
+	} {
+		v, out := newTestValidator(t, c.files)
+		assert.False(t, v.validate(0), name)
+		assert.Contains(t, out.String(), c.expected, name)
+	}
+}
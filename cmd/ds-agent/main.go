@@ -29,6 +29,11 @@ func main() {
 	}
 
 	rootCmd.AddCommand(app.MakeCmdRun(&logger, pDebug))
+	rootCmd.AddCommand(app.MakeCmdServe(&logger))
+	rootCmd.AddCommand(app.MakeCmdRepl(&logger))
+	rootCmd.AddCommand(app.MakeCmdValidate(&logger))
+	rootCmd.AddCommand(app.MakeCmdConvert(&logger))
+	rootCmd.AddCommand(app.MakeCmdRecord(&logger))
 
 	err := rootCmd.Execute()
 	if err != nil {
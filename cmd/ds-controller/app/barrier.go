@@ -0,0 +1,90 @@
+package app
+
+import (
+	"io"
+	"sync"
+
+	"go.uber.org/zap"
+
+	apiv1 "github.com/joesonw/lte/pkg/api/v1"
+)
+
+type countedBarrier struct {
+	parties    int32
+	arrived    int32
+	generation int64
+}
+
+// barrierCoordinator counts waiters of barriers on all agents, a barrier is released on all of them once its parties
+// arrived in total
+type barrierCoordinator struct {
+	logger   *zap.Logger
+	mu       *sync.Mutex
+	streams  []apiv1.Agent_BarriersClient
+	barriers map[string]*countedBarrier
+}
+
+func newBarrierCoordinator(logger *zap.Logger, streams []apiv1.Agent_BarriersClient) *barrierCoordinator {
+	return &barrierCoordinator{
+		logger:   logger,
+		mu:       &sync.Mutex{},
+		streams:  streams,
+		barriers: map[string]*countedBarrier{},
+	}
+}
+
+// serve counts arrivals of the i-th agent until its stream ends
+func (c *barrierCoordinator) serve(i int) error {
+	for {
+		arrival, err := c.streams[i].Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		c.arrive(arrival)
+	}
+}
+
+// arrive counts an arrival, arrivals and leaves of generations released already are ignored, as agents release their
+// waiters of such generations on their own
+func (c *barrierCoordinator) arrive(arrival *apiv1.BarrierArrival) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	name := arrival.GetName()
+	b := c.barriers[name]
+	if b == nil {
+		b = &countedBarrier{}
+		c.barriers[name] = b
+	}
+	if arrival.GetGeneration() != b.generation {
+		return
+	}
+	if arrival.GetLeft() {
+		if b.arrived > 0 {
+			b.arrived--
+		}
+		return
+	}
+	if b.arrived > 0 && b.parties != arrival.GetParties() {
+		c.logger.Warn("barrier arrival ignored, parties differ", zap.String("barrier", name),
+			zap.Int32("parties", b.parties), zap.Int32("arrival_parties", arrival.GetParties()))
+		return
+	}
+	b.parties = arrival.GetParties()
+	b.arrived++
+	if b.arrived < b.parties {
+		return
+	}
+
+	// releases are sent while locked, so agents receive them in order of generations
+	release := &apiv1.BarrierRelease{Name: name, Generation: b.generation}
+	b.generation++
+	b.arrived = 0
+	for _, stream := range c.streams {
+		if err := stream.Send(release); err != nil {
+			c.logger.Error("unable to release barrier", zap.String("barrier", name), zap.Error(err))
+		}
+	}
+}
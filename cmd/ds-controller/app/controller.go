@@ -0,0 +1,238 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+
+	apiv1 "github.com/joesonw/lte/pkg/api/v1"
+	"github.com/joesonw/lte/pkg/stat"
+)
+
+type Plan struct {
+	Entry       string
+	Concurrency int
+	Amount      int64
+	Duration    time.Duration
+	Rate        float64
+	Envs        map[string]string
+	StartDelay  time.Duration
+	AbortPolicy *apiv1.AbortPolicy
+}
+
+type agent struct {
+	addr   string
+	cc     *grpc.ClientConn
+	client apiv1.AgentClient
+}
+
+type Controller struct {
+	logger   *zap.Logger
+	agents   []*agent
+	reporter stat.Reporter
+}
+
+func NewController(logger *zap.Logger, addrs []string, reporter stat.Reporter, dialOpts ...grpc.DialOption) (*Controller, error) {
+	c := &Controller{
+		logger:   logger,
+		reporter: reporter,
+	}
+
+	for _, addr := range addrs {
+		cc, err := grpc.Dial(addr, dialOpts...)
+		if err != nil {
+			c.Close()
+			return nil, errors.Wrap(err, "unable to dial "+addr)
+		}
+		c.agents = append(c.agents, &agent{
+			addr:   addr,
+			cc:     cc,
+			client: apiv1.NewAgentClient(cc),
+		})
+	}
+
+	return c, nil
+}
+
+func (c *Controller) each(f func(i int, a *agent) error) error {
+	wg := &sync.WaitGroup{}
+	errs := make([]error, len(c.agents))
+	for i := range c.agents {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := f(i, c.agents[i]); err != nil {
+				errs[i] = errors.Wrap(err, c.agents[i].addr)
+			}
+		}(i)
+	}
+	wg.Wait()
+	return multierr.Combine(errs...)
+}
+
+func (c *Controller) Upload(ctx context.Context, name string, content []byte) error {
+	return c.each(func(_ int, a *agent) error {
+		_, err := a.client.Upload(ctx, &apiv1.UploadRequest{
+			Name:    name,
+			Content: content,
+		})
+		return err
+	})
+}
+
+// Run starts plan on all agents at the same time, and reports their stats until all of them are finished.
+// Returns abort reasons of agents that are aborted.
+func (c *Controller) Run(ctx context.Context, plan *Plan) ([]string, error) {
+	n := len(c.agents)
+	if plan.Concurrency < n {
+		return nil, fmt.Errorf("concurrency %d is less than amount of agents %d", plan.Concurrency, n)
+	}
+	if plan.Duration <= 0 && plan.Amount < int64(n) {
+		return nil, fmt.Errorf("amount %d is less than amount of agents %d", plan.Amount, n)
+	}
+
+	startAt := time.Now().Add(plan.StartDelay)
+	requests := splitPlan(plan, n, startAt)
+	streams := make([]apiv1.Agent_StatsClient, n)
+	streamCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// barriers are coordinated and stats are subscribed on all agents before any is started, so none of them is missed
+	barrierStreams := make([]apiv1.Agent_BarriersClient, n)
+	err := c.each(func(i int, a *agent) error {
+		stream, err := a.client.Barriers(streamCtx)
+		if err != nil {
+			return err
+		}
+		if _, err := stream.Header(); err != nil {
+			return err
+		}
+		barrierStreams[i] = stream
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	barriers := newBarrierCoordinator(c.logger, barrierStreams)
+	for i := range barrierStreams {
+		go func(i int) {
+			if err := barriers.serve(i); err != nil && streamCtx.Err() == nil {
+				c.logger.Error("barriers of agent failed", zap.String("agent", c.agents[i].addr), zap.Error(err))
+			}
+		}(i)
+	}
+
+	err = c.each(func(i int, a *agent) error {
+		stream, err := a.client.Stats(streamCtx, &apiv1.StatsRequest{Next: true})
+		if err != nil {
+			return err
+		}
+		if _, err := stream.Header(); err != nil {
+			return err
+		}
+		streams[i] = stream
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = c.each(func(i int, a *agent) error {
+		_, err := a.client.Start(ctx, requests[i])
+		return err
+	})
+	if err != nil {
+		c.Stop(context.Background())
+		return nil, err
+	}
+
+	c.logger.Info(fmt.Sprintf("%d agents will start at %s", n, startAt.Format(time.RFC3339Nano)))
+	err = c.each(func(i int, a *agent) error {
+		for {
+			s, err := streams[i].Recv()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			c.reporter.Report(s.ToStat().Tag("agent", a.addr))
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	reasons := make([]string, n)
+	err = c.each(func(i int, a *agent) error {
+		res, err := a.client.Status(ctx, &apiv1.StatusRequest{})
+		if err != nil {
+			return err
+		}
+		if res.GetAborted() {
+			reasons[i] = a.addr + ": " + res.GetAbortReason()
+		}
+		return nil
+	})
+
+	var aborted []string
+	for _, reason := range reasons {
+		if reason != "" {
+			aborted = append(aborted, reason)
+		}
+	}
+	return aborted, err
+}
+
+func (c *Controller) Stop(ctx context.Context) {
+	err := c.each(func(_ int, a *agent) error {
+		_, err := a.client.Stop(ctx, &apiv1.StopRequest{})
+		return err
+	})
+	if err != nil {
+		c.logger.Error("unable to stop agents", zap.Error(err))
+	}
+}
+
+func (c *Controller) Close() {
+	for _, a := range c.agents {
+		if err := a.cc.Close(); err != nil {
+			c.logger.Error("unable to close connection", zap.String("agent", a.addr), zap.Error(err))
+		}
+	}
+}
+
+// split divides total into n parts, the first total%n parts get one more
+func split(total int64, n, i int) int64 {
+	part := total / int64(n)
+	if int64(i) < total%int64(n) {
+		part++
+	}
+	return part
+}
+
+func splitPlan(plan *Plan, n int, startAt time.Time) []*apiv1.StartRequest {
+	requests := make([]*apiv1.StartRequest, n)
+	for i := 0; i < n; i++ {
+		req := &apiv1.StartRequest{
+			Entry:           plan.Entry,
+			Concurrency:     int32(split(int64(plan.Concurrency), n, i)),
+			DurationNs:      plan.Duration.Nanoseconds(),
+			Rate:            plan.Rate / float64(n),
+			Envs:            plan.Envs,
+			StartAtUnixNano: startAt.UnixNano(),
+			AbortPolicy:     plan.AbortPolicy,
+		}
+		if plan.Duration <= 0 {
+			req.Amount = split(plan.Amount, n, i)
+		}
+		requests[i] = req
+	}
+	return requests
+}
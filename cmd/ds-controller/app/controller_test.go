@@ -0,0 +1,152 @@
+package app
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+
+	agentapp "github.com/joesonw/lte/cmd/ds-agent/app"
+	apiv1 "github.com/joesonw/lte/pkg/api/v1"
+	"github.com/joesonw/lte/pkg/stat"
+)
+
+type countingReporter struct {
+	mu     sync.Mutex
+	counts map[string]map[string]int
+}
+
+func (r *countingReporter) Report(stats ...*stat.Stat) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, s := range stats {
+		if r.counts[s.Name] == nil {
+			r.counts[s.Name] = map[string]int{}
+		}
+		r.counts[s.Name][s.Tags["agent"]]++
+	}
+}
+
+func (r *countingReporter) Finish() error { return nil }
+
+func startAgents(t *testing.T, n int) []string {
+	var addrs []string
+	for i := 0; i < n; i++ {
+		dir, err := ioutil.TempDir("", "ds-agent")
+		assert.Nil(t, err)
+		t.Cleanup(func() {
+			os.RemoveAll(dir)
+		})
+
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.Nil(t, err)
+		server := grpc.NewServer()
+		apiv1.RegisterAgentServer(server, agentapp.NewAgentServer(zap.NewNop(), dir, nil))
+		go server.Serve(lis) //nolint:errcheck
+		t.Cleanup(server.Stop)
+		addrs = append(addrs, lis.Addr().String())
+	}
+	return addrs
+}
+
+func TestController(t *testing.T) {
+	addrs := startAgents(t, 3)
+	reporter := &countingReporter{counts: map[string]map[string]int{}}
+	controller, err := NewController(zap.NewNop(), addrs, reporter, grpc.WithInsecure())
+	assert.Nil(t, err)
+	defer controller.Close()
+
+	ctx := context.Background()
+	assert.Nil(t, controller.Upload(ctx, "main.lua", []byte(`
+		function run(id)
+			assert(ENV_NAME == "test")
+		end
+	`)))
+
+	// stats of agents started at once are not missed either
+	for _, delay := range []time.Duration{time.Millisecond * 100, 0} {
+		reporter.counts = map[string]map[string]int{}
+		aborted, err := controller.Run(ctx, &Plan{
+			Entry:       "main.lua",
+			Concurrency: 4,
+			Amount:      10,
+			Envs:        map[string]string{"ENV_NAME": "test"},
+			StartDelay:  delay,
+		})
+		assert.Nil(t, err)
+		assert.Empty(t, aborted)
+
+		assert.Equal(t, map[string]int{addrs[0]: 4, addrs[1]: 3, addrs[2]: 3}, reporter.counts["run"], delay)
+	}
+}
+
+func TestControllerBarrier(t *testing.T) {
+	addrs := startAgents(t, 2)
+	reporter := &countingReporter{counts: map[string]map[string]int{}}
+	controller, err := NewController(zap.NewNop(), addrs, reporter, grpc.WithInsecure())
+	assert.Nil(t, err)
+	defer controller.Close()
+
+	// each agent runs 2 vus, the barrier is released only if vus of both agents are counted
+	ctx := context.Background()
+	assert.Nil(t, controller.Upload(ctx, "main.lua", []byte(`
+		local barrier = require "barrier"
+		function run(id)
+			local err = barrier:wait("all", 4, 2000)()
+			assert(err == nil, err)
+		end
+	`)))
+
+	aborted, err := controller.Run(ctx, &Plan{
+		Entry:       "main.lua",
+		Concurrency: 4,
+		Amount:      8,
+		AbortPolicy: &apiv1.AbortPolicy{ConsecutiveErrors: 1},
+	})
+	assert.Nil(t, err)
+	assert.Empty(t, aborted)
+	assert.Equal(t, map[string]int{addrs[0]: 4, addrs[1]: 4}, reporter.counts["barrier"])
+}
+
+func TestControllerAbort(t *testing.T) {
+	addrs := startAgents(t, 2)
+	controller, err := NewController(zap.NewNop(), addrs, stat.Noop(), grpc.WithInsecure())
+	assert.Nil(t, err)
+	defer controller.Close()
+
+	ctx := context.Background()
+	assert.Nil(t, controller.Upload(ctx, "main.lua", []byte(`
+		function run(id)
+			error("failed")
+		end
+	`)))
+
+	aborted, err := controller.Run(ctx, &Plan{
+		Entry:       "main.lua",
+		Concurrency: 2,
+		Duration:    time.Minute,
+		AbortPolicy: &apiv1.AbortPolicy{ConsecutiveErrors: 5},
+	})
+	assert.Nil(t, err)
+	assert.Len(t, aborted, 2)
+}
+
+func TestSplitPlan(t *testing.T) {
+	requests := splitPlan(&Plan{
+		Concurrency: 10,
+		Amount:      100,
+		Rate:        30,
+	}, 3, time.Now())
+	assert.Equal(t, int32(4), requests[0].GetConcurrency())
+	assert.Equal(t, int32(3), requests[2].GetConcurrency())
+	assert.Equal(t, int64(34), requests[0].GetAmount())
+	assert.Equal(t, int64(33), requests[1].GetAmount())
+	assert.Equal(t, float64(10), requests[2].GetRate())
+}
@@ -0,0 +1,135 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+
+	apiv1 "github.com/joesonw/lte/pkg/api/v1"
+	"github.com/joesonw/lte/pkg/stat"
+	goutil "github.com/joesonw/lte/pkg/util"
+)
+
+const exitCodeAborted = 3
+
+func MakeCmdRun(
+	pLogger **zap.Logger,
+) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "run",
+		Short: "run script on all agents",
+	}
+
+	pAgents := cmd.Flags().StringArrayP("agent", "a", nil, "agent address, can be repeated")
+	pEnvs := cmd.Flags().StringArrayP("env", "e", nil, "set lua script environment variables")
+	pDuration := cmd.Flags().DurationP("duration", "t", 0, "run amount of take, takes precedence of --amount/-n")
+	pAmount := cmd.Flags().IntP("amount", "n", 1, "amount of requests/runs to be made, split across agents")
+	pConcurrency := cmd.Flags().IntP("concurrency", "c", 1, "run concurrency, split across agents")
+	pRate := cmd.Flags().Float64P("rate", "r", 0, "max runs per second, split across agents, 0 for unlimited")
+	pFile := cmd.Flags().StringP("file", "f", "", "zip file of contents")
+	pDirectory := cmd.Flags().StringP("directory", "d", "", "directory of contents")
+	pOut := cmd.Flags().StringP("out", "o", "console", "stats output target")
+	pStartDelay := cmd.Flags().Duration("start-delay", time.Second*3, "delay before agents start together")
+	pAbortErrorRate := cmd.Flags().Float64("abort-on-error-rate", 0, "abort when error rate (0-1) over --abort-window reaches this value")
+	pAbortWindow := cmd.Flags().Duration("abort-window", time.Second*30, "sliding window used by --abort-on-error-rate")
+	pAbortConsecutive := cmd.Flags().Int64("abort-after-consecutive-errors", 0, "abort after this many consecutive failed runs")
+
+	cmd.Args = cobra.ExactValidArgs(1)
+	cmd.Run = func(cmd *cobra.Command, args []string) {
+		logger := *pLogger
+		var reporter stat.Reporter
+		switch *pOut {
+		case "console":
+			reporter = stat.Console()
+		default:
+			logger.Fatal(fmt.Sprintf("output \"%s\" is not supoprted", *pOut))
+		}
+
+		if len(*pAgents) == 0 {
+			logger.Fatal("at least one --agent/-a has to be specified")
+		}
+
+		envs := map[string]string{}
+		for _, env := range *pEnvs {
+			kvs := strings.Split(env, "=")
+			if len(kvs) >= 2 {
+				envs[kvs[0]] = strings.Join(kvs[1:], "=")
+			}
+		}
+
+		var name string
+		var content []byte
+		var err error
+		if *pDirectory != "" {
+			name = "bundle.zip"
+			content, err = goutil.ZipDirectory(*pDirectory)
+		} else if *pFile != "" {
+			name = filepath.Base(*pFile)
+			content, err = ioutil.ReadFile(*pFile)
+		} else {
+			logger.Fatal("either --file/-f or --directory/-d has to be specified")
+		}
+		if err != nil {
+			logger.Fatal("unable to read bundle", zap.Error(err))
+		}
+
+		controller, err := NewController(logger, *pAgents, reporter, grpc.WithInsecure())
+		if err != nil {
+			logger.Fatal("unable to connect agents", zap.Error(err))
+		}
+		defer controller.Close()
+
+		ctx := context.Background()
+		if err := controller.Upload(ctx, name, content); err != nil {
+			logger.Fatal("unable to upload bundle", zap.Error(err))
+		}
+
+		chSignal := make(chan os.Signal, 1)
+		signal.Notify(chSignal, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-chSignal
+			logger.Info("interrupted, stopping agents")
+			controller.Stop(context.Background())
+		}()
+
+		aborted, err := controller.Run(ctx, &Plan{
+			Entry:       args[0],
+			Concurrency: *pConcurrency,
+			Amount:      int64(*pAmount),
+			Duration:    *pDuration,
+			Rate:        *pRate,
+			Envs:        envs,
+			StartDelay:  *pStartDelay,
+			AbortPolicy: &apiv1.AbortPolicy{
+				ErrorRate:         *pAbortErrorRate,
+				WindowNs:          pAbortWindow.Nanoseconds(),
+				ConsecutiveErrors: *pAbortConsecutive,
+			},
+		})
+		signal.Stop(chSignal)
+		if err != nil {
+			logger.Error("unable to run", zap.Error(err))
+		}
+
+		if err := reporter.Finish(); err != nil {
+			logger.Error("unable to report stast", zap.Error(err))
+		}
+		if len(aborted) > 0 {
+			logger.Error("job aborted: " + strings.Join(aborted, "; "))
+			controller.Close()
+			os.Exit(exitCodeAborted)
+		}
+	}
+
+	return cmd
+}
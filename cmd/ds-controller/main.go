@@ -0,0 +1,38 @@
+package main
+
+import (
+	"os"
+
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+
+	"github.com/joesonw/lte/cmd/ds-controller/app"
+)
+
+func main() {
+
+	var logger *zap.Logger
+	rootCmd := &cobra.Command{
+		Use:   "distress-ds-controller",
+		Short: "distributed stress ds-controller",
+	}
+
+	pDebug := rootCmd.PersistentFlags().Bool("debug", false, "enable debug mode")
+	rootCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		var err error
+		if *pDebug {
+			logger, err = zap.NewDevelopment()
+		} else {
+			logger, err = zap.NewProduction()
+		}
+		return err
+	}
+
+	rootCmd.AddCommand(app.MakeCmdRun(&logger))
+
+	err := rootCmd.Execute()
+	if err != nil {
+		println(err)
+		os.Exit(1)
+	}
+}
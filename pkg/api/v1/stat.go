@@ -0,0 +1,27 @@
+package apiv1
+
+import (
+	"time"
+
+	"github.com/joesonw/lte/pkg/stat"
+)
+
+func NewStat(s *stat.Stat) *Stat {
+	return &Stat{
+		Name:              s.Name,
+		TimestampUnixNano: s.Timestamp.UnixNano(),
+		Tags:              s.Tags,
+		Fields:            s.Fields,
+	}
+}
+
+func (x *Stat) ToStat() *stat.Stat {
+	s := stat.New(x.GetName()).SetTime(time.Unix(0, x.GetTimestampUnixNano()))
+	for k, v := range x.GetTags() {
+		s.Tag(k, v)
+	}
+	for k, v := range x.GetFields() {
+		s.FloatField(k, v)
+	}
+	return s
+}
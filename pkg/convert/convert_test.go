@@ -0,0 +1,113 @@
+package convert_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	lua "github.com/yuin/gopher-lua"
+	"go.uber.org/zap"
+
+	"github.com/joesonw/lte/pkg/convert"
+	luacontext "github.com/joesonw/lte/pkg/lua/context"
+	libpool "github.com/joesonw/lte/pkg/lua/lib/pool"
+	luavm "github.com/joesonw/lte/pkg/lua/vm"
+	"github.com/joesonw/lte/pkg/stat"
+)
+
+const testHAR = `{"log": {
+	"pages": [{"id": "page_1", "title": "Home"}, {"id": "page_2", "title": "Checkout \"now\""}],
+	"entries": [
+		{"pageref": "page_2", "startedDateTime": "2020-01-01T00:00:02.000Z", "time": 100,
+		 "request": {"method": "POST", "url": "%[1]s/orders?id=1",
+			"headers": [{"name": "Content-Type", "value": "application/json"}, {"name": "Content-Length", "value": "13"}],
+			"postData": {"mimeType": "application/json", "text": "{\"qty\":\"1\n\"}"}},
+		 "response": {"content": {"mimeType": "application/json"}}},
+		{"pageref": "page_1", "startedDateTime": "2020-01-01T00:00:00.000Z", "time": 50,
+		 "request": {"method": "GET", "url": "%[1]s/", "headers": [{"name": "accept", "value": "text/html"}, {"name": ":authority", "value": "x"}],
+			"cookies": [{"name": "sid", "value": "abc"}]},
+		 "response": {"content": {"mimeType": "text/html"}}},
+		{"pageref": "page_1", "startedDateTime": "2020-01-01T00:00:00.100Z", "time": 10,
+		 "request": {"method": "GET", "url": "%[1]s/app.js", "headers": []},
+		 "response": {"content": {"mimeType": "application/javascript"}}},
+		{"pageref": "page_1", "startedDateTime": "2020-01-01T00:00:00.200Z", "time": 10,
+		 "request": {"method": "GET", "url": "https://cdn.example.com/logo", "headers": []},
+		 "response": {"content": {"mimeType": "image/png"}}}
+	]
+}}`
+
+func TestHARToScript(t *testing.T) {
+	mu := &sync.Mutex{}
+	var received []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		received = append(received, fmt.Sprintf("%s %s %s %s %q", r.Method, r.URL.RequestURI(), r.Header.Get("Accept"), r.Header.Get("Cookie"), b))
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	requests, err := convert.ReadHAR(strings.NewReader(fmt.Sprintf(testHAR, server.URL)))
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(requests))
+	assert.Equal(t, "Home", requests[0].Page)
+
+	selected := convert.Select(requests, convert.Filter{Domains: []string{"127.0.0.1"}, ExcludeStatic: true})
+	assert.Equal(t, 2, len(selected))
+	assert.Equal(t, 3, len(convert.Select(requests, convert.Filter{Domains: []string{"127.0.0.1"}})))
+	assert.Equal(t, 1, len(convert.Select(requests, convert.Filter{Domains: []string{"example.com"}})))
+
+	groups := convert.GroupByPage(selected)
+	assert.Equal(t, 2, len(groups))
+	out := &bytes.Buffer{}
+	assert.Nil(t, convert.Generate(out, groups, convert.Options{ThinkTime: true}))
+	script := out.String()
+	assert.Contains(t, script, `group("Checkout \"now\"", function()`)
+	assert.Contains(t, script, "sleep(1950000000)() -- 1.95s")
+	assert.NotContains(t, script, "Content-Length")
+	assert.NotContains(t, script, ":authority")
+
+	vm := luavm.New(zap.NewNop(), libpool.NewAsync(zap.NewNop(), 4, 0, 16), luacontext.NewGlobal(stat.Noop()), luavm.Parameters{
+		Filesystem: afero.NewMemMapFs(),
+	})
+	defer vm.Stop()
+	proto, err := luavm.Compile(script, "main.lua")
+	assert.Nil(t, err, script)
+	assert.Nil(t, vm.Load(proto, "run"))
+	// sleeps are recorded once awaited rather than slept
+	var slept []int64
+	L := vm.LState()
+	L.SetGlobal("sleep", L.NewFunction(func(L *lua.LState) int {
+		ns := L.CheckInt64(1)
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			slept = append(slept, ns)
+			return 0
+		}))
+		return 1
+	}))
+	assert.Nil(t, vm.Run(1))
+	assert.Equal(t, []int64{1950000000}, slept)
+	assert.Equal(t, []string{
+		`GET / text/html sid=abc ""`,
+		fmt.Sprintf("POST /orders?id=1   %q", "{\"qty\":\"1\n\"}"),
+	}, received)
+}
+
+func TestGroupByIdle(t *testing.T) {
+	start := time.Now()
+	at := func(ms int) *convert.Request {
+		return &convert.Request{URL: "http://a", StartedAt: start.Add(time.Duration(ms) * time.Millisecond), Duration: time.Millisecond * 100}
+	}
+	groups := convert.GroupByIdle([]*convert.Request{at(0), at(50), at(1200), at(3000), at(3100)}, time.Second)
+	assert.Equal(t, 3, len(groups))
+	assert.Equal(t, "step 3", groups[2].Name)
+	assert.Equal(t, 2, len(groups[2].Requests))
+}
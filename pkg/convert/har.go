@@ -0,0 +1,103 @@
+package convert
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// har is the subset of HTTP Archive 1.2 read by ReadHAR
+type har struct {
+	Log struct {
+		Pages []struct {
+			ID    string `json:"id"`
+			Title string `json:"title"`
+		} `json:"pages"`
+		Entries []harEntry `json:"entries"`
+	} `json:"log"`
+}
+
+type harEntry struct {
+	PageRef         string    `json:"pageref"`
+	StartedDateTime time.Time `json:"startedDateTime"`
+	// Time is total time of the request in milliseconds
+	Time    float64 `json:"time"`
+	Request struct {
+		Method  string      `json:"method"`
+		URL     string      `json:"url"`
+		Headers []harHeader `json:"headers"`
+		Cookies []struct {
+			Name  string `json:"name"`
+			Value string `json:"value"`
+		} `json:"cookies"`
+		PostData *struct {
+			MimeType string `json:"mimeType"`
+			Text     string `json:"text"`
+		} `json:"postData"`
+	} `json:"request"`
+	Response struct {
+		Content struct {
+			MimeType string `json:"mimeType"`
+		} `json:"content"`
+	} `json:"response"`
+}
+
+type harHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// ReadHAR reads requests of a HAR file ordered by start time, page of a request is title of its page
+func ReadHAR(r io.Reader) ([]*Request, error) {
+	archive := &har{}
+	if err := json.NewDecoder(r).Decode(archive); err != nil {
+		return nil, errors.Wrap(err, "unable to decode har")
+	}
+
+	titles := map[string]string{}
+	for _, page := range archive.Log.Pages {
+		titles[page.ID] = page.Title
+		if page.Title == "" {
+			titles[page.ID] = page.ID
+		}
+	}
+
+	requests := make([]*Request, 0, len(archive.Log.Entries))
+	for _, entry := range archive.Log.Entries {
+		header := http.Header{}
+		for _, h := range entry.Request.Headers {
+			header.Add(h.Name, h.Value)
+		}
+		// cookies are listed apart from headers by some browsers
+		if header.Get("Cookie") == "" {
+			for _, c := range entry.Request.Cookies {
+				header.Add("Cookie", c.Name+"="+c.Value)
+			}
+		}
+
+		r := &Request{
+			Page:         titles[entry.PageRef],
+			Method:       entry.Request.Method,
+			URL:          entry.Request.URL,
+			Header:       header,
+			StartedAt:    entry.StartedDateTime,
+			Duration:     time.Duration(entry.Time * float64(time.Millisecond)),
+			ResponseType: entry.Response.Content.MimeType,
+		}
+		if entry.Request.PostData != nil {
+			r.Body = []byte(entry.Request.PostData.Text)
+			if r.Header.Get("Content-Type") == "" && entry.Request.PostData.MimeType != "" {
+				r.Header.Set("Content-Type", entry.Request.PostData.MimeType)
+			}
+		}
+		requests = append(requests, r)
+	}
+	sort.SliceStable(requests, func(i, j int) bool {
+		return requests[i].StartedAt.Before(requests[j].StartedAt)
+	})
+	return requests, nil
+}
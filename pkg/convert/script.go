@@ -0,0 +1,248 @@
+package convert
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// DefaultMinThinkTime is the shortest gap between requests generated as a sleep
+const DefaultMinThinkTime = time.Millisecond * 500
+
+// skippedHeaders are set by http client of the agent, Accept-Encoding is skipped as well so responses are decompressed
+var skippedHeaders = map[string]bool{
+	"Host":              true,
+	"Connection":        true,
+	"Content-Length":    true,
+	"Accept-Encoding":   true,
+	"Proxy-Connection":  true,
+	"Transfer-Encoding": true,
+}
+
+var staticExtensions = map[string]bool{
+	".js": true, ".mjs": true, ".css": true, ".map": true,
+	".png": true, ".jpg": true, ".jpeg": true, ".gif": true, ".svg": true, ".ico": true, ".webp": true, ".avif": true,
+	".woff": true, ".woff2": true, ".ttf": true, ".otf": true, ".eot": true,
+	".mp4": true, ".webm": true, ".mp3": true,
+}
+
+var staticContentTypes = []string{"image/", "font/", "video/", "audio/", "text/css", "javascript"}
+
+// Request is a recorded http request
+type Request struct {
+	// Page names the group request belongs to
+	Page      string
+	Method    string
+	URL       string
+	Header    http.Header
+	Body      []byte
+	StartedAt time.Time
+	Duration  time.Duration
+	// ResponseType is content type of the response, it tells static assets besides extension of url
+	ResponseType string
+}
+
+// Group is a sequence of requests generated into one `group()` call
+type Group struct {
+	Name     string
+	Requests []*Request
+}
+
+// Filter selects requests converted, all requests are selected by a zero Filter
+type Filter struct {
+	// Domains selects requests to these hosts and their subdomains, all hosts if empty
+	Domains []string
+	// ExcludeStatic drops scripts, styles, images, fonts and media
+	ExcludeStatic bool
+}
+
+func (f Filter) Match(r *Request) bool {
+	u, err := url.Parse(r.URL)
+	if err != nil {
+		return false
+	}
+	if len(f.Domains) > 0 {
+		host := strings.ToLower(u.Hostname())
+		matched := false
+		for _, domain := range f.Domains {
+			domain = strings.ToLower(strings.TrimPrefix(domain, "."))
+			if host == domain || strings.HasSuffix(host, "."+domain) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return !f.ExcludeStatic || !isStatic(u, r.ResponseType)
+}
+
+func isStatic(u *url.URL, contentType string) bool {
+	if staticExtensions[strings.ToLower(path.Ext(u.Path))] {
+		return true
+	}
+	contentType = strings.ToLower(contentType)
+	for _, t := range staticContentTypes {
+		if strings.Contains(contentType, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Select returns requests matched by filter
+func Select(requests []*Request, filter Filter) []*Request {
+	var selected []*Request
+	for _, r := range requests {
+		if filter.Match(r) {
+			selected = append(selected, r)
+		}
+	}
+	return selected
+}
+
+// GroupByPage groups requests by page, groups are ordered by their first request
+func GroupByPage(requests []*Request) []*Group {
+	var groups []*Group
+	byPage := map[string]*Group{}
+	for _, r := range requests {
+		g, ok := byPage[r.Page]
+		if !ok {
+			name := r.Page
+			if name == "" {
+				name = fmt.Sprintf("page %d", len(groups)+1)
+			}
+			g = &Group{Name: name}
+			byPage[r.Page] = g
+			groups = append(groups, g)
+		}
+		g.Requests = append(g.Requests, r)
+	}
+	return groups
+}
+
+// GroupByIdle starts a new group whenever no request is started for idle since the previous one finished
+func GroupByIdle(requests []*Request, idle time.Duration) []*Group {
+	var groups []*Group
+	var last time.Time
+	for _, r := range requests {
+		if len(groups) == 0 || r.StartedAt.Sub(last) >= idle {
+			groups = append(groups, &Group{Name: fmt.Sprintf("step %d", len(groups)+1)})
+		}
+		g := groups[len(groups)-1]
+		g.Requests = append(g.Requests, r)
+		if end := r.StartedAt.Add(r.Duration); end.After(last) {
+			last = end
+		}
+	}
+	return groups
+}
+
+// Options of generated script
+type Options struct {
+	// ThinkTime sleeps for gaps between recorded requests of at least MinThinkTime
+	ThinkTime    bool
+	MinThinkTime time.Duration
+}
+
+// Generate writes a script calling requests of groups in order, each group is wrapped in a `group()` call
+func Generate(w io.Writer, groups []*Group, opts Options) error {
+	if opts.MinThinkTime <= 0 {
+		opts.MinThinkTime = DefaultMinThinkTime
+	}
+
+	bw := bufio.NewWriter(w)
+	bw.WriteString("local http = require \"http\"\n\nfunction run()\n")
+	var previous *Request
+	for i, g := range groups {
+		if i > 0 {
+			bw.WriteString("\n")
+		}
+		fmt.Fprintf(bw, "\tgroup(%s, function()\n", quote(g.Name))
+		for _, r := range g.Requests {
+			if opts.ThinkTime && previous != nil {
+				if gap := r.StartedAt.Sub(previous.StartedAt.Add(previous.Duration)); gap >= opts.MinThinkTime {
+					fmt.Fprintf(bw, "\t\tsleep(%d)() -- %s\n", gap.Round(time.Millisecond).Nanoseconds(), gap.Round(time.Millisecond))
+				}
+			}
+			writeRequest(bw, r)
+			previous = r
+		}
+		bw.WriteString("\tend)\n")
+	}
+	bw.WriteString("end\n")
+	return bw.Flush()
+}
+
+func writeRequest(w *bufio.Writer, r *Request) {
+	var names []string
+	for name := range r.Header {
+		name = http.CanonicalHeaderKey(name)
+		if !skippedHeaders[name] && !strings.HasPrefix(name, ":") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	method := strings.ToLower(r.Method)
+	if method == "" {
+		method = "get"
+	}
+	fmt.Fprintf(w, "\t\tlocal err, body, headers, status = http:%s(%s", method, quote(r.URL))
+	if len(names) > 0 || len(r.Body) > 0 {
+		w.WriteString(", {\n")
+		if len(names) > 0 {
+			w.WriteString("\t\t\theaders = {\n")
+			for _, name := range names {
+				sep := ", "
+				if name == "Cookie" {
+					sep = "; "
+				}
+				fmt.Fprintf(w, "\t\t\t\t[%s] = %s,\n", quote(name), quote(strings.Join(r.Header.Values(name), sep)))
+			}
+			w.WriteString("\t\t\t},\n")
+		}
+		if len(r.Body) > 0 {
+			fmt.Fprintf(w, "\t\t\tbody = %s,\n", quote(string(r.Body)))
+		}
+		w.WriteString("\t\t}")
+	}
+	w.WriteString(")()\n")
+	fmt.Fprintf(w, "\t\tassert(err == nil, err)\n")
+}
+
+// quote returns a lua string literal of s, control bytes are escaped in decimal, as well as non ascii bytes unless s
+// is valid utf-8
+func quote(s string) string {
+	valid := utf8.ValidString(s)
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c == '\n':
+			b.WriteString(`\n`)
+		case c == '\r':
+			b.WriteString(`\r`)
+		case c == '\t':
+			b.WriteString(`\t`)
+		case c < 0x20 || c == 0x7f || (c >= 0x80 && !valid):
+			fmt.Fprintf(&b, "\\%03d", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
@@ -0,0 +1,204 @@
+package context
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Barrier releases all waiters of a name once parties of them arrived
+type Barrier interface {
+	Wait(ctx context.Context, name string, parties int) error
+}
+
+type barrierGeneration struct {
+	parties   int
+	arrived   int
+	chRelease chan struct{}
+}
+
+// LocalBarrier is a Barrier of vms in the same process
+type LocalBarrier struct {
+	mu          *sync.Mutex
+	generations map[string]*barrierGeneration
+}
+
+func NewLocalBarrier() *LocalBarrier {
+	return &LocalBarrier{
+		mu:          &sync.Mutex{},
+		generations: map[string]*barrierGeneration{},
+	}
+}
+
+// Wait blocks until parties waiters of name arrived or ctx is done, a waiter leaving on ctx is not counted.
+// Once released the barrier of name can be used again.
+func (b *LocalBarrier) Wait(ctx context.Context, name string, parties int) error {
+	if parties < 1 {
+		return fmt.Errorf("barrier %s needs at least 1 party, got %d", name, parties)
+	}
+
+	b.mu.Lock()
+	g := b.generations[name]
+	if g == nil {
+		g = &barrierGeneration{
+			parties:   parties,
+			chRelease: make(chan struct{}),
+		}
+		b.generations[name] = g
+	}
+	if g.parties != parties {
+		b.mu.Unlock()
+		return fmt.Errorf("barrier %s is waiting for %d parties, got %d", name, g.parties, parties)
+	}
+	g.arrived++
+	if g.arrived == g.parties {
+		delete(b.generations, name)
+		close(g.chRelease)
+		b.mu.Unlock()
+		return nil
+	}
+	b.mu.Unlock()
+
+	select {
+	case <-g.chRelease:
+		return nil
+	case <-ctx.Done():
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		select {
+		case <-g.chRelease:
+			return nil
+		default:
+		}
+		g.arrived--
+		if g.arrived == 0 {
+			delete(b.generations, name)
+		}
+		return ctx.Err()
+	}
+}
+
+// BarrierArrival tells a coordinator a waiter arrived at, or left, generation of barrier name
+type BarrierArrival struct {
+	Name       string
+	Parties    int
+	Generation int64
+	Left       bool
+}
+
+type coordinatedBarrier struct {
+	parties    int
+	waiting    int
+	generation int64
+	chRelease  chan struct{}
+}
+
+// CoordinatedBarrier is a Barrier whose waiters are counted by a coordinator, e.g. the controller counting vms of all
+// agents. Arrivals are sent to the coordinator, which releases generations of barriers by Release
+type CoordinatedBarrier struct {
+	mu       *sync.Mutex
+	send     func(BarrierArrival) error
+	barriers map[string]*coordinatedBarrier
+	err      error
+	chClosed chan struct{}
+}
+
+func NewCoordinatedBarrier(send func(BarrierArrival) error) *CoordinatedBarrier {
+	return &CoordinatedBarrier{
+		mu:       &sync.Mutex{},
+		send:     send,
+		barriers: map[string]*coordinatedBarrier{},
+		chClosed: make(chan struct{}),
+	}
+}
+
+func (b *CoordinatedBarrier) barrier(name string) *coordinatedBarrier {
+	cb := b.barriers[name]
+	if cb == nil {
+		cb = &coordinatedBarrier{chRelease: make(chan struct{})}
+		b.barriers[name] = cb
+	}
+	return cb
+}
+
+// Wait blocks until the coordinator releases the barrier, ctx is done or the barrier is closed
+func (b *CoordinatedBarrier) Wait(ctx context.Context, name string, parties int) error {
+	if parties < 1 {
+		return fmt.Errorf("barrier %s needs at least 1 party, got %d", name, parties)
+	}
+
+	b.mu.Lock()
+	if b.err != nil {
+		b.mu.Unlock()
+		return b.err
+	}
+	cb := b.barrier(name)
+	if cb.waiting > 0 && cb.parties != parties {
+		b.mu.Unlock()
+		return fmt.Errorf("barrier %s is waiting for %d parties, got %d", name, cb.parties, parties)
+	}
+	cb.parties = parties
+	cb.waiting++
+	arrival := BarrierArrival{Name: name, Parties: parties, Generation: cb.generation}
+	chRelease := cb.chRelease
+	b.mu.Unlock()
+
+	if err := b.send(arrival); err != nil {
+		b.leave(cb, chRelease)
+		return err
+	}
+
+	select {
+	case <-chRelease:
+		return nil
+	case <-b.chClosed:
+		return b.err
+	case <-ctx.Done():
+		if !b.leave(cb, chRelease) {
+			return nil
+		}
+		arrival.Left = true
+		// a failed leave is dropped, the coordinator is gone or counts the waiter released
+		_ = b.send(arrival)
+		return ctx.Err()
+	}
+}
+
+// leave uncounts a waiter of generation released by chRelease, it returns false if the generation was released already
+func (b *CoordinatedBarrier) leave(cb *coordinatedBarrier, chRelease chan struct{}) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	select {
+	case <-chRelease:
+		return false
+	default:
+	}
+	cb.waiting--
+	return true
+}
+
+// Release releases waiters of generation of barrier name, and waiters arrive at the next generation from now on.
+// Generations already released are ignored
+func (b *CoordinatedBarrier) Release(name string, generation int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	cb := b.barrier(name)
+	if generation < cb.generation {
+		return
+	}
+	close(cb.chRelease)
+	cb.chRelease = make(chan struct{})
+	cb.generation = generation + 1
+	cb.waiting = 0
+}
+
+// Close fails waiters and later waits with err, e.g. once the coordinator is gone
+func (b *CoordinatedBarrier) Close(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		return
+	}
+	b.err = err
+	close(b.chClosed)
+}
@@ -0,0 +1,93 @@
+package context_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	luacontext "github.com/joesonw/lte/pkg/lua/context"
+)
+
+func TestLocalBarrier(t *testing.T) {
+	b := luacontext.NewLocalBarrier()
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Nil(t, b.Wait(context.Background(), "spike", 3))
+		}()
+	}
+	wg.Wait()
+
+	// a waiter timed out is not counted
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, b.Wait(ctx, "spike", 2))
+	assert.NotNil(t, b.Wait(context.Background(), "spike", 0))
+
+	chDone := make(chan struct{})
+	go func() {
+		defer close(chDone)
+		assert.Nil(t, b.Wait(context.Background(), "spike", 2))
+	}()
+	time.Sleep(time.Millisecond * 10)
+	assert.NotNil(t, b.Wait(context.Background(), "spike", 3))
+	assert.Nil(t, b.Wait(context.Background(), "spike", 2))
+	<-chDone
+
+	// a barrier left by all waiters is forgotten along with its parties
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, b.Wait(ctx, "left", 3))
+	go func() {
+		assert.Nil(t, b.Wait(context.Background(), "left", 2))
+	}()
+	assert.Nil(t, b.Wait(context.Background(), "left", 2))
+}
+
+func TestCoordinatedBarrier(t *testing.T) {
+	var b *luacontext.CoordinatedBarrier
+	mu := &sync.Mutex{}
+	var arrivals []luacontext.BarrierArrival
+	b = luacontext.NewCoordinatedBarrier(func(arrival luacontext.BarrierArrival) error {
+		mu.Lock()
+		defer mu.Unlock()
+		arrivals = append(arrivals, arrival)
+		// the coordinator counts 2 arrivals, e.g. one of this and one of another agent
+		if !arrival.Left && arrival.Parties == 2 {
+			go b.Release(arrival.Name, arrival.Generation)
+		}
+		return nil
+	})
+
+	assert.Nil(t, b.Wait(context.Background(), "spike", 2))
+	assert.Nil(t, b.Wait(context.Background(), "spike", 2))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, b.Wait(ctx, "slow", 3))
+
+	mu.Lock()
+	assert.Equal(t, []luacontext.BarrierArrival{
+		{Name: "spike", Parties: 2, Generation: 0},
+		{Name: "spike", Parties: 2, Generation: 1},
+		{Name: "slow", Parties: 3, Generation: 0},
+		{Name: "slow", Parties: 3, Generation: 0, Left: true},
+	}, arrivals)
+	mu.Unlock()
+
+	chDone := make(chan struct{})
+	go func() {
+		defer close(chDone)
+		assert.NotNil(t, b.Wait(context.Background(), "slow", 3))
+	}()
+	time.Sleep(time.Millisecond * 10)
+	b.Close(errors.New("gone"))
+	<-chDone
+	assert.EqualError(t, b.Wait(context.Background(), "spike", 2), "gone")
+}
@@ -23,6 +23,7 @@ type Context struct {
 	releasePool *libpool.ReleasePool
 	asyncPool   *libpool.AsyncPool
 	scopes      []scope
+	stubNetwork bool
 }
 
 func New(L *lua.LState, global *Global, releasePool *libpool.ReleasePool, asyncPool *libpool.AsyncPool, logger *zap.Logger) *Context {
@@ -179,6 +180,16 @@ func (c *Context) Exit() {
 	c.scopes = c.scopes[:len(c.scopes)-1]
 }
 
+// SetStubNetwork makes network modules hand out inert placeholders (connections, empty responses) instead of
+// reaching network
+func (c *Context) SetStubNetwork(stub bool) {
+	c.stubNetwork = stub
+}
+
+func (c *Context) StubNetwork() bool {
+	return c.stubNetwork
+}
+
 func (c *Context) Global() *Global {
 	return c.global
 }
@@ -3,11 +3,17 @@ package context
 import (
 	"sync"
 
+	"go.uber.org/zap"
+
+	libpool "github.com/joesonw/lte/pkg/lua/lib/pool"
 	"github.com/joesonw/lte/pkg/stat"
 )
 
 type Global struct {
 	reporter stat.Reporter
+	barrier  Barrier
+	// releasePool holds resources shared by vms, they live until Close
+	releasePool *libpool.ReleasePool
 
 	uniqueMu  *sync.Mutex
 	uniqueMap map[string]interface{}
@@ -15,12 +21,27 @@ type Global struct {
 
 func NewGlobal(reporter stat.Reporter) *Global {
 	return &Global{
-		reporter:  reporter,
-		uniqueMu:  &sync.Mutex{},
-		uniqueMap: map[string]interface{}{},
+		reporter:    reporter,
+		barrier:     NewLocalBarrier(),
+		releasePool: libpool.NewRelease(zap.NewNop()),
+		uniqueMu:    &sync.Mutex{},
+		uniqueMap:   map[string]interface{}{},
 	}
 }
 
+// WithReporter returns a global sharing unique values with g, stats are reported to reporter
+func (g *Global) WithReporter(reporter stat.Reporter) *Global {
+	return &Global{
+		reporter:    reporter,
+		barrier:     g.barrier,
+		releasePool: g.releasePool,
+		uniqueMu:    g.uniqueMu,
+		uniqueMap:   g.uniqueMap,
+	}
+}
+
+// Unique returns value of name shared by vms, do makes it on first call. Nil is not kept, e.g. when do failed, so do is
+// called again by the next caller
 func (g *Global) Unique(name string, do func() interface{}) interface{} {
 	g.uniqueMu.Lock()
 	defer g.uniqueMu.Unlock()
@@ -28,10 +49,32 @@ func (g *Global) Unique(name string, do func() interface{}) interface{} {
 		return in
 	}
 	in := do()
-	g.uniqueMap[name] = in
+	if in != nil {
+		g.uniqueMap[name] = in
+	}
 	return in
 }
 
+// ReleasePool returns pool of resources living as long as the job rather than an iteration, e.g. connections shared by
+// vms
+func (g *Global) ReleasePool() *libpool.ReleasePool {
+	return g.releasePool
+}
+
+// Close releases resources of ReleasePool, it is called once vms sharing g are stopped
+func (g *Global) Close() {
+	g.releasePool.Clean()
+}
+
+// SetBarrier replaces the barrier shared by vms, e.g. with one spanning agents, it has to be called before WithReporter
+func (g *Global) SetBarrier(barrier Barrier) {
+	g.barrier = barrier
+}
+
+func (g *Global) Barrier() Barrier {
+	return g.barrier
+}
+
 func (g *Global) Report(stats ...*stat.Stat) {
 	g.reporter.Report(stats...)
 }
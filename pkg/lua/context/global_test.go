@@ -2,8 +2,52 @@ package context_test
 
 import (
 	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	luacontext "github.com/joesonw/lte/pkg/lua/context"
+	libpool "github.com/joesonw/lte/pkg/lua/lib/pool"
+	"github.com/joesonw/lte/pkg/stat"
 )
 
 func TestGlobal(t *testing.T) {
 
 }
+
+func TestGlobalUnique(t *testing.T) {
+	global := luacontext.NewGlobal(stat.Noop())
+	scoped := global.WithReporter(stat.Noop())
+
+	calls := 0
+	do := func() interface{} {
+		calls++
+		if calls == 1 {
+			return nil
+		}
+		return calls
+	}
+	assert.Nil(t, global.Unique("a", do))
+	assert.Equal(t, 2, global.Unique("a", do))
+	assert.Equal(t, 2, scoped.Unique("a", do))
+	assert.Equal(t, 2, calls)
+}
+
+func TestGlobalClose(t *testing.T) {
+	global := luacontext.NewGlobal(stat.Noop())
+	scoped := global.WithReporter(stat.Noop())
+
+	released := 0
+	global.ReleasePool().Watch(libpool.NewReleaseFunc("a", func() error {
+		released++
+		return nil
+	}))
+	scoped.ReleasePool().Watch(libpool.NewReleaseFunc("b", func() error {
+		released++
+		return nil
+	}))
+	assert.Equal(t, int64(2), global.ReleasePool().Len())
+
+	global.Close()
+	assert.Equal(t, 2, released)
+	assert.Equal(t, int64(0), scoped.ReleasePool().Len())
+}
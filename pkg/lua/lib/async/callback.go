@@ -2,54 +2,214 @@ package async
 
 import (
 	"context"
+	"sync"
 
 	lua "github.com/yuin/gopher-lua"
 
 	"github.com/joesonw/lte/pkg/lua/lib/pool"
 )
 
+// deferred is the result of an async task, which is awaited by calling the function pushed by Deferred or DeferredResult
+type deferred struct {
+	done chan struct{}
+	err  error
+	lf   lua.LGFunction
+	// withResult pushes nil in place of error on success
+	withResult bool
+	// spawned is set for tasks of coroutines, which are run only by the scheduler
+	spawned bool
+
+	values   []lua.LValue
+	resolved bool
+	awaited  bool
+
+	cancelOnce *sync.Once
+	chCancel   chan struct{}
+	// children are cancelled along with deferred combining them
+	children []*deferred
+}
+
+func newDeferred(withResult bool) *deferred {
+	return &deferred{
+		done:       make(chan struct{}),
+		withResult: withResult,
+		cancelOnce: &sync.Once{},
+		chCancel:   make(chan struct{}),
+	}
+}
+
+// run calls f with a context which is cancelled once the deferred is cancelled, f is skipped if it is cancelled before
+func (d *deferred) run(ctx context.Context, f func(ctx context.Context) (lua.LGFunction, error)) {
+	select {
+	case <-d.chCancel:
+		d.resolve(nil, context.Canceled)
+		return
+	default:
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-d.chCancel:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	d.resolve(f(ctx))
+}
+
+// cancel cancels context of the task and deferreds combined by d, it has no effect on a finished task
+func (d *deferred) cancel() {
+	d.cancelOnce.Do(func() {
+		close(d.chCancel)
+	})
+	for _, child := range d.children {
+		child.cancel()
+	}
+}
+
+func (d *deferred) resolve(lf lua.LGFunction, err error) {
+	d.lf = lf
+	d.err = err
+	close(d.done)
+}
+
+// resolveValues resolves with values of lua, it has to be called on goroutine of the lua state
+func (d *deferred) resolveValues(values []lua.LValue) {
+	d.values = values
+	d.resolved = true
+	close(d.done)
+}
+
+// waitsSpawned returns if d, or a deferred combined by it, is an unfinished spawned task
+func (d *deferred) waitsSpawned() bool {
+	if d.isDone() {
+		return false
+	}
+	if d.spawned {
+		return true
+	}
+	for _, child := range d.children {
+		if child.waitsSpawned() {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *deferred) isDone() bool {
+	select {
+	case <-d.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// results returns values returned to lua, they are built only once so a deferred can be awaited more than once
+func (d *deferred) results(L *lua.LState) []lua.LValue {
+	if d.resolved {
+		return d.values
+	}
+
+	top := L.GetTop()
+	if d.err != nil {
+		L.Push(lua.LString(d.err.Error()))
+	} else if d.withResult {
+		L.Push(lua.LNil)
+	}
+	if d.lf != nil {
+		d.lf(L)
+	}
+	for i := top + 1; i <= L.GetTop(); i++ {
+		d.values = append(d.values, L.Get(i))
+	}
+	L.SetTop(top)
+	d.resolved = true
+	return d.values
+}
+
+// await parks current coroutine if it is run by a Scheduler, otherwise it blocks until the deferred is done
+func (d *deferred) await(L *lua.LState) int {
+	d.awaited = true
+	if !d.isDone() {
+		if s := schedulerOf(L); s != nil && s.yieldable(L) {
+			ud := L.NewUserData()
+			ud.Value = d
+			s.yielded = ud
+			return L.Yield(ud)
+		}
+		// blocking here would block the scheduler as well, which is the only one to run spawned tasks
+		if d.waitsSpawned() {
+			L.RaiseError("cannot await a spawned task from a non-yieldable context, e.g. within pcall")
+		}
+		if ctx := L.Context(); ctx != nil {
+			select {
+			case <-d.done:
+			case <-ctx.Done():
+				L.RaiseError(ctx.Err().Error())
+			}
+		} else {
+			<-d.done
+		}
+	}
+
+	values := d.results(L)
+	for _, v := range values {
+		L.Push(v)
+	}
+	return len(values)
+}
+
+func (d *deferred) push(L *lua.LState) int {
+	ud := L.NewUserData()
+	ud.Value = d
+	L.Push(L.NewClosure(func(L *lua.LState) int {
+		return d.await(L)
+	}, ud))
+	return 1
+}
+
 func Deferred(L *lua.LState, asyncPool *pool.AsyncPool, f func(ctx context.Context) error) int {
-	ch := make(chan error)
+	d := newDeferred(false)
 	asyncPool.Add(pool.AsyncTaskFunc(func(ctx context.Context) error {
-		ch <- f(ctx)
+		d.run(ctx, func(ctx context.Context) (lua.LGFunction, error) {
+			return nil, f(ctx)
+		})
 		return nil
 	}))
-
-	L.Push(L.NewFunction(func(L *lua.LState) int {
-		err := <-ch
-		if err != nil {
-			L.Push(lua.LString(err.Error()))
-			return 1
-		}
-		return 0
-	}))
-	return 1
+	return d.push(L)
 }
 
 func DeferredResult(L *lua.LState, asyncPool *pool.AsyncPool, f func(ctx context.Context) (lua.LGFunction, error)) int {
-	ch := make(chan struct{})
-	var lf lua.LGFunction
-	var err error
+	d := newDeferred(true)
 	asyncPool.Add(pool.AsyncTaskFunc(func(ctx context.Context) error {
-		lf, err = f(ctx)
-		ch <- struct{}{}
+		d.run(ctx, f)
 		return nil
 	}))
+	return d.push(L)
+}
 
-	L.Push(L.NewFunction(func(L *lua.LState) int {
-		<-ch
-		if err != nil {
-			L.Push(lua.LString(err.Error()))
-		} else {
-			L.Push(lua.LNil)
-		}
-
-		if lf == nil {
-			return 1
-		}
+// DeferredWait is Deferred for tasks waiting for other vms rather than doing io, f runs outside workers of asyncPool and
+// is bounded only by its own timeout, see AsyncPool.Go
+func DeferredWait(L *lua.LState, asyncPool *pool.AsyncPool, f func(ctx context.Context) error) int {
+	d := newDeferred(false)
+	asyncPool.Go(pool.AsyncTaskFunc(func(ctx context.Context) error {
+		d.run(ctx, func(ctx context.Context) (lua.LGFunction, error) {
+			return nil, f(ctx)
+		})
+		return nil
+	}))
+	return d.push(L)
+}
 
-		n := lf(L)
-		return n + 1
+// DeferredResultWait is DeferredResult for tasks waiting for other vms, see DeferredWait
+func DeferredResultWait(L *lua.LState, asyncPool *pool.AsyncPool, f func(ctx context.Context) (lua.LGFunction, error)) int {
+	d := newDeferred(true)
+	asyncPool.Go(pool.AsyncTaskFunc(func(ctx context.Context) error {
+		d.run(ctx, f)
+		return nil
 	}))
-	return 1
+	return d.push(L)
 }
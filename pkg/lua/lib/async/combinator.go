@@ -0,0 +1,229 @@
+package async
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+
+	luacontext "github.com/joesonw/lte/pkg/lua/context"
+)
+
+const moduleName = "async"
+
+var errTimeout = errors.New("timeout")
+
+// Open registers module `async`, its functions combine deferreds into a new deferred, e.g.
+//
+//	local err, results = async:all({ http:get(a), http:get(b) })()
+//	local err, index, res = async:race({ http:get(a), http:get(b) })()
+//	local err, index, res = async:any({ http:get(a), http:get(b) })()
+//	local err, res = async:timeout(http:get(a), 100)()
+//
+// Deferreds left unconsumed by race, any and timeout are cancelled.
+func Open(L *lua.LState, luaCtx *luacontext.Context) {
+	mod := L.RegisterModule(moduleName, map[string]lua.LGFunction{}).(*lua.LTable)
+	mod.RawSetString("all", L.NewClosure(lAll, mod))
+	mod.RawSetString("race", L.NewClosure(lRace, mod))
+	mod.RawSetString("any", L.NewClosure(lAny, mod))
+	mod.RawSetString("timeout", L.NewClosure(lTimeout, mod))
+}
+
+// argBase returns index of first argument, functions can be called as both async.all(...) and async:all(...)
+func argBase(L *lua.LState) int {
+	if L.Get(1) == L.Get(lua.UpvalueIndex(1)) {
+		return 2
+	}
+	return 1
+}
+
+func checkDeferred(L *lua.LState, n int) *deferred {
+	fn := L.CheckFunction(n)
+	if d := deferredOf(fn); d != nil {
+		return d
+	}
+	L.ArgError(n, "deferred expected")
+	return nil
+}
+
+func deferredOf(fn *lua.LFunction) *deferred {
+	if !fn.IsG || len(fn.Upvalues) == 0 {
+		return nil
+	}
+	ud, ok := fn.Upvalues[0].Value().(*lua.LUserData)
+	if !ok {
+		return nil
+	}
+	d, _ := ud.Value.(*deferred)
+	return d
+}
+
+// IsDeferred returns if v is a function returned by an async function, which is awaited by calling it
+func IsDeferred(v lua.LValue) bool {
+	fn, ok := v.(*lua.LFunction)
+	return ok && deferredOf(fn) != nil
+}
+
+func checkDeferredList(L *lua.LState, n int) []*deferred {
+	tb := L.CheckTable(n)
+	var list []*deferred
+	for i := 1; i <= tb.Len(); i++ {
+		fn, ok := tb.RawGetInt(i).(*lua.LFunction)
+		if !ok {
+			L.ArgError(n, "list of deferreds expected")
+		}
+		d := deferredOf(fn)
+		if d == nil {
+			L.ArgError(n, "list of deferreds expected")
+		}
+		d.awaited = true
+		list = append(list, d)
+	}
+	return list
+}
+
+// split returns error and remaining values of a finished deferred
+func (d *deferred) split(L *lua.LState) (lua.LValue, []lua.LValue) {
+	values := d.results(L)
+	if d.withResult {
+		if len(values) == 0 {
+			return lua.LNil, nil
+		}
+		return values[0], values[1:]
+	}
+	if d.err != nil {
+		return values[0], nil
+	}
+	return lua.LNil, nil
+}
+
+// combine pushes a deferred resolved by wait, which runs on its own goroutine
+func combine(L *lua.LState, children []*deferred, wait func() (lua.LGFunction, error)) int {
+	d := newDeferred(true)
+	d.children = children
+	go func() {
+		d.resolve(wait())
+	}()
+	return d.push(L)
+}
+
+// first returns index of the first deferred finished, and a channel of indices of the rest
+func first(list []*deferred) (int, <-chan int) {
+	ch := make(chan int, len(list))
+	for i := range list {
+		go func(i int) {
+			<-list[i].done
+			ch <- i
+		}(i)
+	}
+	return <-ch, ch
+}
+
+func cancelExcept(list []*deferred, index int) {
+	for i, d := range list {
+		if i != index {
+			d.cancel()
+		}
+	}
+}
+
+// lAll waits all deferreds, results[i] is {err, values...} of the i-th deferred, err is the first error in order of list
+func lAll(L *lua.LState) int {
+	list := checkDeferredList(L, argBase(L))
+	return combine(L, list, func() (lua.LGFunction, error) {
+		var err error
+		for _, d := range list {
+			<-d.done
+			if err == nil && d.err != nil {
+				err = d.err
+			}
+		}
+		return func(L *lua.LState) int {
+			results := L.NewTable()
+			for i, d := range list {
+				e, values := d.split(L)
+				result := L.NewTable()
+				result.RawSetInt(1, e)
+				for j, v := range values {
+					result.RawSetInt(j+2, v)
+				}
+				results.RawSetInt(i+1, result)
+			}
+			L.Push(results)
+			return 1
+		}, err
+	})
+}
+
+// lRace resolves as the first finished deferred with its index, errors included
+func lRace(L *lua.LState) int {
+	list := checkDeferredList(L, argBase(L))
+	if len(list) == 0 {
+		L.ArgError(argBase(L), "at least one deferred expected")
+	}
+	return combine(L, list, func() (lua.LGFunction, error) {
+		index, _ := first(list)
+		cancelExcept(list, index)
+		return pushIndexed(list, index), list[index].err
+	})
+}
+
+// lAny resolves as the first successful deferred with its index, it fails only if all deferreds fail
+func lAny(L *lua.LState) int {
+	list := checkDeferredList(L, argBase(L))
+	if len(list) == 0 {
+		L.ArgError(argBase(L), "at least one deferred expected")
+	}
+	return combine(L, list, func() (lua.LGFunction, error) {
+		index, rest := first(list)
+		var messages []string
+		for n := 1; ; n++ {
+			if list[index].err == nil {
+				cancelExcept(list, index)
+				return pushIndexed(list, index), nil
+			}
+			messages = append(messages, list[index].err.Error())
+			if n == len(list) {
+				return nil, errors.New("all failed: " + strings.Join(messages, "; "))
+			}
+			index = <-rest
+		}
+	})
+}
+
+// lTimeout resolves as the deferred, or fails with "timeout" and cancels the deferred if it is not finished in ms
+func lTimeout(L *lua.LState) int {
+	base := argBase(L)
+	d := checkDeferred(L, base)
+	d.awaited = true
+	timeout := time.Duration(L.CheckInt64(base+1)) * time.Millisecond
+	return combine(L, []*deferred{d}, func() (lua.LGFunction, error) {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case <-d.done:
+		case <-timer.C:
+			d.cancel()
+			return nil, errTimeout
+		}
+		return func(L *lua.LState) int {
+			_, values := d.split(L)
+			for _, v := range values {
+				L.Push(v)
+			}
+			return len(values)
+		}, d.err
+	})
+}
+
+func pushIndexed(list []*deferred, index int) lua.LGFunction {
+	return func(L *lua.LState) int {
+		_, values := list[index].split(L)
+		L.Push(lua.LNumber(index + 1))
+		for _, v := range values {
+			L.Push(v)
+		}
+		return len(values) + 1
+	}
+}
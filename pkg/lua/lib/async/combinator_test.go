@@ -0,0 +1,99 @@
+package async_test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	lua "github.com/yuin/gopher-lua"
+
+	luacontext "github.com/joesonw/lte/pkg/lua/context"
+	libasync "github.com/joesonw/lte/pkg/lua/lib/async"
+	test_util "github.com/joesonw/lte/pkg/lua/test-util"
+)
+
+func TestCombinators(t *testing.T) {
+	var cancelled int64
+	before := func(t *testing.T, L *lua.LState, luaCtx *luacontext.Context) {
+		libasync.Open(L, luaCtx)
+		// d(ms, value, fail) resolves to value after ms, or fails with value
+		L.SetGlobal("d", L.NewFunction(func(L *lua.LState) int {
+			dur := time.Duration(L.CheckInt64(1)) * time.Millisecond
+			value := L.CheckString(2)
+			fail := L.OptBool(3, false)
+			return libasync.DeferredResult(L, luaCtx.AsyncPool(), func(ctx context.Context) (lua.LGFunction, error) {
+				select {
+				case <-time.After(dur):
+				case <-ctx.Done():
+					atomic.AddInt64(&cancelled, 1)
+					return nil, ctx.Err()
+				}
+				if fail {
+					return nil, errors.New(value)
+				}
+				return func(L *lua.LState) int {
+					L.Push(lua.LString(value))
+					return 1
+				}, nil
+			})
+		}))
+	}
+
+	test_util.Run(t,
+		func(t *testing.T) *test_util.Test {
+			return test_util.New("all", `
+				local async = require "async"
+				local err, results = async.all({ d(50, "a"), d(10, "b") })()
+				assert(err == nil)
+				assert(results[1][1] == nil and results[1][2] == "a")
+				assert(results[2][2] == "b")
+
+				err, results = async:all({ d(10, "a"), d(20, "failed", true) })()
+				assert(err == "failed", err)
+				assert(results[1][2] == "a")
+				assert(results[2][1] == "failed")
+			`).Before(before)
+		},
+		func(t *testing.T) *test_util.Test {
+			return test_util.New("race", `
+				local async = require "async"
+				local err, index, value = async:race({ d(1000, "slow"), d(10, "fast") })()
+				assert(err == nil and index == 2 and value == "fast")
+
+				err, index = async:race({ d(1000, "slow"), d(10, "failed", true) })()
+				assert(err == "failed" and index == 2)
+			`).Before(before)
+		},
+		func(t *testing.T) *test_util.Test {
+			return test_util.New("any", `
+				local async = require "async"
+				local err, index, value = async:any({ d(10, "failed", true), d(50, "ok"), d(1000, "slow") })()
+				assert(err == nil and index == 2 and value == "ok")
+
+				err = async:any({ d(10, "a", true), d(20, "b", true) })()
+				assert(err == "all failed: a; b", err)
+			`).Before(before)
+		},
+		func(t *testing.T) *test_util.Test {
+			return test_util.New("timeout", `
+				local async = require "async"
+				local err, value = async:timeout(d(10, "ok"), 500)()
+				assert(err == nil and value == "ok")
+
+				err = async:timeout(d(1000, "slow"), 10)()
+				assert(err == "timeout")
+
+				err, results = async:all({ async:timeout(d(1000, "slow"), 10), d(10, "ok") })()
+				assert(err == "timeout" and results[2][2] == "ok")
+			`).Before(before)
+		},
+	)
+
+	// losers of race and any, and timed out deferreds are cancelled
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt64(&cancelled) == 5
+	}, time.Second, time.Millisecond*10)
+}
@@ -0,0 +1,254 @@
+package async
+
+import (
+	lua "github.com/yuin/gopher-lua"
+)
+
+const schedulerRegistryKey = "__async_scheduler"
+
+type coroutine struct {
+	thread  *lua.LState
+	fn      *lua.LFunction
+	args    []lua.LValue
+	waiting *deferred
+	// returning is set if the coroutine awaits waiting in a tail call of its function, which has returned then, so it
+	// finishes with results of waiting rather than being resumed
+	returning bool
+	// task is resolved once coroutine is finished, it is awaited through function returned by spawn
+	task *deferred
+}
+
+// Scheduler runs lua functions as coroutines of a state. A coroutine awaiting an unfinished deferred is parked
+// and resumed when the async task is done, so coroutines started by `spawn` make progress concurrently.
+// Deferreds awaited outside of a coroutine of the scheduler, or from within a go function (e.g. pcall), still block,
+// except spawned tasks which would never finish then, awaiting them there raises an error instead.
+type Scheduler struct {
+	L       *lua.LState
+	ready   []*coroutine
+	current *lua.LState
+	// yielded is the value yielded by the latest await, it tells a tail call await apart from the coroutine returning
+	yielded lua.LValue
+	pending int
+	failed  []*coroutine
+	// chWake and chAbort are made by each Run, so coroutines left by an aborted run never wake up a later one
+	chWake  chan *coroutine
+	chAbort chan struct{}
+}
+
+// NewScheduler binds a scheduler to L, and registers global function `spawn`
+func NewScheduler(L *lua.LState) *Scheduler {
+	s := &Scheduler{
+		L: L,
+	}
+	ud := L.NewUserData()
+	ud.Value = s
+	L.G.Registry.RawSetString(schedulerRegistryKey, ud)
+	L.SetGlobal("spawn", L.NewFunction(s.lSpawn))
+	return s
+}
+
+func schedulerOf(L *lua.LState) *Scheduler {
+	ud, ok := L.G.Registry.RawGetString(schedulerRegistryKey).(*lua.LUserData)
+	if !ok {
+		return nil
+	}
+	s, _ := ud.Value.(*Scheduler)
+	return s
+}
+
+// yieldable returns if L is the running coroutine and no go function is in between, gopher-lua can not yield across them
+func (s *Scheduler) yieldable(L *lua.LState) bool {
+	if L != s.current {
+		return false
+	}
+	for level := 1; ; level++ {
+		dbg, ok := L.GetStack(level)
+		if !ok {
+			return true
+		}
+		if _, err := L.GetInfo("S", dbg, lua.LNil); err != nil || dbg.What == "G" {
+			return false
+		}
+	}
+}
+
+// Run calls fn in a coroutine and blocks until it and all coroutines spawned meanwhile are finished.
+// Error of fn is returned, otherwise the first error of spawned coroutines whose result is never awaited.
+// If the state has a context, coroutines share it and the run is aborted with error of the context once it is done.
+func (s *Scheduler) Run(fn *lua.LFunction, args ...lua.LValue) error {
+	_, err := s.Call(fn, args...)
+	return err
+}
+
+// Call runs fn like Run, values returned by fn are returned as well
+func (s *Scheduler) Call(fn *lua.LFunction, args ...lua.LValue) ([]lua.LValue, error) {
+	s.chWake = make(chan *coroutine)
+	s.chAbort = make(chan struct{})
+	var chDone <-chan struct{}
+	if ctx := s.L.Context(); ctx != nil {
+		chDone = ctx.Done()
+	}
+
+	main := s.add(fn, args)
+	for s.pending > 0 {
+		if len(s.ready) == 0 {
+			select {
+			case co := <-s.chWake:
+				values, err := s.results(co.waiting)
+				co.waiting = nil
+				if err != nil {
+					// the coroutine fails as if the error was raised where it awaits
+					s.fail(co, err)
+					continue
+				}
+				if co.returning {
+					co.task.resolveValues(append([]lua.LValue{lua.LNil}, values...))
+					s.pending--
+					continue
+				}
+				if len(values) == 0 {
+					// gopher-lua leaves results of a yield unset rather than nil when resumed without values
+					values = []lua.LValue{lua.LNil}
+				}
+				co.args = values
+				s.ready = append(s.ready, co)
+			case <-chDone:
+				s.abort()
+				return nil, s.L.Context().Err()
+			}
+		}
+		co := s.ready[0]
+		s.ready = s.ready[1:]
+		s.resume(co)
+	}
+
+	failed := s.failed
+	s.failed = nil
+	if main.task.err != nil {
+		return nil, main.task.err
+	}
+	for _, co := range failed {
+		if !co.task.awaited {
+			return nil, co.task.err
+		}
+	}
+	// values of a finished task are led by nil in place of error
+	return main.task.values[1:], nil
+}
+
+// results builds values of d protected, results of a deferred may raise an error, e.g. when decoding a response
+func (s *Scheduler) results(d *deferred) (values []lua.LValue, err error) {
+	s.L.Push(s.L.NewFunction(func(L *lua.LState) int {
+		values = d.results(L)
+		return 0
+	}))
+	err = s.L.PCall(0, 0, nil)
+	return values, err
+}
+
+// abort drops coroutines of current run, parked ones are never resumed
+func (s *Scheduler) abort() {
+	close(s.chAbort)
+	s.ready = nil
+	s.failed = nil
+	s.pending = 0
+}
+
+func (s *Scheduler) add(fn *lua.LFunction, args []lua.LValue) *coroutine {
+	thread, cancel := s.L.NewThread()
+	if ctx := s.L.Context(); ctx != nil {
+		// threads check the very context instead of a child of it, which keeps counting of sandbox in one place
+		cancel()
+		thread.SetContext(ctx)
+	}
+	co := &coroutine{
+		thread: thread,
+		fn:     fn,
+		args:   args,
+		task:   newDeferred(true),
+	}
+	co.task.spawned = true
+	s.ready = append(s.ready, co)
+	s.pending++
+	return co
+}
+
+func (s *Scheduler) resume(co *coroutine) {
+	args := co.args
+	co.args = nil
+	s.current = co.thread
+	s.yielded = nil
+	state, err, values := s.L.Resume(co.thread, co.fn, args...)
+	s.current = nil
+
+	switch state {
+	case lua.ResumeYield:
+		if d := s.awaited(values); d != nil {
+			s.park(co, d)
+			return
+		}
+		// plain coroutine.yield() gives way to other coroutines
+		s.ready = append(s.ready, co)
+		return
+	case lua.ResumeError:
+		s.fail(co, err)
+		return
+	default:
+		// awaiting in a tail call, e.g. `return d()`, yields after gopher-lua dropped the frame of the function, which
+		// looks like the coroutine returned the yielded value
+		if d := s.awaited(values); d != nil {
+			co.returning = true
+			s.park(co, d)
+			return
+		}
+		co.task.resolveValues(append([]lua.LValue{lua.LNil}, values...))
+	}
+	s.pending--
+}
+
+// awaited returns deferred of values yielded by await, nil if they are not
+func (s *Scheduler) awaited(values []lua.LValue) *deferred {
+	if len(values) != 1 || values[0] != s.yielded {
+		return nil
+	}
+	ud, ok := values[0].(*lua.LUserData)
+	if !ok {
+		return nil
+	}
+	d, _ := ud.Value.(*deferred)
+	return d
+}
+
+// park wakes co up once d is done
+func (s *Scheduler) park(co *coroutine, d *deferred) {
+	co.waiting = d
+	chWake, chAbort := s.chWake, s.chAbort
+	go func() {
+		<-d.done
+		select {
+		case chWake <- co:
+		case <-chAbort:
+		}
+	}()
+}
+
+// fail finishes co with err
+func (s *Scheduler) fail(co *coroutine, err error) {
+	co.task.err = err
+	co.task.resolveValues([]lua.LValue{lua.LString(err.Error())})
+	s.failed = append(s.failed, co)
+	s.pending--
+}
+
+// lSpawn runs a function in a new coroutine, it returns a deferred of (err, results...) of the function
+func (s *Scheduler) lSpawn(L *lua.LState) int {
+	fn := L.CheckFunction(1)
+	if s.current == nil {
+		L.RaiseError("spawn can only be called while running")
+	}
+	var args []lua.LValue
+	for i := 2; i <= L.GetTop(); i++ {
+		args = append(args, L.Get(i))
+	}
+	return s.add(fn, args).task.push(L)
+}
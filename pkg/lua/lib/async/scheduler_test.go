@@ -0,0 +1,163 @@
+package async_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	lua "github.com/yuin/gopher-lua"
+	"go.uber.org/zap"
+
+	libasync "github.com/joesonw/lte/pkg/lua/lib/async"
+	libpool "github.com/joesonw/lte/pkg/lua/lib/pool"
+)
+
+func runScheduler(t *testing.T, script string) error {
+	L := lua.NewState()
+	defer L.Close()
+
+	asyncPool := libpool.NewAsync(zap.NewNop(), 16, 0, 64)
+	asyncPool.Start()
+	defer asyncPool.Stop()
+
+	s := libasync.NewScheduler(L)
+	L.SetGlobal("sleep", L.NewFunction(func(L *lua.LState) int {
+		dur := time.Duration(L.CheckInt64(1)) * time.Millisecond
+		return libasync.DeferredResult(L, asyncPool, func(ctx context.Context) (lua.LGFunction, error) {
+			time.Sleep(dur)
+			return func(L *lua.LState) int {
+				L.Push(lua.LNumber(dur.Milliseconds()))
+				return 1
+			}, nil
+		})
+	}))
+	L.SetGlobal("wait", L.NewFunction(func(L *lua.LState) int {
+		return libasync.Deferred(L, asyncPool, func(ctx context.Context) error {
+			time.Sleep(10 * time.Millisecond)
+			return nil
+		})
+	}))
+	L.SetGlobal("broken", L.NewFunction(func(L *lua.LState) int {
+		return libasync.DeferredResult(L, asyncPool, func(ctx context.Context) (lua.LGFunction, error) {
+			time.Sleep(10 * time.Millisecond)
+			return func(L *lua.LState) int {
+				L.RaiseError("broken result")
+				return 0
+			}, nil
+		})
+	}))
+	assert.Nil(t, L.DoString(script))
+	return s.Run(L.GetGlobal("run").(*lua.LFunction))
+}
+
+func TestSchedulerSpawn(t *testing.T) {
+	start := time.Now()
+	err := runScheduler(t, `
+		function run()
+			local tasks = {}
+			for i = 1, 8 do
+				tasks[i] = spawn(function(n)
+					local _, a = sleep(200)()
+					local _, b = sleep(200)()
+					return a + b + n
+				end, i)
+			end
+			for i = 1, 8 do
+				local err, v = tasks[i]()
+				assert(err == nil)
+				assert(v == 400 + i, tostring(v))
+			end
+		end
+	`)
+	assert.Nil(t, err)
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+}
+
+func TestSchedulerAwaitInPCall(t *testing.T) {
+	err := runScheduler(t, `
+		function run()
+			local ok, err, v = pcall(function() return sleep(10)() end)
+			assert(ok and err == nil and v == 10)
+			local d = sleep(10)
+			local _, a = d()
+			local _, b = d()
+			assert(a == 10 and b == 10)
+		end
+	`)
+	assert.Nil(t, err)
+}
+
+func TestSchedulerSpawnError(t *testing.T) {
+	err := runScheduler(t, `
+		function run()
+			local err = spawn(function() error("awaited") end)()
+			assert(err ~= nil)
+		end
+	`)
+	assert.Nil(t, err)
+
+	err = runScheduler(t, `
+		function run()
+			spawn(function() sleep(10)() error("not awaited") end)
+		end
+	`)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "not awaited")
+}
+
+func TestSchedulerResultError(t *testing.T) {
+	err := runScheduler(t, `
+		function run()
+			local err = spawn(function() broken()() end)()
+			assert(string.find(err, "broken result"), err)
+			broken()()
+		end
+	`)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "broken result")
+}
+
+func TestSchedulerAwaitSpawnedInPCall(t *testing.T) {
+	err := runScheduler(t, `
+		function run()
+			local ok, err = pcall(function()
+				local d = spawn(function() return 1 end)
+				return d()
+			end)
+			assert(not ok and string.find(err, "non%-yieldable"), err)
+		end
+	`)
+	assert.Nil(t, err)
+}
+
+func TestSchedulerAwaitWithoutResult(t *testing.T) {
+	err := runScheduler(t, `
+		function run()
+			local err = wait()()
+			assert(err == nil)
+			err = spawn(function() wait()() end)()
+			assert(err == nil)
+		end
+	`)
+	assert.Nil(t, err)
+}
+
+func TestSchedulerAwaitInTailCall(t *testing.T) {
+	start := time.Now()
+	err := runScheduler(t, `
+		local function nested()
+			return sleep(10)()
+		end
+
+		function run()
+			local err, _, v = spawn(function() return sleep(100)() end)()
+			assert(err == nil and v == 100, tostring(v))
+			local _, a = nested()
+			assert(a == 10, tostring(a))
+			return wait()()
+		end
+	`)
+	assert.Nil(t, err)
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(time.Millisecond*120))
+}
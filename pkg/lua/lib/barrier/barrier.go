@@ -0,0 +1,59 @@
+package barrier
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+
+	luacontext "github.com/joesonw/lte/pkg/lua/context"
+	libasync "github.com/joesonw/lte/pkg/lua/lib/async"
+	luautil "github.com/joesonw/lte/pkg/lua/util"
+	"github.com/joesonw/lte/pkg/stat"
+	goutil "github.com/joesonw/lte/pkg/util"
+)
+
+const moduleName = "barrier"
+
+var errTimeout = errors.New("timeout")
+
+// Open registers module `barrier`, waiters of a name are released together once n of them arrived, e.g.
+//
+//	local err = barrier:wait("spike", 500, 10000)() -- err is "timeout" if 500 vus do not arrive in 10s
+//
+// Time each waiter spent is reported as stat barrier.
+func Open(L *lua.LState, luaCtx *luacontext.Context) {
+	ud := L.NewUserData()
+	ud.Value = luaCtx
+	mod := L.RegisterModule(moduleName, map[string]lua.LGFunction{}).(*lua.LTable)
+	mod.RawSetString("wait", L.NewClosure(lWait, ud))
+}
+
+// lWait returns a deferred released once n waiters arrived, timeout is in milliseconds, 0 for no timeout. Waiters do
+// not take workers of the async pool, nor are they bounded by its timeout
+func lWait(L *lua.LState) int {
+	luaCtx := L.CheckUserData(lua.UpvalueIndex(1)).Value.(*luacontext.Context)
+	name := L.CheckString(2)
+	parties := L.CheckInt(3)
+	timeout := time.Duration(L.OptInt64(4, 0)) * time.Millisecond
+	return libasync.DeferredWait(L, luaCtx.AsyncPool(), func(ctx context.Context) error {
+		ctx, cancel := goutil.OptionalTimeoutContext(ctx, timeout)
+		defer cancel()
+
+		s := stat.New("barrier").Tag("name", name)
+		start := time.Now()
+		err := luaCtx.Global().Barrier().Wait(ctx, name, parties)
+		s.Int64Field("wait_ns", time.Since(start).Nanoseconds())
+		if err == context.DeadlineExceeded {
+			err = errTimeout
+		}
+		if err != nil {
+			luautil.FailStat(ctx, s, err)
+		} else {
+			s.IntField("success", 1)
+		}
+		luautil.ReportContextStat(luaCtx, s)
+		return err
+	})
+}
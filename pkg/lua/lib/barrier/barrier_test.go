@@ -0,0 +1,33 @@
+package barrier_test
+
+import (
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+
+	luacontext "github.com/joesonw/lte/pkg/lua/context"
+	libbarrier "github.com/joesonw/lte/pkg/lua/lib/barrier"
+	test_util "github.com/joesonw/lte/pkg/lua/test-util"
+)
+
+func Test(t *testing.T) {
+	test_util.Run(t, func(t *testing.T) *test_util.Test {
+		return test_util.New("wait", `
+			local barrier = require "barrier"
+			local a, b = barrier:wait("spike", 2, 1000), barrier:wait("spike", 2, 1000)
+			assert(a() == nil)
+			assert(b() == nil)
+			assert(barrier:wait("alone", 2, 10)() == "timeout")
+			-- waiters do not hold workers of the async pool, there are fewer of them
+			local waiters = {}
+			for i = 1, 6 do
+				waiters[i] = barrier:wait("crowd", 6)
+			end
+			for i = 1, 6 do
+				assert(waiters[i]() == nil)
+			end
+		`).Before(func(t *testing.T, L *lua.LState, luaCtx *luacontext.Context) {
+			libbarrier.Open(L, luaCtx)
+		})
+	})
+}
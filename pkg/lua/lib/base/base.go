@@ -18,7 +18,8 @@ type baseContext struct {
 	fs     afero.Fs
 }
 
-func Open(L *lua.LState, luaCtx *luacontext.Context, fs afero.Fs) {
+// Open registers global functions, and makes require load modules from fs searching modulePath, DefaultModulePath if empty
+func Open(L *lua.LState, luaCtx *luacontext.Context, fs afero.Fs, modulePath string) {
 	ud := L.NewUserData()
 	ud.Value = &baseContext{
 		luaCtx: luaCtx,
@@ -27,6 +28,7 @@ func Open(L *lua.LState, luaCtx *luacontext.Context, fs afero.Fs) {
 	for k, f := range funcs {
 		L.SetGlobal(k, L.NewClosure(f, ud))
 	}
+	openLoader(L, ud, modulePath)
 }
 
 func upContext(L *lua.LState) *baseContext {
@@ -105,12 +107,11 @@ func lImport(L *lua.LState) int {
 	ctx := upContext(L)
 	name := L.CheckString(1)
 	L.Pop(L.GetTop())
-	b, err := afero.ReadFile(ctx.fs, name)
+	proto, err := ctx.compile(name)
 	if err != nil {
 		L.RaiseError(err.Error())
 	}
-	if err := L.DoString(string(b)); err != nil {
-		L.RaiseError(err.Error())
-	}
+	L.Push(L.NewFunctionFromProto(proto))
+	L.Call(0, lua.MultRet)
 	return L.GetTop()
 }
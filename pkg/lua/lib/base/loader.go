@@ -0,0 +1,80 @@
+package base
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/spf13/afero"
+	lua "github.com/yuin/gopher-lua"
+	luaparse "github.com/yuin/gopher-lua/parse"
+)
+
+// DefaultModulePath is package.path searched by require in bundle filesystem
+const DefaultModulePath = "?.lua;?/init.lua"
+
+type compiled struct {
+	proto *lua.FunctionProto
+	err   error
+}
+
+// compile compiles a file of fs once per job, source name of chunk is the file name so errors carry it
+func (c *baseContext) compile(name string) (*lua.FunctionProto, error) {
+	result := c.luaCtx.Global().Unique("lib/base:"+name, func() interface{} {
+		b, err := afero.ReadFile(c.fs, name)
+		if err != nil {
+			return &compiled{err: err}
+		}
+		chunk, err := luaparse.Parse(bytes.NewReader(b), name)
+		if err != nil {
+			return &compiled{err: err}
+		}
+		proto, err := lua.Compile(chunk, name)
+		return &compiled{proto: proto, err: err}
+	}).(*compiled)
+	return result.proto, result.err
+}
+
+// openLoader replaces the loader of package.loaders reading host filesystem with one reading fs,
+// `require "lib.auth"` loads lib/auth.lua or lib/auth/init.lua by default, loaded modules are cached per vm by require
+func openLoader(L *lua.LState, ud *lua.LUserData, modulePath string) {
+	pkg, ok := L.GetGlobal("package").(*lua.LTable)
+	if !ok {
+		return
+	}
+	loaders, ok := pkg.RawGetString("loaders").(*lua.LTable)
+	if !ok {
+		return
+	}
+	if modulePath == "" {
+		modulePath = DefaultModulePath
+	}
+	pkg.RawSetString("path", lua.LString(modulePath))
+	loaders.RawSetInt(2, L.NewClosure(lLoader, ud))
+}
+
+func lLoader(L *lua.LState) int {
+	ctx := upContext(L)
+	name := L.CheckString(1)
+	path, ok := L.GetField(L.GetGlobal("package"), "path").(lua.LString)
+	if !ok {
+		L.RaiseError("package.path must be a string")
+	}
+
+	var messages []string
+	for _, pattern := range strings.Split(string(path), ";") {
+		file := strings.Replace(pattern, "?", strings.Replace(name, ".", "/", -1), -1)
+		if ok, _ := afero.Exists(ctx.fs, file); !ok {
+			messages = append(messages, fmt.Sprintf("\n\tno file '%s'", file))
+			continue
+		}
+		proto, err := ctx.compile(file)
+		if err != nil {
+			L.RaiseError("error loading module '%s' from file '%s':\n\t%s", name, file, err.Error())
+		}
+		L.Push(L.NewFunctionFromProto(proto))
+		return 1
+	}
+	L.Push(lua.LString(strings.Join(messages, "")))
+	return 1
+}
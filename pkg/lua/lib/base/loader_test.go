@@ -0,0 +1,61 @@
+package base_test
+
+import (
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	lua "github.com/yuin/gopher-lua"
+	"go.uber.org/zap"
+
+	luacontext "github.com/joesonw/lte/pkg/lua/context"
+	libbase "github.com/joesonw/lte/pkg/lua/lib/base"
+	libpool "github.com/joesonw/lte/pkg/lua/lib/pool"
+	"github.com/joesonw/lte/pkg/stat"
+)
+
+func newState(t *testing.T, global *luacontext.Global, fs afero.Fs) *lua.LState {
+	L := lua.NewState()
+	t.Cleanup(L.Close)
+	luaCtx := luacontext.New(L, global, libpool.NewRelease(zap.NewNop()), libpool.NewAsync(zap.NewNop(), 1, 0, 1), zap.NewNop())
+	libbase.Open(L, luaCtx, fs, "")
+	return L
+}
+
+func TestRequire(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	assert.Nil(t, afero.WriteFile(fs, "lib/auth.lua", []byte(`
+		loaded = (loaded or 0) + 1
+		return { token = function() return "abc" end }
+	`), 0600))
+	assert.Nil(t, afero.WriteFile(fs, "lib/util/init.lua", []byte(`return { name = "util" }`), 0600))
+	assert.Nil(t, afero.WriteFile(fs, "lib/broken.lua", []byte("local a = \n\n error('broken')"), 0600))
+	assert.Nil(t, afero.WriteFile(fs, "lib/syntax.lua", []byte("local = 1"), 0600))
+
+	global := luacontext.NewGlobal(stat.Noop())
+	L := newState(t, global, fs)
+	assert.Nil(t, L.DoString(`
+		local auth = require "lib.auth"
+		assert(auth.token() == "abc")
+		assert(require("lib.auth") == auth)
+		assert(loaded == 1)
+		assert(require("lib.util").name == "util")
+		assert(import("lib/auth.lua").token() == "abc")
+		assert(loaded == 2)
+	`))
+
+	err := L.DoString(`require "lib.missing"`)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "no file 'lib/missing.lua'")
+	err = L.DoString(`require "lib.broken"`)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "lib/broken.lua:3")
+	err = L.DoString(`require "lib.syntax"`)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "lib/syntax.lua")
+
+	// compiled once per global, other vms of the job get the same chunk
+	assert.Nil(t, afero.WriteFile(fs, "lib/auth.lua", []byte(`return { token = function() return "changed" end }`), 0600))
+	assert.Nil(t, newState(t, global, fs).DoString(`assert(require("lib.auth").token() == "abc")`))
+	assert.Nil(t, newState(t, luacontext.NewGlobal(stat.Noop()), fs).DoString(`assert(require("lib.auth").token() == "changed")`))
+}
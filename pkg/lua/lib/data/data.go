@@ -0,0 +1,227 @@
+package data
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+	lua "github.com/yuin/gopher-lua"
+
+	luacontext "github.com/joesonw/lte/pkg/lua/context"
+	goclass "github.com/joesonw/lte/pkg/lua/lib/go-class"
+	libjson "github.com/joesonw/lte/pkg/lua/lib/json"
+)
+
+const (
+	moduleName   = "data"
+	feedMetaName = "*DATA*FEED*"
+
+	// PolicySequential hands out rows in order through a cursor shared by all vms, it starts over once exhausted
+	PolicySequential = "sequential"
+	// PolicyUnique gives each vm its own row of a file, it fails if there are fewer rows than vms
+	PolicyUnique = "unique"
+	// PolicyRandom hands out a random row on each call
+	PolicyRandom = "random"
+	// PolicyOnce hands out each row once across all vms, an error of ErrExhausted is raised once exhausted
+	PolicyOnce = "once"
+)
+
+// ErrExhausted is raised by feeds of PolicyOnce without a row left, scenarios stop rather than fail on it
+var ErrExhausted = errors.New("data exhausted")
+
+// IsExhausted returns if err was raised by a feed of PolicyOnce without a row left, errors of lua carry only the
+// message, so it is matched rather than compared
+func IsExhausted(err error) bool {
+	return err != nil && strings.Contains(err.Error(), ErrExhausted.Error())
+}
+
+type dataContext struct {
+	fs     afero.Fs
+	class  *goclass.Class
+	luaCtx *luacontext.Context
+	// uniqueRows holds rows assigned to this vm by PolicyUnique by file, so feeds opened more than once share the row
+	uniqueRows map[string]int
+}
+
+// dataset is loaded once per job and shared read only by all vms
+type dataset struct {
+	rows []interface{}
+	err  error
+}
+
+type feed struct {
+	c      *dataContext
+	name   string
+	policy string
+	rows   []interface{}
+	cursor *int64
+}
+
+// Open registers module `data`, files are read from fs once per job, e.g.
+//
+//	local users = data:open("users.csv", { policy = "unique" })
+//	local user = users:next()
+//
+// CSV files need a header line, rows are tables keyed by header. JSON files have to be an array.
+func Open(L *lua.LState, luaCtx *luacontext.Context, fs afero.Fs) {
+	ud := L.NewUserData()
+	ud.Value = &dataContext{
+		fs:         fs,
+		class:      goclass.New(L, feedMetaName, feedFuncs),
+		luaCtx:     luaCtx,
+		uniqueRows: map[string]int{},
+	}
+	mod := L.RegisterModule(moduleName, map[string]lua.LGFunction{}).(*lua.LTable)
+	mod.RawSetString("open", L.NewClosure(lOpen, ud))
+}
+
+var feedFuncs = map[string]lua.LGFunction{
+	"next": feedNext,
+	"get":  feedGet,
+	"len":  feedLen,
+}
+
+func lOpen(L *lua.LState) int {
+	c := L.CheckUserData(lua.UpvalueIndex(1)).Value.(*dataContext)
+	// "./users.csv" and "users.csv" are the same file, so they share dataset and cursors
+	name := filepath.Clean(L.CheckString(2))
+	policy := PolicySequential
+	if opts, ok := L.Get(3).(*lua.LTable); ok {
+		if v := opts.RawGetString("policy"); v != lua.LNil {
+			policy = v.String()
+		}
+	}
+	switch policy {
+	case PolicySequential, PolicyUnique, PolicyRandom, PolicyOnce:
+	default:
+		L.ArgError(3, "unknown policy \""+policy+"\", expect one of sequential, unique, random and once")
+	}
+
+	global := c.luaCtx.Global()
+	ds := global.Unique("lib/data:"+name, func() interface{} {
+		rows, err := load(c.fs, name)
+		return &dataset{rows: rows, err: err}
+	}).(*dataset)
+	if ds.err != nil {
+		L.RaiseError(ds.err.Error())
+	}
+	// each policy has its own cursor, so feeds of different policies do not interfere
+	cursor := global.Unique("lib/data:"+name+"#"+policy, func() interface{} {
+		return new(int64)
+	}).(*int64)
+
+	L.Push(c.class.New(L, &feed{
+		c:      c,
+		name:   name,
+		policy: policy,
+		rows:   ds.rows,
+		cursor: cursor,
+	}))
+	return 1
+}
+
+func load(fs afero.Fs, name string) ([]interface{}, error) {
+	b, err := afero.ReadFile(fs, name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read %s", name)
+	}
+
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".csv":
+		records, err := csv.NewReader(bytes.NewReader(b)).ReadAll()
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to parse %s", name)
+		}
+		if len(records) == 0 {
+			return nil, nil
+		}
+		header := records[0]
+		rows := make([]interface{}, 0, len(records)-1)
+		for _, record := range records[1:] {
+			row := map[string]interface{}{}
+			for i, value := range record {
+				if i < len(header) {
+					row[header[i]] = value
+				}
+			}
+			rows = append(rows, row)
+		}
+		return rows, nil
+	case ".json":
+		var rows []interface{}
+		if err := json.Unmarshal(b, &rows); err != nil {
+			return nil, errors.Wrapf(err, "unable to parse %s, expect an array", name)
+		}
+		return rows, nil
+	default:
+		return nil, errors.Errorf("unsupported data file %s, expect .csv or .json", name)
+	}
+}
+
+func checkFeed(L *lua.LState) *feed {
+	f, ok := L.CheckUserData(1).Value.(*feed)
+	if !ok {
+		L.ArgError(1, "data feed expected")
+	}
+	return f
+}
+
+// feedNext returns next row under policy of the feed, nil if there is no row at all
+func feedNext(L *lua.LState) int {
+	f := checkFeed(L)
+	n := int64(len(f.rows))
+	if n == 0 {
+		L.Push(lua.LNil)
+		return 1
+	}
+
+	var i int64
+	switch f.policy {
+	case PolicySequential:
+		i = (atomic.AddInt64(f.cursor, 1) - 1) % n
+	case PolicyRandom:
+		i = rand.Int63n(n)
+	case PolicyUnique:
+		row, ok := f.c.uniqueRows[f.name]
+		if !ok {
+			assigned := atomic.AddInt64(f.cursor, 1) - 1
+			if assigned >= n {
+				L.RaiseError("data %s has %d rows, not enough for every vu", f.name, n)
+			}
+			row = int(assigned)
+			f.c.uniqueRows[f.name] = row
+		}
+		i = int64(row)
+	case PolicyOnce:
+		i = atomic.AddInt64(f.cursor, 1) - 1
+		if i >= n {
+			L.RaiseError("%s: %s has %d rows", ErrExhausted.Error(), f.name, n)
+		}
+	}
+	L.Push(libjson.UnmarshalGoValue(L, f.rows[i]))
+	return 1
+}
+
+// feedGet returns row at 1-based index
+func feedGet(L *lua.LState) int {
+	f := checkFeed(L)
+	i := L.CheckInt(2)
+	if i < 1 || i > len(f.rows) {
+		L.Push(lua.LNil)
+		return 1
+	}
+	L.Push(libjson.UnmarshalGoValue(L, f.rows[i-1]))
+	return 1
+}
+
+func feedLen(L *lua.LState) int {
+	f := checkFeed(L)
+	L.Push(lua.LNumber(len(f.rows)))
+	return 1
+}
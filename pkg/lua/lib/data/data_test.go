@@ -0,0 +1,102 @@
+package data_test
+
+import (
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	lua "github.com/yuin/gopher-lua"
+	"go.uber.org/zap"
+
+	luacontext "github.com/joesonw/lte/pkg/lua/context"
+	libdata "github.com/joesonw/lte/pkg/lua/lib/data"
+	libpool "github.com/joesonw/lte/pkg/lua/lib/pool"
+	test_util "github.com/joesonw/lte/pkg/lua/test-util"
+)
+
+func newFs(t *testing.T) afero.Fs {
+	fs := afero.NewMemMapFs()
+	assert.Nil(t, afero.WriteFile(fs, "users.csv", []byte("name,password\nalice,a\nbob,b\n"), 0600))
+	assert.Nil(t, afero.WriteFile(fs, "ids.json", []byte(`[1, 2, {"id": 3}]`), 0600))
+	return fs
+}
+
+// openPeer opens module data in another state sharing global of luaCtx, as another vm of the job
+func openPeer(t *testing.T, luaCtx *luacontext.Context) *lua.LState {
+	L := lua.NewState()
+	asyncPool := libpool.NewAsync(zap.NewNop(), 1, 0, 1)
+	asyncPool.Start()
+	t.Cleanup(func() {
+		asyncPool.Stop()
+		L.Close()
+	})
+	peerCtx := luacontext.New(L, luaCtx.Global(), libpool.NewRelease(zap.NewNop()), asyncPool, zap.NewNop())
+	libdata.Open(L, peerCtx, newFs(t))
+	return L
+}
+
+func Test(t *testing.T) {
+	test_util.Run(t,
+		func(t *testing.T) *test_util.Test {
+			return test_util.New("sequential", `
+				local data = require "data"
+				local users = data:open("users.csv")
+				assert(users:len() == 2)
+				assert(users:next().name == "alice")
+				assert(users:next().password == "b")
+				assert(users:next().name == "alice")
+				assert(users:get(2).name == "bob")
+				assert(users:get(3) == nil)
+			`).Before(func(t *testing.T, L *lua.LState, luaCtx *luacontext.Context) {
+				libdata.Open(L, luaCtx, newFs(t))
+			})
+		},
+		func(t *testing.T) *test_util.Test {
+			return test_util.New("json", `
+				local data = require "data"
+				local ids = data:open("ids.json", { policy = "once" })
+				assert(ids:next() == 1)
+				assert(ids:next() == 2)
+				assert(ids:next().id == 3)
+				local ok, err = pcall(function() return ids:next() end)
+				assert(not ok and string.find(err, "data exhausted"), err)
+			`).Before(func(t *testing.T, L *lua.LState, luaCtx *luacontext.Context) {
+				libdata.Open(L, luaCtx, newFs(t))
+			})
+		},
+		func(t *testing.T) *test_util.Test {
+			var job *luacontext.Context
+			return test_util.New("unique", `
+				local data = require "data"
+				-- the peer took alice, feeds of the file opened again by this vm keep its row
+				local a, b = data:open("users.csv", { policy = "unique" }), data:open("./users.csv", { policy = "unique" })
+				assert(a:next().name == "bob" and a:next().name == "bob")
+				assert(b:next().name == "bob")
+			`).Before(func(t *testing.T, L *lua.LState, luaCtx *luacontext.Context) {
+				job = luaCtx
+				libdata.Open(L, luaCtx, newFs(t))
+				peer := openPeer(t, luaCtx)
+				assert.Nil(t, peer.DoString(`
+					local users = require("data"):open("users.csv", { policy = "unique" })
+					assert(users:next().name == "alice")
+				`))
+			}).After(func(t *testing.T, L *lua.LState) {
+				// a third vm finds no row left
+				peer := openPeer(t, job)
+				assert.NotNil(t, peer.DoString(`require("data"):open("users.csv", { policy = "unique" }):next()`))
+			})
+		},
+		func(t *testing.T) *test_util.Test {
+			return test_util.New("random", `
+				local data = require "data"
+				local users = data:open("users.csv", { policy = "random" })
+				local name = users:next().name
+				assert(name == "alice" or name == "bob")
+				assert(not pcall(function() data:open("users.csv", { policy = "shuffle" }) end))
+				assert(not pcall(function() data:open("missing.csv") end))
+			`).Before(func(t *testing.T, L *lua.LState, luaCtx *luacontext.Context) {
+				libdata.Open(L, luaCtx, newFs(t))
+			})
+		},
+	)
+}
@@ -13,6 +13,7 @@ import (
 	libpool "github.com/joesonw/lte/pkg/lua/lib/pool"
 	luautil "github.com/joesonw/lte/pkg/lua/util"
 	"github.com/joesonw/lte/pkg/stat"
+	goutil "github.com/joesonw/lte/pkg/util"
 )
 
 type IO interface {
@@ -45,6 +46,7 @@ func Read(L *lua.LState) int {
 	n := L.CheckInt(2)
 	return libasync.DeferredResult(L, reader.GetContext().AsyncPool(), func(ctx context.Context) (lua.LGFunction, error) {
 		b := make([]byte, n)
+		defer goutil.InterruptOnDone(ctx, reader)()
 		_, err := reader.Read(b)
 		if err != nil {
 			return nil, err
@@ -64,6 +66,7 @@ func ReadAll(L *lua.LState) int {
 		L.RaiseError("expected go_io.Reader as UserData for :read_all()")
 	}
 	return libasync.DeferredResult(L, reader.GetContext().AsyncPool(), func(ctx context.Context) (lua.LGFunction, error) {
+		defer goutil.InterruptOnDone(ctx, reader)()
 		b, err := ioutil.ReadAll(reader)
 		if err != nil {
 			return nil, err
@@ -84,6 +87,7 @@ func Write(L *lua.LState) int {
 	}
 	bytes := libbytes.Check(L, 2)
 	return libasync.Deferred(L, writer.GetContext().AsyncPool(), func(ctx context.Context) error {
+		defer goutil.InterruptOnDone(ctx, writer)()
 		_, err := writer.Write(bytes)
 		if err == nil {
 			luautil.ReportContextStat(writer.GetContext(), stat.New("io").Tag("name", writer.GetName()).IntField("write", len(bytes)))
@@ -17,6 +17,7 @@ import (
 	libbytes "github.com/joesonw/lte/pkg/lua/lib/bytes"
 	luautil "github.com/joesonw/lte/pkg/lua/util"
 	"github.com/joesonw/lte/pkg/stat"
+	goutil "github.com/joesonw/lte/pkg/util"
 )
 
 const moduleName = "http"
@@ -65,7 +66,7 @@ func lDo(L *lua.LState) int {
 	}
 
 	return libasync.DeferredResult(L, c.luaCtx.AsyncPool(), func(ctx context.Context) (lua.LGFunction, error) {
-		req, err := http.NewRequest(c.method, url, body)
+		req, err := http.NewRequestWithContext(ctx, c.method, url, body)
 		if err != nil {
 			return nil, err
 		}
@@ -82,9 +83,13 @@ func lDo(L *lua.LState) int {
 		start := time.Now()
 		s := stat.New("http").Tag("url", url)
 		defer luautil.ReportContextStat(c.luaCtx, s)
-		res, err := c.client.Do(req)
+		client := c.client
+		if c.luaCtx.StubNetwork() {
+			client = &http.Client{Transport: goutil.NopTransport{}}
+		}
+		res, err := client.Do(req)
 		if err != nil {
-			s.IntField("success", 0)
+			luautil.FailStat(ctx, s, err)
 			return nil, err
 		}
 		defer res.Body.Close()
@@ -104,7 +109,7 @@ func lDo(L *lua.LState) int {
 
 		b, err = ioutil.ReadAll(res.Body)
 		if err != nil {
-			s.IntField("success", 0)
+			luautil.FailStat(ctx, s, err)
 			return returnResult, err
 		}
 		s.IntField("success", 1).Int64Field("duration_ns", time.Since(start).Nanoseconds())
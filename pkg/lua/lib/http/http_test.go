@@ -2,11 +2,13 @@ package http_test
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	lua "github.com/yuin/gopher-lua"
@@ -139,3 +141,34 @@ func NewTestClient(fn RoundTripFunc) *http.Client {
 		Transport: RoundTripFunc(fn),
 	}
 }
+
+func TestCancel(t *testing.T) {
+	client := &http.Client{
+		Transport: RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			<-req.Context().Done()
+			return nil, req.Context().Err()
+		}),
+	}
+	test_util.Run(t, func(t *testing.T) *test_util.Test {
+		return test_util.New("cancel", `
+			local http = require "http"
+			err = http:get("http://example.com")()
+		`).
+			Before(func(t *testing.T, L *lua.LState, luaCtx *luacontext.Context) {
+				libhttp.Open(L, luaCtx, client)
+				go func() {
+					time.Sleep(time.Millisecond * 50)
+					luaCtx.AsyncPool().Cancel()
+				}()
+			}).
+			After(func(t *testing.T, L *lua.LState) {
+				assert.Contains(t, L.GetGlobal("err").String(), context.Canceled.Error())
+			})
+	})
+}
+
+type RoundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f RoundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
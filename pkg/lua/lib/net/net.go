@@ -11,6 +11,7 @@ import (
 	libasync "github.com/joesonw/lte/pkg/lua/lib/async"
 	goclass "github.com/joesonw/lte/pkg/lua/lib/go-class"
 	libpool "github.com/joesonw/lte/pkg/lua/lib/pool"
+	goutil "github.com/joesonw/lte/pkg/util"
 )
 
 type netContext struct {
@@ -41,9 +42,14 @@ func netOpen(L *lua.LState) int {
 	addr := L.CheckString(2)
 
 	return libasync.DeferredResult(L, c.luaCtx.AsyncPool(), func(ctx context.Context) (lua.LGFunction, error) {
-		conn, err := net.Dial(c.protocol, addr)
-		if err != nil {
-			return nil, err
+		var conn net.Conn = &goutil.NopConn{Network: c.protocol, Addr: addr}
+		if !c.luaCtx.StubNetwork() {
+			dialer := &net.Dialer{}
+			var err error
+			conn, err = dialer.DialContext(ctx, c.protocol, addr)
+			if err != nil {
+				return nil, err
+			}
 		}
 
 		name := fmt.Sprintf("%s(%s)", c.protocol, addr)
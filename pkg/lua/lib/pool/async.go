@@ -21,9 +21,16 @@ func (f AsyncTaskFunc) Do(ctx context.Context) error {
 	return f(ctx)
 }
 
+type queuedTask struct {
+	AsyncTask
+	queuedAt time.Time
+}
+
 type AsyncPool struct {
+	ctx          context.Context
+	cancel       context.CancelFunc
 	mu           *sync.Mutex
-	chTasks      chan AsyncTask
+	chTasks      chan queuedTask
 	chExit       []chan struct{}
 	isRunning    bool
 	concurrency  int
@@ -31,23 +38,41 @@ type AsyncPool struct {
 	logger       *zap.Logger
 	statsTotal   int64
 	statsCurrent int64
-	bufferSize   int
+	statsWaited  int64
+	statsWaitNs  int64
 }
 
 func NewAsync(logger *zap.Logger, concurrency int, timeout time.Duration, bufferSize int) *AsyncPool {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &AsyncPool{
+		ctx:         ctx,
+		cancel:      cancel,
 		mu:          &sync.Mutex{},
-		bufferSize:  bufferSize,
+		chTasks:     make(chan queuedTask, bufferSize),
 		concurrency: concurrency,
 		timeout:     timeout,
 		logger:      logger.With(zap.String("lua-module", "AsyncTaskPool")),
 	}
 }
 
+// Add queues a task, it blocks while queue is full so callers are slowed down to the pace of workers
 func (p *AsyncPool) Add(task AsyncTask) {
 	atomic.AddInt64(&p.statsCurrent, 1)
 	atomic.AddInt64(&p.statsTotal, 1)
-	p.chTasks <- task
+	p.chTasks <- queuedTask{AsyncTask: task, queuedAt: time.Now()}
+}
+
+// Go runs task on its own goroutine rather than a worker and without timeout, it is meant for tasks waiting for other
+// vms (e.g. barriers and blocking queues) which would otherwise hold workers for long. Task is cancelled by Cancel
+func (p *AsyncPool) Go(task AsyncTask) {
+	atomic.AddInt64(&p.statsCurrent, 1)
+	atomic.AddInt64(&p.statsTotal, 1)
+	go func() {
+		defer atomic.AddInt64(&p.statsCurrent, -1)
+		if err := task.Do(p.ctx); err != nil {
+			p.logger.Error("unable to handle async task", zap.Error(err))
+		}
+	}()
 }
 
 func (p *AsyncPool) Start() {
@@ -56,7 +81,6 @@ func (p *AsyncPool) Start() {
 	if p.isRunning {
 		return
 	}
-	p.chTasks = make(chan AsyncTask, p.bufferSize)
 	p.isRunning = true
 	p.chExit = make([]chan struct{}, p.concurrency)
 	for i := 0; i < p.concurrency; i++ {
@@ -66,6 +90,7 @@ func (p *AsyncPool) Start() {
 	}
 }
 
+// Stop stops workers once their current tasks finish, queued tasks are not run unless the pool is started again
 func (p *AsyncPool) Stop() {
 	p.mu.Lock()
 	defer p.mu.Unlock()
@@ -79,6 +104,11 @@ func (p *AsyncPool) Stop() {
 	p.chExit = nil
 }
 
+// Cancel cancels contexts of running and queued tasks, tasks added afterwards are cancelled as well
+func (p *AsyncPool) Cancel() {
+	p.cancel()
+}
+
 func (p *AsyncPool) run(chExit chan struct{}) {
 	for {
 		select {
@@ -90,8 +120,10 @@ func (p *AsyncPool) run(chExit chan struct{}) {
 	}
 }
 
-func (p *AsyncPool) runTask(task AsyncTask) {
-	ctx, cancel := goutil.NewOptionalTimeoutContext(p.timeout)
+func (p *AsyncPool) runTask(task queuedTask) {
+	atomic.AddInt64(&p.statsWaited, 1)
+	atomic.AddInt64(&p.statsWaitNs, time.Since(task.queuedAt).Nanoseconds())
+	ctx, cancel := goutil.OptionalTimeoutContext(p.ctx, p.timeout)
 	defer cancel()
 	defer atomic.AddInt64(&p.statsCurrent, -1)
 
@@ -102,9 +134,20 @@ func (p *AsyncPool) runTask(task AsyncTask) {
 }
 
 func (p *AsyncPool) Total() int64 {
-	return p.statsTotal
+	return atomic.LoadInt64(&p.statsTotal)
 }
 
+// Len returns amount of tasks queued or running
 func (p *AsyncPool) Len() int64 {
-	return p.statsCurrent
+	return atomic.LoadInt64(&p.statsCurrent)
+}
+
+// QueueLen returns amount of tasks waiting for a worker
+func (p *AsyncPool) QueueLen() int {
+	return len(p.chTasks)
+}
+
+// Waited returns amount of tasks picked up by workers and total time they spent in queue
+func (p *AsyncPool) Waited() (int64, time.Duration) {
+	return atomic.LoadInt64(&p.statsWaited), time.Duration(atomic.LoadInt64(&p.statsWaitNs))
 }
@@ -0,0 +1,123 @@
+package proto
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	protodesc "github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+	lua "github.com/yuin/gopher-lua"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	libbytes "github.com/joesonw/lte/pkg/lua/lib/bytes"
+)
+
+// callOptions are options of a call given by lua, e.g. `{ metadata = { authorization = "Bearer x" }, timeout = 1000,
+// wait_for_ready = true }`, timeout is in milliseconds and covers a whole stream for streaming calls
+type callOptions struct {
+	metadata     metadata.MD
+	timeout      time.Duration
+	waitForReady bool
+}
+
+func checkCallOptions(L *lua.LState, n int) *callOptions {
+	opts := &callOptions{}
+	table, ok := L.Get(n).(*lua.LTable)
+	if !ok {
+		if L.Get(n) != lua.LNil {
+			L.TypeError(n, lua.LTTable)
+		}
+		return opts
+	}
+
+	if md, ok := table.RawGetString("metadata").(*lua.LTable); ok {
+		opts.metadata = metadata.MD{}
+		md.ForEach(func(k, v lua.LValue) {
+			key := strings.ToLower(k.String())
+			if values, ok := v.(*lua.LTable); ok {
+				values.ForEach(func(_, v lua.LValue) {
+					opts.metadata.Append(key, lua.LVAsString(v))
+				})
+			} else {
+				opts.metadata.Append(key, lua.LVAsString(v))
+			}
+		})
+	}
+	if timeout, ok := table.RawGetString("timeout").(lua.LNumber); ok {
+		opts.timeout = time.Duration(float64(timeout) * float64(time.Millisecond))
+	}
+	opts.waitForReady = lua.LVAsBool(table.RawGetString("wait_for_ready"))
+	return opts
+}
+
+// context returns ctx carrying metadata and deadline of the call
+func (o *callOptions) context(ctx context.Context) (context.Context, context.CancelFunc) {
+	if len(o.metadata) > 0 {
+		ctx = metadata.NewOutgoingContext(ctx, o.metadata)
+	}
+	if o.timeout > 0 {
+		return context.WithTimeout(ctx, o.timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+func (o *callOptions) grpcOptions() []grpc.CallOption {
+	if o.waitForReady {
+		return []grpc.CallOption{grpc.WaitForReady(true)}
+	}
+	return nil
+}
+
+// callMeta is what a call returns besides messages: headers, trailers and status
+type callMeta struct {
+	header  metadata.MD
+	trailer metadata.MD
+	err     error
+	// file resolves types of status details, types not found in file or its dependencies are looked up in ones
+	// linked into the binary
+	file *protodesc.FileDescriptor
+}
+
+// push pushes a table of meta to L, e.g. `{ headers = {}, trailers = {}, code = "NotFound", message = "no such item",
+// details = { { type = "google.rpc.BadRequest", value = {} } } }`, values of metadata are the first of each key
+func (m *callMeta) push(L *lua.LState) {
+	table := L.NewTable()
+	table.RawSetString("headers", metadataToLua(L, m.header))
+	table.RawSetString("trailers", metadataToLua(L, m.trailer))
+
+	st := status.Convert(m.err)
+	table.RawSetString("code", lua.LString(st.Code().String()))
+	table.RawSetString("message", lua.LString(st.Message()))
+
+	details := L.NewTable()
+	resolver := dynamic.AnyResolver(nil, m.file)
+	for _, any := range st.Proto().GetDetails() {
+		detail := L.NewTable()
+		detail.RawSetString("type", lua.LString(any.GetTypeUrl()[strings.LastIndex(any.GetTypeUrl(), "/")+1:]))
+		detail.RawSetString("value", libbytes.New(L, any.GetValue()))
+		if message, err := resolver.Resolve(any.GetTypeUrl()); err == nil {
+			if err := proto.Unmarshal(any.GetValue(), message); err == nil {
+				if val, err := messageToLua(L, message); err == nil {
+					detail.RawSetString("value", val)
+				}
+			}
+		}
+		details.Append(detail)
+	}
+	table.RawSetString("details", details)
+	L.Push(table)
+}
+
+func metadataToLua(L *lua.LState, md metadata.MD) *lua.LTable {
+	table := L.NewTable()
+	for k, values := range md {
+		if len(values) > 0 {
+			table.RawSetString(k, lua.LString(values[0]))
+		}
+	}
+	return table
+}
@@ -0,0 +1,209 @@
+package proto
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+	lua "github.com/yuin/gopher-lua"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	luacontext "github.com/joesonw/lte/pkg/lua/context"
+	libasync "github.com/joesonw/lte/pkg/lua/lib/async"
+	libpool "github.com/joesonw/lte/pkg/lua/lib/pool"
+	goutil "github.com/joesonw/lte/pkg/util"
+)
+
+const connMetaName = "*PROTO*CONN*"
+
+var connFuncs = map[string]lua.LGFunction{
+	"close": connClose,
+}
+
+type grpcClientConnContext struct {
+	cc *grpc.ClientConn
+	// guard is nil for shared connections, which are closed along with their pool
+	guard  *libpool.Guard
+	luaCtx *luacontext.Context
+}
+
+// connPool is a fixed set of connections shared by vms of a job, handed out round robin
+type connPool struct {
+	conns []*grpc.ClientConn
+	next  uint64
+}
+
+func (p *connPool) get() *grpc.ClientConn {
+	return p.conns[(atomic.AddUint64(&p.next, 1)-1)%uint64(len(p.conns))]
+}
+
+func (p *connPool) close() error {
+	var errs []string
+	for _, cc := range p.conns {
+		if err := cc.Close(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// protoDial dials addr, connections are secured by tls unless insecure is set, e.g. `{ ca = "ca.pem", cert =
+// "client.pem", key = "client-key.pem", server_name = "api.example.com" }` with files read from the bundle.
+// With `shared = true`, vms of the job share pool_size connections of addr (1 by default) instead of dialing their own.
+// Connections live until closed or the job ends
+func protoDial(L *lua.LState) int {
+	c := L.CheckUserData(lua.UpvalueIndex(1)).Value.(*protoContext)
+	addr := L.CheckString(2)
+
+	optionalOpts := L.Get(3)
+	opts, _ := optionalOpts.(*lua.LTable)
+	if opts == nil {
+		opts = L.NewTable()
+	}
+	dialOpts, err := c.dialOptions(opts)
+	if err != nil {
+		L.RaiseError(err.Error())
+	}
+
+	if opts.RawGetString("shared") == lua.LTrue {
+		size := 1
+		if n, ok := opts.RawGetString("pool_size").(lua.LNumber); ok {
+			size = int(n)
+		}
+		if size < 1 {
+			L.RaiseError("pool_size has to be positive")
+		}
+		global := c.luaCtx.Global()
+		var dialErr error
+		pool := global.Unique("lib/proto:conn:"+addr+"#"+optionsKey(opts), func() interface{} {
+			pool := &connPool{}
+			for i := 0; i < size; i++ {
+				// dialing does not block, connections are established in background
+				cc, err := grpc.Dial(addr, dialOpts...)
+				if err != nil {
+					pool.close() //nolint:errcheck
+					dialErr = err
+					return nil
+				}
+				pool.conns = append(pool.conns, cc)
+			}
+			global.ReleasePool().Watch(libpool.NewReleaseFunc("grpc pool "+addr, pool.close)).SuppressWarning(true)
+			return pool
+		})
+		if dialErr != nil {
+			L.RaiseError(dialErr.Error())
+		}
+		// failed pools are not kept, so a pool made by another vm is never nil
+		shared, ok := pool.(*connPool)
+		if !ok {
+			L.RaiseError("unable to dial %s", addr)
+		}
+		return libasync.DeferredResult(L, c.luaCtx.AsyncPool(), func(ctx context.Context) (lua.LGFunction, error) {
+			cc := shared.get()
+			return func(L *lua.LState) int {
+				L.Push(c.connClass.New(L, &grpcClientConnContext{
+					cc:     cc,
+					luaCtx: c.luaCtx,
+				}))
+				return 1
+			}, nil
+		})
+	}
+
+	return libasync.DeferredResult(L, c.luaCtx.AsyncPool(), func(ctx context.Context) (lua.LGFunction, error) {
+		cc, err := grpc.DialContext(ctx, addr, dialOpts...)
+		if err != nil {
+			return nil, err
+		}
+		// connections are usually dialed in top level chunk and kept across iterations, they are released at job end
+		// rather than by the resource pool of the vm, which is cleaned after each iteration
+		g := c.luaCtx.Global().ReleasePool().Watch(libpool.NewReleaseFunc("grpc conn "+addr, cc.Close)).SuppressWarning(true)
+
+		return func(L *lua.LState) int {
+			L.Push(c.connClass.New(L, &grpcClientConnContext{
+				cc:     cc,
+				guard:  g,
+				luaCtx: c.luaCtx,
+			}))
+			return 1
+		}, nil
+	})
+}
+
+// optionsKey tells apart shared pools of an address dialed with different options
+func optionsKey(opts *lua.LTable) string {
+	var pairs []string
+	opts.ForEach(func(k, v lua.LValue) {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", k.String(), v.String()))
+	})
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// connClose closes a connection, it has no effect on a shared connection
+func connClose(L *lua.LState) int {
+	c := L.CheckUserData(1).Value.(*grpcClientConnContext)
+	return libasync.Deferred(L, c.luaCtx.AsyncPool(), func(ctx context.Context) error {
+		if c.guard == nil {
+			return nil
+		}
+		c.guard.Done()
+		return c.cc.Close()
+	})
+}
+
+func (c *protoContext) dialOptions(opts *lua.LTable) ([]grpc.DialOption, error) {
+	var dialOpts []grpc.DialOption
+	if c.luaCtx.StubNetwork() {
+		// connections are made as usual but never connect, calls fail with "network is stubbed"
+		dialOpts = append(dialOpts, grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+			return nil, goutil.ErrNetworkStubbed
+		}))
+	}
+	if opts.RawGetString("insecure") == lua.LTrue {
+		return append(dialOpts, grpc.WithInsecure()), nil
+	}
+
+	config := &tls.Config{
+		ServerName: lua.LVAsString(opts.RawGetString("server_name")),
+	}
+	if ca := lua.LVAsString(opts.RawGetString("ca")); ca != "" {
+		b, err := afero.ReadFile(c.fs, ca)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to read ca")
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(b) {
+			return nil, errors.Errorf("no certificate in ca %s", ca)
+		}
+	}
+	cert := lua.LVAsString(opts.RawGetString("cert"))
+	key := lua.LVAsString(opts.RawGetString("key"))
+	if cert != "" || key != "" {
+		certPEM, err := afero.ReadFile(c.fs, cert)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to read cert")
+		}
+		keyPEM, err := afero.ReadFile(c.fs, key)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to read key")
+		}
+		pair, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to load client certificate")
+		}
+		config.Certificates = []tls.Certificate{pair}
+	}
+	return append(dialOpts, grpc.WithTransportCredentials(credentials.NewTLS(config))), nil
+}
@@ -0,0 +1,308 @@
+package proto
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	dpb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+	protodesc "github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+	"github.com/pkg/errors"
+	lua "github.com/yuin/gopher-lua"
+
+	libbytes "github.com/joesonw/lte/pkg/lua/lib/bytes"
+	libjson "github.com/joesonw/lte/pkg/lua/lib/json"
+)
+
+// maxExactInteger is the largest integer a lua number (float64) represents exactly
+const maxExactInteger = 1 << 53
+
+// tableToMessage builds a message of desc from fields of table. Fields are keyed by name or json name, 64 bit integers
+// are numbers or strings for values beyond precision of numbers, bytes are strings or bytes, enums are names or numbers
+func tableToMessage(desc *protodesc.MessageDescriptor, table *lua.LTable) (*dynamic.Message, error) {
+	message := dynamic.NewMessage(desc)
+	var err error
+	table.ForEach(func(k, v lua.LValue) {
+		if err != nil || v == lua.LNil {
+			return
+		}
+		name, ok := k.(lua.LString)
+		if !ok {
+			err = errors.Errorf("%s: field name has to be string, got %s", desc.GetFullyQualifiedName(), k.Type().String())
+			return
+		}
+		fd := desc.FindFieldByName(string(name))
+		if fd == nil {
+			fd = desc.FindFieldByJSONName(string(name))
+		}
+		if fd == nil {
+			err = errors.Errorf("%s: unknown field \"%s\"", desc.GetFullyQualifiedName(), name)
+			return
+		}
+		if e := setField(message, fd, v); e != nil {
+			err = errors.Wrapf(e, "%s", fd.GetFullyQualifiedName())
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+func setField(message *dynamic.Message, fd *protodesc.FieldDescriptor, v lua.LValue) error {
+	switch {
+	case fd.IsMap():
+		table, ok := v.(*lua.LTable)
+		if !ok {
+			return errors.Errorf("expected table, got %s", v.Type().String())
+		}
+		keyField, valueField := fd.GetMapKeyType(), fd.GetMapValueType()
+		var err error
+		table.ForEach(func(k, v lua.LValue) {
+			if err != nil {
+				return
+			}
+			var key, val interface{}
+			if key, err = luaToValue(keyField, k); err != nil {
+				return
+			}
+			if val, err = luaToValue(valueField, v); err != nil {
+				return
+			}
+			err = message.TryPutMapField(fd, key, val)
+		})
+		return err
+	case fd.IsRepeated():
+		table, ok := v.(*lua.LTable)
+		if !ok {
+			return errors.Errorf("expected table, got %s", v.Type().String())
+		}
+		for i := 1; i <= table.Len(); i++ {
+			val, err := luaToValue(fd, table.RawGetInt(i))
+			if err != nil {
+				return errors.Wrapf(err, "[%d]", i)
+			}
+			if err := message.TryAddRepeatedField(fd, val); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		val, err := luaToValue(fd, v)
+		if err != nil {
+			return err
+		}
+		return message.TrySetField(fd, val)
+	}
+}
+
+// luaToValue converts a single value of field fd, i.e. an element of repeated fields
+func luaToValue(fd *protodesc.FieldDescriptor, v lua.LValue) (interface{}, error) {
+	switch fd.GetType() {
+	case dpb.FieldDescriptorProto_TYPE_INT32, dpb.FieldDescriptorProto_TYPE_SINT32, dpb.FieldDescriptorProto_TYPE_SFIXED32:
+		n, err := luaToInt(v, 32)
+		return int32(n), err
+	case dpb.FieldDescriptorProto_TYPE_INT64, dpb.FieldDescriptorProto_TYPE_SINT64, dpb.FieldDescriptorProto_TYPE_SFIXED64:
+		return luaToInt(v, 64)
+	case dpb.FieldDescriptorProto_TYPE_UINT32, dpb.FieldDescriptorProto_TYPE_FIXED32:
+		n, err := luaToUint(v, 32)
+		return uint32(n), err
+	case dpb.FieldDescriptorProto_TYPE_UINT64, dpb.FieldDescriptorProto_TYPE_FIXED64:
+		return luaToUint(v, 64)
+	case dpb.FieldDescriptorProto_TYPE_FLOAT:
+		f, err := luaToFloat(v, 32)
+		return float32(f), err
+	case dpb.FieldDescriptorProto_TYPE_DOUBLE:
+		return luaToFloat(v, 64)
+	case dpb.FieldDescriptorProto_TYPE_BOOL:
+		b, ok := v.(lua.LBool)
+		if !ok {
+			return nil, errors.Errorf("expected boolean, got %s", v.Type().String())
+		}
+		return bool(b), nil
+	case dpb.FieldDescriptorProto_TYPE_STRING:
+		s, ok := v.(lua.LString)
+		if !ok {
+			return nil, errors.Errorf("expected string, got %s", v.Type().String())
+		}
+		return string(s), nil
+	case dpb.FieldDescriptorProto_TYPE_BYTES:
+		if !libbytes.Is(v) {
+			return nil, errors.Errorf("expected string or bytes, got %s", v.Type().String())
+		}
+		return libbytes.Get(v), nil
+	case dpb.FieldDescriptorProto_TYPE_ENUM:
+		if name, ok := v.(lua.LString); ok {
+			value := fd.GetEnumType().FindValueByName(string(name))
+			if value == nil {
+				return nil, errors.Errorf("unknown value \"%s\" of enum %s", name, fd.GetEnumType().GetFullyQualifiedName())
+			}
+			return value.GetNumber(), nil
+		}
+		n, err := luaToInt(v, 32)
+		return int32(n), err
+	case dpb.FieldDescriptorProto_TYPE_MESSAGE, dpb.FieldDescriptorProto_TYPE_GROUP:
+		if table, ok := v.(*lua.LTable); ok && !isWellKnown(fd.GetMessageType()) {
+			return tableToMessage(fd.GetMessageType(), table)
+		}
+		// well known types are converted as json, e.g. timestamps are RFC 3339 strings
+		b, err := libjson.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		message := dynamic.NewMessage(fd.GetMessageType())
+		if err := message.UnmarshalJSON(b); err != nil {
+			return nil, err
+		}
+		return message, nil
+	}
+	return nil, errors.Errorf("unsupported type %s", fd.GetType().String())
+}
+
+func luaToInt(v lua.LValue, bits int) (int64, error) {
+	switch v := v.(type) {
+	case lua.LNumber:
+		f := float64(v)
+		if f != math.Trunc(f) {
+			return 0, errors.Errorf("expected integer, got %s", v.String())
+		}
+		if bits == 32 && (f < math.MinInt32 || f > math.MaxInt32) {
+			return 0, errors.Errorf("%s overflows int32", v.String())
+		}
+		if math.Abs(f) > maxExactInteger {
+			return 0, errors.Errorf("%s is beyond precision of numbers, use a string instead", v.String())
+		}
+		return int64(f), nil
+	case lua.LString:
+		return strconv.ParseInt(string(v), 10, bits)
+	}
+	return 0, errors.Errorf("expected integer, got %s", v.Type().String())
+}
+
+func luaToUint(v lua.LValue, bits int) (uint64, error) {
+	switch v := v.(type) {
+	case lua.LNumber:
+		f := float64(v)
+		if f != math.Trunc(f) || f < 0 {
+			return 0, errors.Errorf("expected unsigned integer, got %s", v.String())
+		}
+		if bits == 32 && f > math.MaxUint32 {
+			return 0, errors.Errorf("%s overflows uint32", v.String())
+		}
+		if f > maxExactInteger {
+			return 0, errors.Errorf("%s is beyond precision of numbers, use a string instead", v.String())
+		}
+		return uint64(f), nil
+	case lua.LString:
+		return strconv.ParseUint(string(v), 10, bits)
+	}
+	return 0, errors.Errorf("expected unsigned integer, got %s", v.Type().String())
+}
+
+func luaToFloat(v lua.LValue, bits int) (float64, error) {
+	switch v := v.(type) {
+	case lua.LNumber:
+		return float64(v), nil
+	case lua.LString:
+		return strconv.ParseFloat(string(v), bits)
+	}
+	return 0, errors.Errorf("expected number, got %s", v.Type().String())
+}
+
+// messageToLua returns a table of fields set in message keyed by json name, it has to be called on goroutine of L.
+// 64 bit integers are strings so they are exact, bytes are bytes and enums are names
+func messageToLua(L *lua.LState, message proto.Message) (lua.LValue, error) {
+	m, err := dynamic.AsDynamicMessage(message)
+	if err != nil {
+		return nil, err
+	}
+	if isWellKnown(m.GetMessageDescriptor()) {
+		b, err := m.MarshalJSON()
+		if err != nil {
+			return nil, err
+		}
+		return libjson.Unmarshal(L, b)
+	}
+
+	table := L.NewTable()
+	for _, fd := range m.GetMessageDescriptor().GetFields() {
+		if !m.HasField(fd) {
+			continue
+		}
+		var val lua.LValue
+		switch {
+		case fd.IsMap():
+			entries := L.NewTable()
+			keyField, valueField := fd.GetMapKeyType(), fd.GetMapValueType()
+			m.ForEachMapFieldEntry(fd, func(k, v interface{}) bool {
+				var key lua.LValue
+				if key, err = valueToLua(L, keyField, k); err != nil {
+					return false
+				}
+				var value lua.LValue
+				if value, err = valueToLua(L, valueField, v); err != nil {
+					return false
+				}
+				entries.RawSet(key, value)
+				return true
+			})
+			val = entries
+		case fd.IsRepeated():
+			list := L.NewTable()
+			for _, v := range m.GetField(fd).([]interface{}) {
+				var value lua.LValue
+				if value, err = valueToLua(L, fd, v); err != nil {
+					break
+				}
+				list.Append(value)
+			}
+			val = list
+		default:
+			val, err = valueToLua(L, fd, m.GetField(fd))
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s", fd.GetFullyQualifiedName())
+		}
+		table.RawSetString(fd.GetJSONName(), val)
+	}
+	return table, nil
+}
+
+// valueToLua converts a single value of field fd, i.e. an element of repeated fields
+func valueToLua(L *lua.LState, fd *protodesc.FieldDescriptor, v interface{}) (lua.LValue, error) {
+	switch v := v.(type) {
+	case int32:
+		if fd.GetType() == dpb.FieldDescriptorProto_TYPE_ENUM {
+			if value := fd.GetEnumType().FindValueByNumber(v); value != nil {
+				return lua.LString(value.GetName()), nil
+			}
+		}
+		return lua.LNumber(v), nil
+	case int64:
+		return lua.LString(strconv.FormatInt(v, 10)), nil
+	case uint32:
+		return lua.LNumber(v), nil
+	case uint64:
+		return lua.LString(strconv.FormatUint(v, 10)), nil
+	case float32:
+		return lua.LNumber(v), nil
+	case float64:
+		return lua.LNumber(v), nil
+	case bool:
+		return lua.LBool(v), nil
+	case string:
+		return lua.LString(v), nil
+	case []byte:
+		return libbytes.New(L, v), nil
+	case proto.Message:
+		return messageToLua(L, v)
+	}
+	return nil, errors.Errorf("unsupported value %T", v)
+}
+
+// isWellKnown tells messages of google.protobuf, which have special json forms, e.g. timestamps and wrappers
+func isWellKnown(desc *protodesc.MessageDescriptor) bool {
+	return strings.HasPrefix(desc.GetFullyQualifiedName(), "google.protobuf.")
+}
@@ -5,8 +5,8 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/golang/protobuf/proto"
 	protodesc "github.com/jhump/protoreflect/desc"
-	"github.com/jhump/protoreflect/dynamic"
 	"github.com/jhump/protoreflect/dynamic/grpcdynamic"
 	lua "github.com/yuin/gopher-lua"
 	"google.golang.org/grpc"
@@ -14,60 +14,25 @@ import (
 
 	luacontext "github.com/joesonw/lte/pkg/lua/context"
 	libasync "github.com/joesonw/lte/pkg/lua/lib/async"
-	libjson "github.com/joesonw/lte/pkg/lua/lib/json"
+	goclass "github.com/joesonw/lte/pkg/lua/lib/go-class"
 	luautil "github.com/joesonw/lte/pkg/lua/util"
 	"github.com/joesonw/lte/pkg/stat"
 )
 
-type grpcClientConnContext struct {
-	cc     *grpc.ClientConn
-	luaCtx *luacontext.Context
-}
-
-func protoDial(L *lua.LState) int {
-	c := L.CheckUserData(lua.UpvalueIndex(1)).Value.(*protoContext)
-	addr := L.CheckString(2)
-
-	optionalOpts := L.Get(3)
-	opts, ok := optionalOpts.(*lua.LTable)
-	var dialOpts []grpc.DialOption
-
-	if ok {
-		if val := opts.RawGetString("insecure"); val == lua.LTrue {
-			dialOpts = append(dialOpts, grpc.WithInsecure())
-		}
-	}
-
-	return libasync.DeferredResult(L, c.luaCtx.AsyncPool(), func(ctx context.Context) (lua.LGFunction, error) {
-		cc, err := grpc.Dial(addr, dialOpts...)
-		if err != nil {
-			return nil, err
-		}
-
-		return func(L *lua.LState) int {
-			ud := L.NewUserData()
-			ud.Value = &grpcClientConnContext{
-				cc:     cc,
-				luaCtx: c.luaCtx,
-			}
-			L.Push(ud)
-			return 1
-		}, nil
-	})
-}
-
 type serviceClientContext struct {
-	client grpcdynamic.Stub
-	desc   *protodesc.ServiceDescriptor
-	luaCtx *luacontext.Context
+	client      grpcdynamic.Stub
+	desc        *protodesc.ServiceDescriptor
+	streamClass *goclass.Class
+	luaCtx      *luacontext.Context
 }
 
-func newServiceClient(L *lua.LState, luaCtx *luacontext.Context, desc *protodesc.ServiceDescriptor, client grpcdynamic.Stub) lua.LValue {
+func newServiceClient(L *lua.LState, luaCtx *luacontext.Context, desc *protodesc.ServiceDescriptor, streamClass *goclass.Class, client grpcdynamic.Stub) lua.LValue {
 	ud := L.NewUserData()
 	ud.Value = &serviceClientContext{
-		client: client,
-		desc:   desc,
-		luaCtx: luaCtx,
+		client:      client,
+		desc:        desc,
+		streamClass: streamClass,
+		luaCtx:      luaCtx,
 	}
 
 	index := L.NewTable()
@@ -83,63 +48,87 @@ func serviceClientCall(L *lua.LState) int {
 	c := L.CheckUserData(lua.UpvalueIndex(1)).Value.(*serviceClientContext)
 	name := L.CheckString(2)
 	L.Push(L.NewClosure(func(L *lua.LState) int {
-		reqObj := L.CheckTable(2)
-		return libasync.DeferredResult(L, c.luaCtx.AsyncPool(), func(ctx context.Context) (lua.LGFunction, error) {
-			method := c.desc.FindMethodByName(name)
-			if method == nil {
+		method := c.desc.FindMethodByName(name)
+		if method == nil {
+			return libasync.DeferredResult(L, c.luaCtx.AsyncPool(), func(ctx context.Context) (lua.LGFunction, error) {
 				return nil, fmt.Errorf("method \"%s\" not found", name)
-			}
-			serviceName := c.desc.GetFullyQualifiedName()
-			methodName := method.GetFullyQualifiedName()
+			})
+		}
+		if method.IsClientStreaming() || method.IsServerStreaming() {
+			return serviceClientStream(L, c, method)
+		}
 
-			bytes, err := libjson.Marshal(reqObj)
-			if err != nil {
-				return nil, err
-			}
+		req, err := tableToMessage(method.GetInputType(), L.CheckTable(2))
+		if err != nil {
+			L.RaiseError(err.Error())
+		}
+		opts := checkCallOptions(L, 3)
 
-			s := stat.New("grpc").Tag("service", serviceName).Tag("method", methodName)
+		return libasync.DeferredResult(L, c.luaCtx.AsyncPool(), func(ctx context.Context) (lua.LGFunction, error) {
+			s := stat.New("grpc").Tag("service", c.desc.GetFullyQualifiedName()).Tag("method", method.GetFullyQualifiedName())
 			defer luautil.ReportContextStat(c.luaCtx, s)
 
-			req := dynamic.NewMessage(method.GetInputType())
-			if err := req.UnmarshalJSON(bytes); err != nil {
-				L.RaiseError(err.Error())
-			}
-
+			meta := &callMeta{file: method.GetFile()}
+			ctx, cancel := opts.context(ctx)
+			defer cancel()
 			start := time.Now()
-			resMessage, err := c.client.InvokeRpc(ctx, method, req)
+			res, err := c.client.InvokeRpc(ctx, method, req, append(opts.grpcOptions(), grpc.Header(&meta.header), grpc.Trailer(&meta.trailer))...)
+			meta.err = err
 			if err != nil {
-				code := status.Code(err)
-				s.Tag("code", code.String()).Int64Field("success", 0)
-				return nil, err
+				luautil.FailStat(ctx, s.Tag("code", status.Code(err).String()), err)
+				return func(L *lua.LState) int {
+					L.Push(lua.LNil)
+					meta.push(L)
+					return 2
+				}, err
 			}
 
-			s.Int64Field("duration_ns", time.Since(start).Nanoseconds())
-			res, err := dynamic.AsDynamicMessage(resMessage)
-			if err != nil {
-				s.Int64Field("success", 0)
-				return nil, err
-			}
-
-			bytes, err = res.MarshalJSON()
-			if err != nil {
-				s.Int64Field("success", 0)
-				return nil, err
-			}
-			s.IntField("response_size", len(bytes))
-
-			s.Int64Field("success", 1).IntField("response_size", len(bytes))
+			s.Int64Field("duration_ns", time.Since(start).Nanoseconds()).
+				IntField("response_size", proto.Size(res)).
+				Int64Field("success", 1)
 
 			return func(L *lua.LState) int {
-				val, err := libjson.Unmarshal(L, bytes)
+				val, err := messageToLua(L, res)
 				if err != nil {
 					L.RaiseError(err.Error())
 				}
-
 				L.Push(val)
-				return 1
+				meta.push(L)
+				return 2
 			}, nil
 		})
 	}))
 
 	return 1
 }
+
+// serviceClientStream opens a stream of method, a server stream sends the request at argument 2 on opening, call
+// options follow the request if any
+func serviceClientStream(L *lua.LState, c *serviceClientContext, method *protodesc.MethodDescriptor) int {
+	var req proto.Message
+	optsIndex := 2
+	if !method.IsClientStreaming() {
+		m, err := tableToMessage(method.GetInputType(), L.CheckTable(2))
+		if err != nil {
+			L.RaiseError(err.Error())
+		}
+		req = m
+		optsIndex = 3
+	}
+	opts := checkCallOptions(L, optsIndex)
+
+	return libasync.DeferredResult(L, c.luaCtx.AsyncPool(), func(ctx context.Context) (lua.LGFunction, error) {
+		stream, err := openStream(ctx, c.client, c.luaCtx, method, req, opts)
+		if err != nil {
+			s := stat.New("grpc_stream").Tag("service", c.desc.GetFullyQualifiedName()).Tag("method", method.GetFullyQualifiedName())
+			luautil.FailStat(ctx, s.Tag("code", status.Code(err).String()), err)
+			luautil.ReportContextStat(c.luaCtx, s)
+			return nil, err
+		}
+
+		return func(L *lua.LState) int {
+			L.Push(c.streamClass.New(L, stream))
+			return 1
+		}, nil
+	})
+}
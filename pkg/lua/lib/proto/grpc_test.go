@@ -0,0 +1,290 @@
+package proto_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	lua "github.com/yuin/gopher-lua"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	luacontext "github.com/joesonw/lte/pkg/lua/context"
+	libproto "github.com/joesonw/lte/pkg/lua/lib/proto"
+	test_util "github.com/joesonw/lte/pkg/lua/test-util"
+	"github.com/joesonw/lte/pkg/record"
+)
+
+// itemsScript dials addr and binds svc to test.Items before script
+func itemsScript(addr, script string) string {
+	return fmt.Sprintf(`
+		local proto = require "proto"
+		local messages, services = proto:load("items.proto")
+		local dialErr, cc = proto:dial("%s", { insecure = true })()
+		assert(dialErr == nil, dialErr)
+		local svc = services["test.Items"]:new(cc)
+		%s
+	`, addr, script)
+}
+
+func TestUnary(t *testing.T) {
+	addr := startItemsServer(t)
+	test_util.Run(t, func(t *testing.T) *test_util.Test {
+		return test_util.New("unary", itemsScript(addr, `
+			err, res = svc:Get({ name = "a", n = 1 })()
+		`)).
+			Before(func(t *testing.T, L *lua.LState, luaCtx *luacontext.Context) {
+				libproto.Open(L, luaCtx, newItemsFs(t))
+			}).
+			After(func(t *testing.T, L *lua.LState) {
+				assert.Equal(t, lua.LNil, L.GetGlobal("err"))
+				res := L.GetGlobal("res").(*lua.LTable)
+				assert.Equal(t, "a", res.RawGetString("name").String())
+				assert.Equal(t, lua.LNumber(2), res.RawGetString("n"))
+			})
+	})
+}
+
+func TestStream(t *testing.T) {
+	addr := startItemsServer(t)
+	test_util.Run(t, func(t *testing.T) *test_util.Test {
+		return test_util.New("server stream", itemsScript(addr, `
+			local err, stream = svc:List({ name = "item", n = 3 })()
+			assert(err == nil, err)
+			names = {}
+			while true do
+				local err, item, meta = stream:recv()()
+				assert(err == nil, err)
+				if item == nil then
+					code, count = meta.code, meta.trailers.count
+					break
+				end
+				table.insert(names, item.name)
+			end
+			ok = pcall(function() stream:send({}) end)
+		`)).
+			Before(func(t *testing.T, L *lua.LState, luaCtx *luacontext.Context) {
+				libproto.Open(L, luaCtx, newItemsFs(t))
+			}).
+			After(func(t *testing.T, L *lua.LState) {
+				names := L.GetGlobal("names").(*lua.LTable)
+				assert.Equal(t, 3, names.Len())
+				for i := 1; i <= 3; i++ {
+					assert.Equal(t, fmt.Sprintf("item%d", i-1), names.RawGetInt(i).String())
+				}
+				assert.Equal(t, lua.LFalse, L.GetGlobal("ok"))
+				assert.Equal(t, "OK", L.GetGlobal("code").String())
+				assert.Equal(t, "3", L.GetGlobal("count").String())
+			})
+	}, func(t *testing.T) *test_util.Test {
+		return test_util.New("client stream", itemsScript(addr, `
+			local openErr, stream = svc:Add()()
+			assert(openErr == nil, openErr)
+			for i = 1, 4 do
+				local err = stream:send({ n = i })()
+				assert(err == nil, err)
+			end
+			assert(stream:close_send()() == nil)
+			err, sum = stream:recv()()
+			local _, last = stream:recv()()
+			ended = last == nil
+		`)).
+			Before(func(t *testing.T, L *lua.LState, luaCtx *luacontext.Context) {
+				libproto.Open(L, luaCtx, newItemsFs(t))
+			}).
+			After(func(t *testing.T, L *lua.LState) {
+				assert.Equal(t, lua.LNil, L.GetGlobal("err"))
+				sum := L.GetGlobal("sum").(*lua.LTable)
+				assert.Equal(t, lua.LNumber(10), sum.RawGetString("total"))
+				assert.Equal(t, lua.LNumber(4), sum.RawGetString("count"))
+				assert.Equal(t, lua.LTrue, L.GetGlobal("ended"))
+			})
+	}, func(t *testing.T) *test_util.Test {
+		return test_util.New("bidi stream", itemsScript(addr, `
+			local err, stream = svc:Echo()()
+			assert(err == nil, err)
+			echoed = {}
+			for _, name in ipairs({ "x", "y" }) do
+				assert(stream:send({ name = name })() == nil)
+				local err, item = stream:recv()()
+				assert(err == nil, err)
+				table.insert(echoed, item.name)
+			end
+			assert(stream:close_send()() == nil)
+			local err, item = stream:recv()()
+			ended = err == nil and item == nil
+			stream:close()()
+		`)).
+			Before(func(t *testing.T, L *lua.LState, luaCtx *luacontext.Context) {
+				libproto.Open(L, luaCtx, newItemsFs(t))
+			}).
+			After(func(t *testing.T, L *lua.LState) {
+				echoed := L.GetGlobal("echoed").(*lua.LTable)
+				assert.Equal(t, "x", echoed.RawGetInt(1).String())
+				assert.Equal(t, "y", echoed.RawGetInt(2).String())
+				assert.Equal(t, lua.LTrue, L.GetGlobal("ended"))
+			})
+	}, func(t *testing.T) *test_util.Test {
+		return test_util.New("stream closed", itemsScript(addr, `
+			local openErr, stream = svc:Echo()()
+			assert(openErr == nil, openErr)
+			stream:close()()
+			err = stream:send({ name = "x" })()
+		`)).
+			Before(func(t *testing.T, L *lua.LState, luaCtx *luacontext.Context) {
+				libproto.Open(L, luaCtx, newItemsFs(t))
+			}).
+			After(func(t *testing.T, L *lua.LState) {
+				assert.Contains(t, L.GetGlobal("err").String(), "stream is closed")
+			})
+	})
+}
+
+func TestCallMeta(t *testing.T) {
+	addr := startItemsServer(t)
+	test_util.Run(t, func(t *testing.T) *test_util.Test {
+		return test_util.New("call meta", itemsScript(addr, `
+			err, res, meta = svc:Get({ name = "a" }, { metadata = { Authorization = "Bearer token" } })()
+			failErr, failRes, failMeta = svc:Get({ name = "fail" })()
+			slowErr, _, slowMeta = svc:Get({ name = "slow" }, { timeout = 50 })()
+		`)).
+			Before(func(t *testing.T, L *lua.LState, luaCtx *luacontext.Context) {
+				libproto.Open(L, luaCtx, newItemsFs(t))
+			}).
+			After(func(t *testing.T, L *lua.LState) {
+				assert.Equal(t, lua.LNil, L.GetGlobal("err"))
+				meta := L.GetGlobal("meta").(*lua.LTable)
+				assert.Equal(t, "OK", meta.RawGetString("code").String())
+				assert.Equal(t, "Bearer token", L.GetField(meta.RawGetString("headers"), "authorization").String())
+				assert.Equal(t, "items", L.GetField(meta.RawGetString("trailers"), "served-by").String())
+
+				assert.Contains(t, L.GetGlobal("failErr").String(), "no item fail")
+				assert.Equal(t, lua.LNil, L.GetGlobal("failRes"))
+				failMeta := L.GetGlobal("failMeta").(*lua.LTable)
+				assert.Equal(t, "NotFound", failMeta.RawGetString("code").String())
+				assert.Equal(t, "no item fail", failMeta.RawGetString("message").String())
+				assert.Equal(t, "items", L.GetField(failMeta.RawGetString("trailers"), "served-by").String())
+				detail := failMeta.RawGetString("details").(*lua.LTable).RawGetInt(1)
+				assert.Equal(t, "test.Item", L.GetField(detail, "type").String())
+				assert.Equal(t, lua.LNumber(404), L.GetField(L.GetField(detail, "value"), "n"))
+
+				assert.NotEqual(t, lua.LNil, L.GetGlobal("slowErr"))
+				assert.Equal(t, "DeadlineExceeded", L.GetField(L.GetGlobal("slowMeta"), "code").String())
+			})
+	})
+}
+
+func TestWaitForReady(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	addr := lis.Addr().String()
+	lis.Close()
+
+	test_util.Run(t, func(t *testing.T) *test_util.Test {
+		return test_util.New("wait for ready", itemsScript(addr, `
+			local _, _, meta = svc:Get({ name = "a" }, { timeout = 5000 })()
+			failFast = meta.code
+			_, _, meta = svc:Get({ name = "a" }, { timeout = 100, wait_for_ready = true })()
+			waited = meta.code
+		`)).
+			Before(func(t *testing.T, L *lua.LState, luaCtx *luacontext.Context) {
+				libproto.Open(L, luaCtx, newItemsFs(t))
+			}).
+			After(func(t *testing.T, L *lua.LState) {
+				assert.Equal(t, "Unavailable", L.GetGlobal("failFast").String())
+				assert.Equal(t, "DeadlineExceeded", L.GetGlobal("waited").String())
+			})
+	})
+}
+
+func TestTLS(t *testing.T) {
+	ca, err := record.NewCA()
+	assert.Nil(t, err)
+	serverCert, err := ca.Certificate("items.test")
+	assert.Nil(t, err)
+	addr := startItemsServer(t, grpc.Creds(credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{*serverCert},
+		ClientAuth:   tls.RequireAnyClientCert,
+	})))
+
+	clientCert, err := ca.Certificate("client")
+	assert.Nil(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(clientCert.PrivateKey.(*ecdsa.PrivateKey))
+	assert.Nil(t, err)
+	fs := newItemsFs(t)
+	assert.Nil(t, afero.WriteFile(fs, "ca.pem", ca.CertPEM(), 0644))
+	assert.Nil(t, afero.WriteFile(fs, "client.pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: clientCert.Certificate[0]}), 0644))
+	assert.Nil(t, afero.WriteFile(fs, "client-key.pem", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0644))
+
+	test_util.Run(t, func(t *testing.T) *test_util.Test {
+		return test_util.New("tls", fmt.Sprintf(`
+			local proto = require "proto"
+			local messages, services = proto:load("items.proto")
+			local tls = { ca = "ca.pem", cert = "client.pem", key = "client-key.pem", server_name = "items.test" }
+			local _, cc = proto:dial("%[1]s", tls)()
+			err, res, meta = services["test.Items"]:new(cc):Get({ name = "a" })()
+
+			tls.server_name = nil
+			_, cc = proto:dial("%[1]s", tls)()
+			mismatchErr = services["test.Items"]:new(cc):Get({ name = "a" })()
+		`, addr)).
+			Before(func(t *testing.T, L *lua.LState, luaCtx *luacontext.Context) {
+				libproto.Open(L, luaCtx, fs)
+			}).
+			After(func(t *testing.T, L *lua.LState) {
+				assert.Equal(t, lua.LNil, L.GetGlobal("err"))
+				assert.Equal(t, "a", L.GetField(L.GetGlobal("res"), "name").String())
+				assert.Equal(t, "client", L.GetField(L.GetField(L.GetGlobal("meta"), "headers"), "client").String())
+				assert.Contains(t, L.GetGlobal("mismatchErr").String(), "certificate")
+			})
+	})
+}
+
+func TestSharedDial(t *testing.T) {
+	counter := &connCounter{}
+	addr := startItemsServer(t, grpc.StatsHandler(counter))
+	var global *luacontext.Global
+	test_util.Run(t, func(t *testing.T) *test_util.Test {
+		return test_util.New("shared dial", fmt.Sprintf(`
+			local proto = require "proto"
+			local messages, services = proto:load("items.proto")
+			for i = 1, 5 do
+				local _, cc = proto:dial("%[1]s", { insecure = true, shared = true, pool_size = 2 })()
+				local err = services["test.Items"]:new(cc):Get({ name = "a" })()
+				assert(err == nil, err)
+				cc:close()() -- no effect on shared connections
+			end
+			for i = 1, 2 do
+				local _, cc = proto:dial("%[1]s", { insecure = true })()
+				local err = services["test.Items"]:new(cc):Get({ name = "a" })()
+				assert(err == nil, err)
+			end
+			local _, cc = proto:dial("%[1]s", { insecure = true })()
+			assert(services["test.Items"]:new(cc):Get({ name = "a" })() == nil)
+			cc:close()()
+			closedErr = services["test.Items"]:new(cc):Get({ name = "a" })()
+		`, addr)).
+			Before(func(t *testing.T, L *lua.LState, luaCtx *luacontext.Context) {
+				libproto.Open(L, luaCtx, newItemsFs(t))
+				global = luaCtx.Global()
+			}).
+			After(func(t *testing.T, L *lua.LState) {
+				assert.Contains(t, L.GetGlobal("closedErr").String(), "Canceled")
+				assert.Equal(t, int64(5), atomic.LoadInt64(&counter.begun))
+				// the pool and 2 connections dialed without closing are left open until the job ends
+				assert.Equal(t, int64(3), global.ReleasePool().Len())
+				global.Close()
+				assert.Eventually(t, func() bool {
+					return atomic.LoadInt64(&counter.ended) == 5
+				}, time.Second*5, time.Millisecond*10)
+			})
+	})
+}
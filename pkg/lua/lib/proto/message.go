@@ -7,7 +7,6 @@ import (
 
 	luacontext "github.com/joesonw/lte/pkg/lua/context"
 	libbytes "github.com/joesonw/lte/pkg/lua/lib/bytes"
-	libjson "github.com/joesonw/lte/pkg/lua/lib/json"
 )
 
 const messageMetaName = "*PROTO*MESSAGE*"
@@ -24,18 +23,12 @@ var messageFuncs = map[string]lua.LGFunction{
 
 func messageEncode(L *lua.LState) int {
 	c := L.CheckUserData(1).Value.(*messageContext)
-	obj := L.CheckTable(2)
-	bytes, err := libjson.Marshal(obj)
+	message, err := tableToMessage(c.desc, L.CheckTable(2))
 	if err != nil {
 		L.RaiseError(err.Error())
 	}
 
-	message := dynamic.NewMessage(c.desc)
-	if err := message.UnmarshalJSON(bytes); err != nil {
-		L.RaiseError(err.Error())
-	}
-
-	bytes, err = message.Marshal()
+	bytes, err := message.Marshal()
 	if err != nil {
 		L.RaiseError(err.Error())
 	}
@@ -53,12 +46,7 @@ func messageDecode(L *lua.LState) int {
 		L.RaiseError(err.Error())
 	}
 
-	bytes, err = message.MarshalJSON()
-	if err != nil {
-		L.RaiseError(err.Error())
-	}
-
-	val, err := libjson.Unmarshal(L, bytes)
+	val, err := messageToLua(L, message)
 	if err != nil {
 		L.RaiseError(err.Error())
 	}
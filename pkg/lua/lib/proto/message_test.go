@@ -0,0 +1,106 @@
+package proto_test
+
+import (
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	lua "github.com/yuin/gopher-lua"
+
+	luacontext "github.com/joesonw/lte/pkg/lua/context"
+	libbytes "github.com/joesonw/lte/pkg/lua/lib/bytes"
+	libproto "github.com/joesonw/lte/pkg/lua/lib/proto"
+	test_util "github.com/joesonw/lte/pkg/lua/test-util"
+)
+
+const typesProto = `
+syntax = "proto3";
+
+package test;
+
+import "google/protobuf/timestamp.proto";
+
+enum Color {
+	RED = 0;
+	GREEN = 1;
+}
+
+message Inner {
+	string s = 1;
+}
+
+message All {
+	int64 big = 1;
+	uint64 ubig = 2;
+	bytes raw = 3;
+	Color color = 4;
+	repeated Inner inners = 5;
+	map<string, int32> counts = 6;
+	google.protobuf.Timestamp at = 7;
+	double ratio = 8;
+	bool flag = 9;
+	int32 small_number = 10;
+	repeated int64 ids = 11;
+}
+`
+
+func TestMessage(t *testing.T) {
+	test_util.Run(t, func(t *testing.T) *test_util.Test {
+		return test_util.New("encode and decode", `
+			local proto = require "proto"
+			local All = proto:load("types.proto")["test.All"]
+			decoded = All:decode(All:encode({
+				big = "9007199254740993",
+				ubig = "18446744073709551615",
+				raw = "\0\1\255",
+				color = "GREEN",
+				inners = { { s = "a" }, { s = "b" } },
+				counts = { x = 1, y = 2 },
+				at = "2020-01-02T03:04:05Z",
+				ratio = 0.5,
+				flag = true,
+				small_number = 7,
+				ids = { 1, "-9007199254740993" },
+			}))
+			defaults = All:decode(All:encode({ color = 0, smallNumber = 0 }))
+
+			_, precisionErr = pcall(function() All:encode({ big = 2^60 }) end)
+			_, fieldErr = pcall(function() All:encode({ nope = 1 }) end)
+			_, enumErr = pcall(function() All:encode({ color = "BLUE" }) end)
+			_, typeErr = pcall(function() All:encode({ inners = { { s = 1 } } }) end)
+		`).
+			Before(func(t *testing.T, L *lua.LState, luaCtx *luacontext.Context) {
+				fs := afero.NewMemMapFs()
+				assert.Nil(t, afero.WriteFile(fs, "types.proto", []byte(typesProto), 0644))
+				libproto.Open(L, luaCtx, fs)
+			}).
+			After(func(t *testing.T, L *lua.LState) {
+				decoded := L.GetGlobal("decoded").(*lua.LTable)
+				assert.Equal(t, lua.LString("9007199254740993"), decoded.RawGetString("big"))
+				assert.Equal(t, lua.LString("18446744073709551615"), decoded.RawGetString("ubig"))
+				assert.Equal(t, []byte{0, 1, 255}, libbytes.CheckValue(L, decoded.RawGetString("raw")))
+				assert.Equal(t, lua.LString("GREEN"), decoded.RawGetString("color"))
+				inners := decoded.RawGetString("inners").(*lua.LTable)
+				assert.Equal(t, 2, inners.Len())
+				assert.Equal(t, "b", L.GetField(inners.RawGetInt(2), "s").String())
+				assert.Equal(t, lua.LNumber(2), L.GetField(decoded.RawGetString("counts"), "y"))
+				assert.Equal(t, lua.LString("2020-01-02T03:04:05Z"), decoded.RawGetString("at"))
+				assert.Equal(t, lua.LNumber(0.5), decoded.RawGetString("ratio"))
+				assert.Equal(t, lua.LTrue, decoded.RawGetString("flag"))
+				assert.Equal(t, lua.LNumber(7), decoded.RawGetString("smallNumber"))
+				ids := decoded.RawGetString("ids").(*lua.LTable)
+				assert.Equal(t, lua.LString("1"), ids.RawGetInt(1))
+				assert.Equal(t, lua.LString("-9007199254740993"), ids.RawGetInt(2))
+
+				// fields of default values are not set
+				defaults := L.GetGlobal("defaults").(*lua.LTable)
+				assert.Equal(t, lua.LNil, defaults.RawGetString("color"))
+				assert.Equal(t, lua.LNil, defaults.RawGetString("smallNumber"))
+
+				assert.Contains(t, L.GetGlobal("precisionErr").String(), "beyond precision")
+				assert.Contains(t, L.GetGlobal("fieldErr").String(), "unknown field \"nope\"")
+				assert.Contains(t, L.GetGlobal("enumErr").String(), "unknown value \"BLUE\"")
+				assert.Contains(t, L.GetGlobal("typeErr").String(), "test.Inner.s: expected string")
+			})
+	})
+}
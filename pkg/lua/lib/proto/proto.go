@@ -1,14 +1,21 @@
 package proto
 
 import (
+	"context"
 	"os"
 
+	"github.com/golang/protobuf/proto"
+	dpb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+	protodesc "github.com/jhump/protoreflect/desc"
 	"github.com/jhump/protoreflect/desc/protoparse"
+	"github.com/jhump/protoreflect/grpcreflect"
 	"github.com/spf13/afero"
 	lua "github.com/yuin/gopher-lua"
 	"go.uber.org/zap"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
 
 	luacontext "github.com/joesonw/lte/pkg/lua/context"
+	libasync "github.com/joesonw/lte/pkg/lua/lib/async"
 	goclass "github.com/joesonw/lte/pkg/lua/lib/go-class"
 )
 
@@ -17,6 +24,8 @@ const moduleName = "proto"
 type protoContext struct {
 	fs           afero.Fs
 	messageClass *goclass.Class
+	streamClass  *goclass.Class
+	connClass    *goclass.Class
 	luaCtx       *luacontext.Context
 }
 
@@ -26,9 +35,13 @@ func Open(L *lua.LState, luaCtx *luacontext.Context, fs afero.Fs) {
 	ud.Value = &protoContext{
 		fs:           fs,
 		messageClass: goclass.New(L, messageMetaName, messageFuncs),
+		streamClass:  goclass.New(L, streamMetaName, streamFuncs),
+		connClass:    goclass.New(L, connMetaName, connFuncs),
 		luaCtx:       luaCtx,
 	}
 	mod.RawSetString("load", L.NewClosure(protoLoad, ud))
+	mod.RawSetString("load_descriptor_set", L.NewClosure(protoLoadDescriptorSet, ud))
+	mod.RawSetString("reflect", L.NewClosure(protoReflect, ud))
 	mod.RawSetString("dial", L.NewClosure(protoDial, ud))
 }
 
@@ -68,6 +81,85 @@ func protoLoad(L *lua.LState) int {
 		L.RaiseError(err.Error())
 	}
 
+	return c.pushFiles(L, fileDescs)
+}
+
+// protoLoadDescriptorSet loads a FileDescriptorSet compiled by `protoc --include_imports -o set.pb`
+func protoLoadDescriptorSet(L *lua.LState) int {
+	c := L.CheckUserData(lua.UpvalueIndex(1)).Value.(*protoContext)
+	path := L.CheckString(2)
+
+	b, err := afero.ReadFile(c.fs, path)
+	if err != nil {
+		L.RaiseError(err.Error())
+	}
+	set := &dpb.FileDescriptorSet{}
+	if err := proto.Unmarshal(b, set); err != nil {
+		L.RaiseError("unable to decode descriptor set %s: %s", path, err)
+	}
+	files, err := protodesc.CreateFileDescriptorsFromSet(set)
+	if err != nil {
+		L.RaiseError(err.Error())
+	}
+
+	fileDescs := make([]*protodesc.FileDescriptor, 0, len(files))
+	for _, file := range set.GetFile() {
+		fileDescs = append(fileDescs, files[file.GetName()])
+	}
+	return c.pushFiles(L, fileDescs)
+}
+
+// protoReflect loads services served by a connection through server reflection, along with messages they depend on
+func protoReflect(L *lua.LState) int {
+	c := L.CheckUserData(lua.UpvalueIndex(1)).Value.(*protoContext)
+	gc, ok := L.CheckUserData(2).Value.(*grpcClientConnContext)
+	if !ok {
+		L.RaiseError("expected a grpc connection")
+	}
+
+	return libasync.DeferredResult(L, c.luaCtx.AsyncPool(), func(ctx context.Context) (lua.LGFunction, error) {
+		client := grpcreflect.NewClient(ctx, rpb.NewServerReflectionClient(gc.cc))
+		defer client.Reset()
+
+		names, err := client.ListServices()
+		if err != nil {
+			return nil, err
+		}
+		var fileDescs []*protodesc.FileDescriptor
+		for _, name := range names {
+			desc, err := client.ResolveService(name)
+			if err != nil {
+				return nil, err
+			}
+			fileDescs = append(fileDescs, desc.GetFile())
+		}
+		return func(L *lua.LState) int {
+			return c.pushFiles(L, withDependencies(fileDescs))
+		}, nil
+	})
+}
+
+// withDependencies returns files and their transitive dependencies, each file is returned once
+func withDependencies(files []*protodesc.FileDescriptor) []*protodesc.FileDescriptor {
+	var all []*protodesc.FileDescriptor
+	seen := map[string]bool{}
+	var add func(files []*protodesc.FileDescriptor)
+	add = func(files []*protodesc.FileDescriptor) {
+		for _, file := range files {
+			if seen[file.GetName()] {
+				continue
+			}
+			seen[file.GetName()] = true
+			all = append(all, file)
+			add(file.GetDependencies())
+		}
+	}
+	add(files)
+	return all
+}
+
+// pushFiles pushes tables of messages and services defined in files, keyed by full name
+func (c *protoContext) pushFiles(L *lua.LState, fileDescs []*protodesc.FileDescriptor) int {
 	services := L.NewTable()
 	messages := L.NewTable()
 	for _, fileDesc := range fileDescs {
@@ -75,7 +167,7 @@ func protoLoad(L *lua.LState) int {
 			messages.RawSetString(desc.GetFullyQualifiedName(), c.messageClass.New(L, &messageContext{desc: desc, luaCtx: c.luaCtx}))
 		}
 		for _, desc := range fileDesc.GetServices() {
-			services.RawSetString(desc.GetFullyQualifiedName(), newService(L, c.luaCtx, desc))
+			services.RawSetString(desc.GetFullyQualifiedName(), newService(L, c.luaCtx, desc, c.streamClass))
 		}
 	}
 
@@ -0,0 +1,70 @@
+package proto_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	protodesc "github.com/jhump/protoreflect/desc"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	lua "github.com/yuin/gopher-lua"
+
+	luacontext "github.com/joesonw/lte/pkg/lua/context"
+	libproto "github.com/joesonw/lte/pkg/lua/lib/proto"
+	test_util "github.com/joesonw/lte/pkg/lua/test-util"
+)
+
+func TestReflect(t *testing.T) {
+	addr := startItemsServer(t)
+	test_util.Run(t, func(t *testing.T) *test_util.Test {
+		return test_util.New("reflect", fmt.Sprintf(`
+			local proto = require "proto"
+			local _, cc = proto:dial("%s", { insecure = true })()
+			local reflectErr, messages, services = proto:reflect(cc)()
+			assert(reflectErr == nil, reflectErr)
+			hasReflection = services["grpc.reflection.v1alpha.ServerReflection"] ~= nil
+			err, res = services["test.Items"]:new(cc):Get({ name = "a", n = 1 })()
+			decoded = messages["test.Item"]:decode(messages["test.Item"]:encode({ name = "b" }))
+		`, addr)).
+			Before(func(t *testing.T, L *lua.LState, luaCtx *luacontext.Context) {
+				libproto.Open(L, luaCtx, newItemsFs(t))
+			}).
+			After(func(t *testing.T, L *lua.LState) {
+				assert.Equal(t, lua.LTrue, L.GetGlobal("hasReflection"))
+				assert.Equal(t, lua.LNil, L.GetGlobal("err"))
+				assert.Equal(t, lua.LNumber(2), L.GetField(L.GetGlobal("res"), "n"))
+				assert.Equal(t, "b", L.GetField(L.GetGlobal("decoded"), "name").String())
+			})
+	})
+}
+
+func TestLoadDescriptorSet(t *testing.T) {
+	addr := startItemsServer(t)
+	fs := newItemsFs(t)
+	b, err := proto.Marshal(protodesc.ToFileDescriptorSet(newItemsService(t).GetFile()))
+	assert.Nil(t, err)
+	assert.Nil(t, afero.WriteFile(fs, "items.pb", b, 0644))
+	assert.Nil(t, afero.WriteFile(fs, "broken.pb", []byte("not a descriptor set"), 0644))
+
+	test_util.Run(t, func(t *testing.T) *test_util.Test {
+		return test_util.New("load descriptor set", fmt.Sprintf(`
+			local proto = require "proto"
+			local messages, services = proto:load_descriptor_set("items.pb")
+			local _, cc = proto:dial("%s", { insecure = true })()
+			err, res = services["test.Items"]:new(cc):Get({ name = "a", n = 1 })()
+			hasItem = messages["test.Item"] ~= nil
+			ok, loadErr = pcall(function() proto:load_descriptor_set("broken.pb") end)
+		`, addr)).
+			Before(func(t *testing.T, L *lua.LState, luaCtx *luacontext.Context) {
+				libproto.Open(L, luaCtx, fs)
+			}).
+			After(func(t *testing.T, L *lua.LState) {
+				assert.Equal(t, lua.LNil, L.GetGlobal("err"))
+				assert.Equal(t, lua.LNumber(2), L.GetField(L.GetGlobal("res"), "n"))
+				assert.Equal(t, lua.LTrue, L.GetGlobal("hasItem"))
+				assert.Equal(t, lua.LFalse, L.GetGlobal("ok"))
+				assert.Contains(t, L.GetGlobal("loadErr").String(), "unable to decode descriptor set broken.pb")
+			})
+	})
+}
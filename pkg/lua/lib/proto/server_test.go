@@ -0,0 +1,237 @@
+package proto_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	protodesc "github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/desc/protoparse"
+	"github.com/jhump/protoreflect/dynamic"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/stats"
+	"google.golang.org/grpc/status"
+)
+
+const itemsProto = `
+syntax = "proto3";
+
+package test;
+
+message Item {
+	string name = 1;
+	int32 n = 2;
+}
+
+message Sum {
+	int32 total = 1;
+	int32 count = 2;
+}
+
+service Items {
+	rpc Get(Item) returns (Item);
+	rpc List(Item) returns (stream Item);
+	rpc Add(stream Item) returns (Sum);
+	rpc Echo(stream Item) returns (stream Item);
+}
+`
+
+// newItemsFs returns a filesystem with items.proto loaded by scripts
+func newItemsFs(t *testing.T) afero.Fs {
+	fs := afero.NewMemMapFs()
+	assert.Nil(t, afero.WriteFile(fs, "items.proto", []byte(itemsProto), 0644))
+	return fs
+}
+
+// connCounter counts connections accepted and closed by a server
+type connCounter struct {
+	begun int64
+	ended int64
+}
+
+func (c *connCounter) TagRPC(ctx context.Context, _ *stats.RPCTagInfo) context.Context {
+	return ctx
+}
+
+func (c *connCounter) HandleRPC(context.Context, stats.RPCStats) {}
+
+func (c *connCounter) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+func (c *connCounter) HandleConn(_ context.Context, s stats.ConnStats) {
+	switch s.(type) {
+	case *stats.ConnBegin:
+		atomic.AddInt64(&c.begun, 1)
+	case *stats.ConnEnd:
+		atomic.AddInt64(&c.ended, 1)
+	}
+}
+
+// itemsServer serves test.Items with dynamic messages
+type itemsServer struct {
+	service *protodesc.ServiceDescriptor
+}
+
+func newItemsService(t *testing.T) *protodesc.ServiceDescriptor {
+	parser := protoparse.Parser{
+		Accessor: protoparse.FileContentsFromMap(map[string]string{"items.proto": itemsProto}),
+	}
+	files, err := parser.ParseFiles("items.proto")
+	assert.Nil(t, err)
+	return files[0].FindService("test.Items")
+}
+
+// startItemsServer listens on a random local port, the server is stopped once the test finishes
+func startItemsServer(t *testing.T, opts ...grpc.ServerOption) string {
+	s := &itemsServer{service: newItemsService(t)}
+	server := grpc.NewServer(opts...)
+	desc := s.serviceDesc()
+	desc.Metadata = s.encodedFile(t)
+	server.RegisterService(desc, s)
+	reflection.Register(server)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	go server.Serve(lis) //nolint:errcheck
+	t.Cleanup(server.Stop)
+	return lis.Addr().String()
+}
+
+// encodedFile returns gzipped descriptor of items.proto, which is served by server reflection as metadata of the
+// service
+func (s *itemsServer) encodedFile(t *testing.T) []byte {
+	b, err := proto.Marshal(s.service.GetFile().AsFileDescriptorProto())
+	assert.Nil(t, err)
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err = w.Write(b)
+	assert.Nil(t, err)
+	assert.Nil(t, w.Close())
+	return buf.Bytes()
+}
+
+func (s *itemsServer) serviceDesc() *grpc.ServiceDesc {
+	return &grpc.ServiceDesc{
+		ServiceName: s.service.GetFullyQualifiedName(),
+		HandlerType: (*interface{})(nil),
+		Methods: []grpc.MethodDesc{{
+			MethodName: "Get",
+			Handler: func(_ interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+				req := s.newMessage("Item")
+				if err := dec(req); err != nil {
+					return nil, err
+				}
+				// authorization is echoed in header, subject of client certificate as well if any
+				header := metadata.MD{}
+				if md, ok := metadata.FromIncomingContext(ctx); ok {
+					header.Set("authorization", md.Get("authorization")...)
+				}
+				if p, ok := peer.FromContext(ctx); ok {
+					if info, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(info.State.PeerCertificates) > 0 {
+						header.Set("client", info.State.PeerCertificates[0].Subject.CommonName)
+					}
+				}
+				if err := grpc.SetHeader(ctx, header); err != nil {
+					return nil, err
+				}
+				if err := grpc.SetTrailer(ctx, metadata.Pairs("served-by", "items")); err != nil {
+					return nil, err
+				}
+
+				name := req.GetFieldByName("name").(string)
+				switch name {
+				case "fail":
+					st, err := status.New(codes.NotFound, "no item fail").WithDetails(s.item(name, 404))
+					if err != nil {
+						return nil, err
+					}
+					return nil, st.Err()
+				case "slow":
+					<-ctx.Done()
+					return nil, ctx.Err()
+				}
+				return s.item(name, req.GetFieldByName("n").(int32)+1), nil
+			},
+		}},
+		Streams: []grpc.StreamDesc{{
+			StreamName:    "List",
+			ServerStreams: true,
+			Handler: func(_ interface{}, stream grpc.ServerStream) error {
+				req := s.newMessage("Item")
+				if err := stream.RecvMsg(req); err != nil {
+					return err
+				}
+				name := req.GetFieldByName("name").(string)
+				stream.SetTrailer(metadata.Pairs("count", fmt.Sprint(req.GetFieldByName("n"))))
+				for i := int32(0); i < req.GetFieldByName("n").(int32); i++ {
+					if err := stream.SendMsg(s.item(fmt.Sprintf("%s%d", name, i), i)); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		}, {
+			StreamName:    "Add",
+			ClientStreams: true,
+			Handler: func(_ interface{}, stream grpc.ServerStream) error {
+				var total, count int32
+				for {
+					req := s.newMessage("Item")
+					if err := stream.RecvMsg(req); err == io.EOF {
+						break
+					} else if err != nil {
+						return err
+					}
+					total += req.GetFieldByName("n").(int32)
+					count++
+				}
+				sum := s.newMessage("Sum")
+				sum.SetFieldByName("total", total)
+				sum.SetFieldByName("count", count)
+				return stream.SendMsg(sum)
+			},
+		}, {
+			StreamName:    "Echo",
+			ServerStreams: true,
+			ClientStreams: true,
+			Handler: func(_ interface{}, stream grpc.ServerStream) error {
+				for {
+					req := s.newMessage("Item")
+					if err := stream.RecvMsg(req); err == io.EOF {
+						return nil
+					} else if err != nil {
+						return err
+					}
+					if err := stream.SendMsg(req); err != nil {
+						return err
+					}
+				}
+			},
+		}},
+	}
+}
+
+func (s *itemsServer) newMessage(name string) *dynamic.Message {
+	return dynamic.NewMessage(s.service.GetFile().FindMessage("test." + name))
+}
+
+func (s *itemsServer) item(name string, n int32) *dynamic.Message {
+	m := s.newMessage("Item")
+	m.SetFieldByName("name", name)
+	m.SetFieldByName("n", n)
+	return m
+}
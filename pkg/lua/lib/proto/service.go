@@ -6,18 +6,21 @@ import (
 	lua "github.com/yuin/gopher-lua"
 
 	luacontext "github.com/joesonw/lte/pkg/lua/context"
+	goclass "github.com/joesonw/lte/pkg/lua/lib/go-class"
 )
 
 type serviceContext struct {
-	desc   *protodesc.ServiceDescriptor
-	luaCtx *luacontext.Context
+	desc        *protodesc.ServiceDescriptor
+	streamClass *goclass.Class
+	luaCtx      *luacontext.Context
 }
 
-func newService(L *lua.LState, luaCtx *luacontext.Context, desc *protodesc.ServiceDescriptor) lua.LValue {
+func newService(L *lua.LState, luaCtx *luacontext.Context, desc *protodesc.ServiceDescriptor, streamClass *goclass.Class) lua.LValue {
 	ud := L.NewUserData()
 	ud.Value = &serviceContext{
-		desc:   desc,
-		luaCtx: luaCtx,
+		desc:        desc,
+		streamClass: streamClass,
+		luaCtx:      luaCtx,
 	}
 
 	index := L.NewTable()
@@ -38,6 +41,6 @@ func serviceNew(L *lua.LState) int {
 	}
 
 	client := grpcdynamic.NewStub(gc.cc)
-	L.Push(newServiceClient(L, c.luaCtx, c.desc, client))
+	L.Push(newServiceClient(L, c.luaCtx, c.desc, c.streamClass, client))
 	return 1
 }
@@ -0,0 +1,288 @@
+package proto
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	protodesc "github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic/grpcdynamic"
+	lua "github.com/yuin/gopher-lua"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	luacontext "github.com/joesonw/lte/pkg/lua/context"
+	libasync "github.com/joesonw/lte/pkg/lua/lib/async"
+	libpool "github.com/joesonw/lte/pkg/lua/lib/pool"
+	luautil "github.com/joesonw/lte/pkg/lua/util"
+	"github.com/joesonw/lte/pkg/stat"
+)
+
+const streamMetaName = "*PROTO*STREAM*"
+
+var streamFuncs = map[string]lua.LGFunction{
+	"send":       streamSend,
+	"recv":       streamRecv,
+	"close_send": streamCloseSend,
+	"close":      streamClose,
+}
+
+// streamContext is a server, client or bidi streaming call, functions not supported by the kind of stream are nil
+type streamContext struct {
+	method *protodesc.MethodDescriptor
+	luaCtx *luacontext.Context
+	cancel context.CancelFunc
+	guard  *libpool.Guard
+	start  time.Time
+
+	send      func(proto.Message) error
+	recv      func() (proto.Message, error)
+	closeSend func() error
+	header    func() (metadata.MD, error)
+	trailer   func() metadata.MD
+
+	sent     int64
+	received int64
+	// closed is set once the stream is closed by lua or released, grpc may still accept messages buffered then
+	closed     int32
+	reportOnce *sync.Once
+}
+
+var errStreamClosed = errors.New("stream is closed")
+
+// openStream starts a streaming call of method, req is sent by server streams. Once opened, the stream lives until it
+// is closed, ended, timed out by opts or the resource pool is cleaned, regardless of ctx
+func openStream(ctx context.Context, stub grpcdynamic.Stub, luaCtx *luacontext.Context, method *protodesc.MethodDescriptor, req proto.Message, opts *callOptions) (*streamContext, error) {
+	streamCtx, cancel := opts.context(context.Background())
+	c := &streamContext{
+		method:     method,
+		luaCtx:     luaCtx,
+		cancel:     cancel,
+		start:      time.Now(),
+		reportOnce: &sync.Once{},
+	}
+	stop := c.interruptOnDone(ctx)
+	defer stop()
+
+	switch {
+	case method.IsServerStreaming() && method.IsClientStreaming():
+		s, err := stub.InvokeRpcBidiStream(streamCtx, method, opts.grpcOptions()...)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		c.header = s.Header
+		c.trailer = s.Trailer
+		c.send = s.SendMsg
+		c.recv = s.RecvMsg
+		c.closeSend = s.CloseSend
+	case method.IsServerStreaming():
+		s, err := stub.InvokeRpcServerStream(streamCtx, method, req, opts.grpcOptions()...)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		c.header = s.Header
+		c.trailer = s.Trailer
+		c.recv = s.RecvMsg
+	default:
+		s, err := stub.InvokeRpcClientStream(streamCtx, method, opts.grpcOptions()...)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		c.header = s.Header
+		c.trailer = s.Trailer
+		// the only response of a client stream is received by closing it, recv returns it and then ends
+		var res proto.Message
+		var resErr error
+		closeOnce := &sync.Once{}
+		recvOnce := &sync.Once{}
+		c.send = s.SendMsg
+		c.closeSend = func() error {
+			closeOnce.Do(func() {
+				res, resErr = s.CloseAndReceive()
+			})
+			return resErr
+		}
+		c.recv = func() (proto.Message, error) {
+			if err := c.closeSend(); err != nil {
+				return nil, err
+			}
+			var m proto.Message
+			recvOnce.Do(func() {
+				m = res
+			})
+			if m == nil {
+				return nil, io.EOF
+			}
+			return m, nil
+		}
+	}
+
+	c.guard = luaCtx.ReleasePool().Watch(libpool.NewReleaseFunc("grpc stream "+method.GetFullyQualifiedName(), func() error {
+		atomic.StoreInt32(&c.closed, 1)
+		c.end(context.Background(), nil, true)
+		return nil
+	}))
+	return c, nil
+}
+
+func (c *streamContext) newStat(name string) *stat.Stat {
+	return stat.New(name).
+		Tag("service", c.method.GetService().GetFullyQualifiedName()).
+		Tag("method", c.method.GetFullyQualifiedName())
+}
+
+// end cancels the stream and reports it once, err is the error ending the stream if any. released tells the stream
+// is released by the resource pool rather than closed or ended
+func (c *streamContext) end(ctx context.Context, err error, released bool) {
+	c.reportOnce.Do(func() {
+		if !released {
+			c.guard.Done()
+		}
+		c.cancel()
+		s := c.newStat("grpc_stream").
+			Int64Field("duration_ns", time.Since(c.start).Nanoseconds()).
+			Int64Field("sent", atomic.LoadInt64(&c.sent)).
+			Int64Field("received", atomic.LoadInt64(&c.received))
+		if err != nil {
+			luautil.FailStat(ctx, s.Tag("code", status.Code(err).String()), err)
+		} else {
+			s.Int64Field("success", 1)
+		}
+		luautil.ReportContextStat(c.luaCtx, s)
+	})
+}
+
+// meta pushes nil in place of a message and meta of the stream ended by err, nil if it ended successfully
+func (c *streamContext) meta(err error) lua.LGFunction {
+	meta := &callMeta{err: err, file: c.method.GetFile()}
+	// header returns immediately as the stream has ended
+	meta.header, _ = c.header()
+	meta.trailer = c.trailer()
+	return func(L *lua.LState) int {
+		L.Push(lua.LNil)
+		meta.push(L)
+		return 2
+	}
+}
+
+// interruptOnDone cancels the stream once ctx is done, since blocking send and recv return only then
+func (c *streamContext) interruptOnDone(ctx context.Context) (stop func()) {
+	chStop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			// ctx of a task is cancelled once it finishes as well, which must not cancel the stream
+			select {
+			case <-chStop:
+			default:
+				c.cancel()
+			}
+		case <-chStop:
+		}
+	}()
+	return func() {
+		close(chStop)
+	}
+}
+
+func streamSend(L *lua.LState) int {
+	c := L.CheckUserData(1).Value.(*streamContext)
+	if c.send == nil {
+		L.RaiseError("%s is not a client stream", c.method.GetFullyQualifiedName())
+	}
+	req, err := tableToMessage(c.method.GetInputType(), L.CheckTable(2))
+	if err != nil {
+		L.RaiseError(err.Error())
+	}
+
+	return libasync.Deferred(L, c.luaCtx.AsyncPool(), func(ctx context.Context) error {
+		defer c.interruptOnDone(ctx)()
+		s := c.newStat("grpc_message").Tag("direction", "send").IntField("size", proto.Size(req))
+		defer luautil.ReportContextStat(c.luaCtx, s)
+
+		start := time.Now()
+		if atomic.LoadInt32(&c.closed) == 1 {
+			luautil.FailStat(ctx, s, errStreamClosed)
+			return errStreamClosed
+		}
+		if err := c.send(req); err != nil {
+			luautil.FailStat(ctx, s, err)
+			c.end(ctx, err, false)
+			return err
+		}
+		atomic.AddInt64(&c.sent, 1)
+		s.Int64Field("duration_ns", time.Since(start).Nanoseconds()).Int64Field("success", 1)
+		return nil
+	})
+}
+
+func streamRecv(L *lua.LState) int {
+	c := L.CheckUserData(1).Value.(*streamContext)
+	return libasync.DeferredResult(L, c.luaCtx.AsyncPool(), func(ctx context.Context) (lua.LGFunction, error) {
+		defer c.interruptOnDone(ctx)()
+		if atomic.LoadInt32(&c.closed) == 1 {
+			return nil, errStreamClosed
+		}
+		start := time.Now()
+		res, err := c.recv()
+		if err == io.EOF {
+			c.end(ctx, nil, false)
+			return c.meta(nil), nil
+		}
+
+		s := c.newStat("grpc_message").Tag("direction", "recv")
+		defer luautil.ReportContextStat(c.luaCtx, s)
+		if err != nil {
+			luautil.FailStat(ctx, s, err)
+			c.end(ctx, err, false)
+			return c.meta(err), err
+		}
+		atomic.AddInt64(&c.received, 1)
+		s.Int64Field("duration_ns", time.Since(start).Nanoseconds()).
+			IntField("size", proto.Size(res)).
+			Int64Field("success", 1)
+
+		return func(L *lua.LState) int {
+			val, err := messageToLua(L, res)
+			if err != nil {
+				L.RaiseError(err.Error())
+			}
+			L.Push(val)
+			return 1
+		}, nil
+	})
+}
+
+func streamCloseSend(L *lua.LState) int {
+	c := L.CheckUserData(1).Value.(*streamContext)
+	if c.closeSend == nil {
+		L.RaiseError("%s is not a client stream", c.method.GetFullyQualifiedName())
+	}
+	return libasync.Deferred(L, c.luaCtx.AsyncPool(), func(ctx context.Context) error {
+		defer c.interruptOnDone(ctx)()
+		if atomic.LoadInt32(&c.closed) == 1 {
+			return errStreamClosed
+		}
+		if err := c.closeSend(); err != nil {
+			c.end(ctx, err, false)
+			return err
+		}
+		return nil
+	})
+}
+
+func streamClose(L *lua.LState) int {
+	c := L.CheckUserData(1).Value.(*streamContext)
+	return libasync.Deferred(L, c.luaCtx.AsyncPool(), func(ctx context.Context) error {
+		atomic.StoreInt32(&c.closed, 1)
+		c.end(ctx, nil, false)
+		return nil
+	})
+}
@@ -0,0 +1,164 @@
+package shared
+
+import (
+	"context"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+
+	luacontext "github.com/joesonw/lte/pkg/lua/context"
+	libasync "github.com/joesonw/lte/pkg/lua/lib/async"
+	libjson "github.com/joesonw/lte/pkg/lua/lib/json"
+)
+
+const (
+	moduleName = "shared"
+	uniqueName = "lib/shared"
+)
+
+type sharedContext struct {
+	store  *store
+	luaCtx *luacontext.Context
+}
+
+// Open registers module `shared`, state is shared by all vms of a job through Global, e.g.
+//
+//	local id = shared:incr("order_id")
+//	shared:set("token", { value = "abc" })
+//	local ok = shared:cas("leader", nil, id)
+//	shared:push("orders", { id = id })
+//	local err, order = shared:pop("orders", 1000)()
+//
+// Values are copied as json, so functions and userdata can not be shared.
+func Open(L *lua.LState, luaCtx *luacontext.Context) {
+	ud := L.NewUserData()
+	ud.Value = &sharedContext{
+		store: luaCtx.Global().Unique(uniqueName, func() interface{} {
+			return newStore()
+		}).(*store),
+		luaCtx: luaCtx,
+	}
+
+	mod := L.RegisterModule(moduleName, map[string]lua.LGFunction{}).(*lua.LTable)
+	for name, f := range funcs {
+		mod.RawSetString(name, L.NewClosure(f, ud))
+	}
+}
+
+var funcs = map[string]lua.LGFunction{
+	"incr":    lIncr,
+	"counter": lCounter,
+	"get":     lGet,
+	"set":     lSet,
+	"delete":  lDelete,
+	"cas":     lCAS,
+	"push":    lPush,
+	"pop":     lPop,
+	"size":    lSize,
+}
+
+func upContext(L *lua.LState) *sharedContext {
+	return L.CheckUserData(lua.UpvalueIndex(1)).Value.(*sharedContext)
+}
+
+// encode marshals value as json, nil is kept as nil
+func encode(L *lua.LState, value lua.LValue) []byte {
+	if value == lua.LNil {
+		return nil
+	}
+	b, err := libjson.Marshal(value)
+	if err != nil {
+		L.RaiseError(err.Error())
+	}
+	return b
+}
+
+func decode(L *lua.LState, b []byte) lua.LValue {
+	if b == nil {
+		return lua.LNil
+	}
+	value, err := libjson.Unmarshal(L, b)
+	if err != nil {
+		L.RaiseError(err.Error())
+	}
+	return value
+}
+
+// lIncr adds delta (1 by default) to counter name, returns the new value
+func lIncr(L *lua.LState) int {
+	c := upContext(L)
+	name := L.CheckString(2)
+	delta := L.OptInt64(3, 1)
+	L.Push(lua.LNumber(c.store.incr(name, delta)))
+	return 1
+}
+
+func lCounter(L *lua.LState) int {
+	c := upContext(L)
+	L.Push(lua.LNumber(c.store.counter(L.CheckString(2))))
+	return 1
+}
+
+func lGet(L *lua.LState) int {
+	c := upContext(L)
+	L.Push(decode(L, c.store.get(L.CheckString(2))))
+	return 1
+}
+
+func lSet(L *lua.LState) int {
+	c := upContext(L)
+	c.store.set(L.CheckString(2), encode(L, L.Get(3)))
+	return 0
+}
+
+func lDelete(L *lua.LState) int {
+	c := upContext(L)
+	c.store.set(L.CheckString(2), nil)
+	return 0
+}
+
+// lCAS sets key to new value only if current value equals old, nil old means key is absent, returns if it is set
+func lCAS(L *lua.LState) int {
+	c := upContext(L)
+	key := L.CheckString(2)
+	old := encode(L, L.Get(3))
+	value := encode(L, L.Get(4))
+	L.Push(lua.LBool(c.store.cas(key, old, value)))
+	return 1
+}
+
+// lPush appends value to queue, returns length of the queue
+func lPush(L *lua.LState) int {
+	c := upContext(L)
+	name := L.CheckString(2)
+	value := L.CheckAny(3)
+	if value == lua.LNil {
+		L.ArgError(3, "value can not be nil")
+	}
+	L.Push(lua.LNumber(c.store.push(name, encode(L, value))))
+	return 1
+}
+
+// lPop returns a deferred of the first value of queue, it waits up to timeout milliseconds (0 for no timeout) for a value.
+// Consumers do not take workers of the async pool, nor are they bounded by its timeout
+func lPop(L *lua.LState) int {
+	c := upContext(L)
+	name := L.CheckString(2)
+	timeout := time.Duration(L.OptInt64(3, 0)) * time.Millisecond
+	return libasync.DeferredResultWait(L, c.luaCtx.AsyncPool(), func(ctx context.Context) (lua.LGFunction, error) {
+		b, err := c.store.pop(ctx, name, timeout)
+		if err != nil {
+			return nil, err
+		}
+		return func(L *lua.LState) int {
+			L.Push(decode(L, b))
+			return 1
+		}, nil
+	})
+}
+
+func lSize(L *lua.LState) int {
+	c := upContext(L)
+	L.Push(lua.LNumber(c.store.size(L.CheckString(2))))
+	return 1
+}
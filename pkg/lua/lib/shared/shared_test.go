@@ -0,0 +1,120 @@
+package shared_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	lua "github.com/yuin/gopher-lua"
+	"go.uber.org/zap"
+
+	luacontext "github.com/joesonw/lte/pkg/lua/context"
+	libpool "github.com/joesonw/lte/pkg/lua/lib/pool"
+	libshared "github.com/joesonw/lte/pkg/lua/lib/shared"
+	test_util "github.com/joesonw/lte/pkg/lua/test-util"
+)
+
+// openPeer opens module shared in another state sharing global of luaCtx, as another vm of the job
+func openPeer(t *testing.T, luaCtx *luacontext.Context) *lua.LState {
+	L := lua.NewState()
+	asyncPool := libpool.NewAsync(zap.NewNop(), 1, 0, 1)
+	asyncPool.Start()
+	t.Cleanup(func() {
+		asyncPool.Stop()
+		L.Close()
+	})
+	peerCtx := luacontext.New(L, luaCtx.Global(), libpool.NewRelease(zap.NewNop()), asyncPool, zap.NewNop())
+	libshared.Open(L, peerCtx)
+	return L
+}
+
+func Test(t *testing.T) {
+	test_util.Run(t,
+		func(t *testing.T) *test_util.Test {
+			return test_util.New("counter", `
+				local shared = require "shared"
+				assert(shared:incr("id") == 1)
+				assert(shared:incr("id", 10) == 11)
+				assert(shared:counter("id") == 11)
+				assert(shared:counter("unknown") == 0)
+			`).Before(func(t *testing.T, L *lua.LState, luaCtx *luacontext.Context) {
+				libshared.Open(L, luaCtx)
+			})
+		},
+		func(t *testing.T) *test_util.Test {
+			return test_util.New("kv", `
+				local shared = require "shared"
+				assert(shared:get("a") == nil)
+				shared:set("a", { name = "lte", n = 1 })
+				assert(shared:get("a").name == "lte")
+				assert(shared:cas("b", nil, "first"))
+				assert(not shared:cas("b", nil, "second"))
+				assert(not shared:cas("b", "second", "third"))
+				assert(shared:cas("b", "first", "third"))
+				assert(shared:get("b") == "third")
+				shared:delete("b")
+				assert(shared:get("b") == nil)
+			`).Before(func(t *testing.T, L *lua.LState, luaCtx *luacontext.Context) {
+				libshared.Open(L, luaCtx)
+			})
+		},
+		func(t *testing.T) *test_util.Test {
+			return test_util.New("queue", `
+				local shared = require "shared"
+				local pending = shared:pop("orders", 1000)
+				assert(shared:push("orders", { id = 1 }) >= 0)
+				local err, order = pending()
+				assert(err == nil, err)
+				assert(order.id == 1)
+
+				shared:push("orders", 2)
+				shared:push("orders", 3)
+				assert(shared:size("orders") == 2)
+				local _, a = shared:pop("orders")()
+				local _, b = shared:pop("orders")()
+				assert(a == 2 and b == 3)
+
+				err = shared:pop("orders", 10)()
+				assert(err == "timeout")
+
+				-- waiting consumers do not hold workers of the async pool, there are fewer of them
+				local consumers = {}
+				for i = 1, 6 do
+					consumers[i] = shared:pop("idle")
+				end
+				assert(shared:pop("orders", 10)() == "timeout")
+				for i = 1, 6 do
+					shared:push("idle", i)
+				end
+				for i = 1, 6 do
+					local err = consumers[i]()
+					assert(err == nil, err)
+				end
+			`).Before(func(t *testing.T, L *lua.LState, luaCtx *luacontext.Context) {
+				libshared.Open(L, luaCtx)
+			})
+		},
+		func(t *testing.T) *test_util.Test {
+			return test_util.New("across vms", `
+				local shared = require "shared"
+				shared:incr("id")
+				local err, token = shared:pop("tokens", 1000)()
+				assert(err == nil, err)
+				assert(token == "from peer")
+			`).Before(func(t *testing.T, L *lua.LState, luaCtx *luacontext.Context) {
+				libshared.Open(L, luaCtx)
+				peer := openPeer(t, luaCtx)
+				assert.Nil(t, peer.DoString(`assert(require("shared"):incr("id") == 1)`))
+				chDone := make(chan struct{})
+				t.Cleanup(func() { <-chDone })
+				go func() {
+					defer close(chDone)
+					time.Sleep(time.Millisecond * 20)
+					_ = peer.DoString(`require("shared"):push("tokens", "from peer")`)
+				}()
+			}).After(func(t *testing.T, L *lua.LState) {
+				assert.Nil(t, L.DoString(`assert(require("shared"):counter("id") == 2)`))
+			})
+		},
+	)
+}
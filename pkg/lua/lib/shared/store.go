@@ -0,0 +1,136 @@
+package shared
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var errTimeout = errors.New("timeout")
+
+// store holds values shared by all vms of a job, values are kept as json so they can be decoded into any lua state
+type store struct {
+	mu       *sync.Mutex
+	counters map[string]int64
+	values   map[string][]byte
+	queues   map[string]*queue
+}
+
+type queue struct {
+	items [][]byte
+	// chPushed is closed and replaced on every push to wake up blocked pops
+	chPushed chan struct{}
+}
+
+func newStore() *store {
+	return &store{
+		mu:       &sync.Mutex{},
+		counters: map[string]int64{},
+		values:   map[string][]byte{},
+		queues:   map[string]*queue{},
+	}
+}
+
+func (s *store) incr(name string, delta int64) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.counters[name] += delta
+	return s.counters[name]
+}
+
+func (s *store) counter(name string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.counters[name]
+}
+
+func (s *store) get(key string) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.values[key]
+}
+
+// set stores value, nil deletes key
+func (s *store) set(key string, value []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if value == nil {
+		delete(s.values, key)
+		return
+	}
+	s.values[key] = value
+}
+
+// cas sets key to value only if its current value is old, nil old means key is absent and nil value deletes key
+func (s *store) cas(key string, old, value []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current, ok := s.values[key]
+	if (old == nil && ok) || (old != nil && !bytes.Equal(current, old)) {
+		return false
+	}
+	if value == nil {
+		delete(s.values, key)
+	} else {
+		s.values[key] = value
+	}
+	return true
+}
+
+func (s *store) queueLocked(name string) *queue {
+	q := s.queues[name]
+	if q == nil {
+		q = &queue{chPushed: make(chan struct{})}
+		s.queues[name] = q
+	}
+	return q
+}
+
+func (s *store) push(name string, value []byte) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q := s.queueLocked(name)
+	q.items = append(q.items, value)
+	close(q.chPushed)
+	q.chPushed = make(chan struct{})
+	return len(q.items)
+}
+
+func (s *store) size(name string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.queueLocked(name).items)
+}
+
+// pop removes the first item of queue, it blocks until an item is pushed, ctx is done or timeout, 0 for no timeout
+func (s *store) pop(ctx context.Context, name string, timeout time.Duration) ([]byte, error) {
+	var chTimeout <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		chTimeout = timer.C
+	}
+
+	for {
+		s.mu.Lock()
+		q := s.queueLocked(name)
+		if len(q.items) > 0 {
+			item := q.items[0]
+			q.items = q.items[1:]
+			s.mu.Unlock()
+			return item, nil
+		}
+		chPushed := q.chPushed
+		s.mu.Unlock()
+
+		select {
+		case <-chPushed:
+		case <-chTimeout:
+			return nil, errTimeout
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
@@ -15,6 +15,7 @@ import (
 	libpool "github.com/joesonw/lte/pkg/lua/lib/pool"
 	luautil "github.com/joesonw/lte/pkg/lua/util"
 	"github.com/joesonw/lte/pkg/stat"
+	goutil "github.com/joesonw/lte/pkg/util"
 )
 
 const connMetaName = "*WEBSOCKET*CONN*"
@@ -37,6 +38,7 @@ var connFuncs = map[string]lua.LGFunction{
 func connRead(L *lua.LState) int {
 	c := L.CheckUserData(1).Value.(*connContext)
 	return libasync.DeferredResult(L, c.luaCtx.AsyncPool(), func(ctx context.Context) (lua.LGFunction, error) {
+		defer goutil.InterruptOnDone(ctx, c.conn)()
 		if c.br != nil {
 			messages, err := wsutil.ReadServerMessage(c.br, nil)
 			ws.PutReader(c.br)
@@ -79,6 +81,7 @@ func connWrite(L *lua.LState) int {
 	bytes := libbytes.Check(L, 2)
 	luautil.ReportContextStat(c.luaCtx, stat.New("websocket").Tag("addr", c.addr).IntField("write", len(bytes)))
 	return libasync.Deferred(L, c.luaCtx.AsyncPool(), func(ctx context.Context) error {
+		defer goutil.InterruptOnDone(ctx, c.conn)()
 		return wsutil.WriteClientText(c.conn, bytes)
 	})
 }
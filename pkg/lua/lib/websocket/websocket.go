@@ -1,7 +1,9 @@
 package websocket
 
 import (
+	"bufio"
 	"context"
+	"net"
 
 	"github.com/gobwas/ws"
 	lua "github.com/yuin/gopher-lua"
@@ -10,6 +12,7 @@ import (
 	libasync "github.com/joesonw/lte/pkg/lua/lib/async"
 	goclass "github.com/joesonw/lte/pkg/lua/lib/go-class"
 	libpool "github.com/joesonw/lte/pkg/lua/lib/pool"
+	goutil "github.com/joesonw/lte/pkg/util"
 )
 
 const moduleName = "websocket"
@@ -35,9 +38,14 @@ func wsOpen(L *lua.LState) int {
 	url := L.CheckString(2)
 
 	return libasync.DeferredResult(L, c.luaCtx.AsyncPool(), func(ctx context.Context) (lua.LGFunction, error) {
-		conn, br, _, err := ws.Dial(ctx, url)
-		if err != nil {
-			return nil, err
+		var conn net.Conn = &goutil.NopConn{Network: "tcp", Addr: url}
+		var br *bufio.Reader
+		if !c.luaCtx.StubNetwork() {
+			var err error
+			conn, br, _, err = ws.Dial(ctx, url)
+			if err != nil {
+				return nil, err
+			}
 		}
 
 		g := c.luaCtx.ReleasePool().Watch(libpool.NewIOReadWriteCloserResource("websocket conn", conn))
@@ -84,7 +84,7 @@ func Run(t *testing.T, tests ...Testable) {
 			lua.OpenTable(L)
 			lua.OpenOs(L)
 
-			libbase.Open(L, luaCtx, afero.NewMemMapFs())
+			libbase.Open(L, luaCtx, afero.NewMemMapFs(), "")
 			libjson.Open(L, luaCtx)
 			libbytes.Open(L, luaCtx)
 
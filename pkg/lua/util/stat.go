@@ -1,10 +1,21 @@
 package util
 
 import (
+	"context"
+
 	luacontext "github.com/joesonw/lte/pkg/lua/context"
 	"github.com/joesonw/lte/pkg/stat"
+	goutil "github.com/joesonw/lte/pkg/util"
 )
 
+// FailStat marks s as failed, or as cancelled if err is caused by cancellation of ctx, e.g. job shutdown
+func FailStat(ctx context.Context, s *stat.Stat, err error) *stat.Stat {
+	if goutil.IsCanceled(ctx, err) {
+		return s.IntField("cancelled", 1)
+	}
+	return s.IntField("success", 0)
+}
+
 func ReportContextStat(ctx *luacontext.Context, stats ...*stat.Stat) {
 	scopeName := ctx.ScopeName()
 	tags := ctx.Tags()
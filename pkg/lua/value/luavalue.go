@@ -196,6 +196,9 @@ func unmarshalValue(typ reflect.Type, field reflect.Value, value lua.LValue, tag
 			ud := value.(*lua.LUserData)
 			field.Set(reflect.ValueOf(ud.Value))
 		} else {
+			if field.IsNil() {
+				field.Set(reflect.New(typ.Elem()))
+			}
 			return unmarshalTable(value.(*lua.LTable), field)
 		}
 	}
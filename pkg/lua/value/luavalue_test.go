@@ -43,6 +43,28 @@ func TestLuaTableToStruct(t *testing.T) {
 	assert.ElementsMatch(t, []int64{1, 2, 3}, s.Arr)
 }
 
+func TestLuaTableToStructPointers(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+
+	assert.Nil(t, L.DoString(`value = { children = { { name = "a" }, { name = "b" } }, child = { name = "c" } }`))
+
+	type C struct {
+		Name string `json:"name"`
+	}
+	type S struct {
+		Children []*C `json:"children"`
+		Child    *C   `json:"child"`
+	}
+
+	s := S{}
+	assert.Nil(t, luavalue.Unmarshal(L.GetGlobal("value"), &s))
+	assert.Equal(t, 2, len(s.Children))
+	assert.Equal(t, "a", s.Children[0].Name)
+	assert.Equal(t, "b", s.Children[1].Name)
+	assert.Equal(t, "c", s.Child.Name)
+}
+
 func TestLuaStructToTable(t *testing.T) {
 	L := lua.NewState()
 	defer L.Close()
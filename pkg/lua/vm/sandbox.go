@@ -0,0 +1,200 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	DefaultSandboxCallStackSize   = 128
+	DefaultSandboxRegistrySize    = 1024
+	DefaultSandboxRegistryMaxSize = 1024 * 64
+
+	memoryCheckInterval = time.Millisecond * 100
+)
+
+// sandboxOsFunctions are functions of os kept in sandbox, the rest (exit, execute, remove, getenv...) are removed
+var sandboxOsFunctions = []string{"clock", "date", "difftime", "time"}
+
+// sandboxBaseFunctions are removed from base library in sandbox, files are read through fs and require instead
+var sandboxBaseFunctions = []string{"dofile", "loadfile"}
+
+// Sandbox limits what a script can reach and how much it can take, zero values of sizes are replaced with defaults
+type Sandbox struct {
+	// CallStackSize caps depth of lua calls
+	CallStackSize int
+	// RegistryMaxSize caps the value stack of the state, it grows from DefaultSandboxRegistrySize
+	RegistryMaxSize int
+	// Timeout aborts an iteration running longer, no timeout if 0
+	Timeout time.Duration
+	// InstructionBudget aborts an iteration after executing this many lua instructions, no budget if 0
+	InstructionBudget int64
+	// MemoryLimit aborts running iterations while heap of the process is larger in bytes, no limit if 0.
+	// Heap is shared by all vms, so it caps the process rather than a single vm
+	MemoryLimit uint64
+}
+
+func (s *Sandbox) options() lua.Options {
+	o := lua.Options{
+		CallStackSize:    s.CallStackSize,
+		RegistrySize:     DefaultSandboxRegistrySize,
+		RegistryMaxSize:  s.RegistryMaxSize,
+		RegistryGrowStep: 0,
+		SkipOpenLibs:     true,
+	}
+	if o.CallStackSize <= 0 {
+		o.CallStackSize = DefaultSandboxCallStackSize
+	}
+	if o.RegistryMaxSize <= 0 {
+		o.RegistryMaxSize = DefaultSandboxRegistryMaxSize
+	}
+	return o
+}
+
+// strip removes functions reaching the host from opened libraries
+func (s *Sandbox) strip(L *lua.LState) {
+	for _, name := range sandboxBaseFunctions {
+		L.SetGlobal(name, lua.LNil)
+	}
+
+	if os, ok := L.GetGlobal(lua.OsLibName).(*lua.LTable); ok {
+		kept := L.NewTable()
+		for _, name := range sandboxOsFunctions {
+			kept.RawSetString(name, os.RawGetString(name))
+		}
+		L.SetGlobal(lua.OsLibName, kept)
+		if loaded, ok := L.GetField(L.Get(lua.RegistryIndex), "_LOADED").(*lua.LTable); ok {
+			loaded.RawSetString(lua.OsLibName, kept)
+		}
+	}
+}
+
+// limited returns if iterations have to run with an iterationContext
+func (s *Sandbox) limited() bool {
+	return s.Timeout > 0 || s.InstructionBudget > 0 || s.MemoryLimit > 0
+}
+
+// iterationContext is set to the state for the length of an iteration. gopher-lua checks Done before each
+// instruction, which is counted against the instruction budget.
+type iterationContext struct {
+	context.Context
+	cancel context.CancelFunc
+	timer  *time.Timer
+	budget int64
+	used   int64
+
+	mu  *sync.Mutex
+	err error
+}
+
+func newIterationContext(sandbox *Sandbox) *iterationContext {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &iterationContext{
+		Context: ctx,
+		cancel:  cancel,
+		budget:  sandbox.InstructionBudget,
+		mu:      &sync.Mutex{},
+	}
+	if sandbox.Timeout > 0 {
+		c.timer = time.AfterFunc(sandbox.Timeout, func() {
+			c.abort(fmt.Errorf("sandbox: iteration exceeded timeout of %s", sandbox.Timeout))
+		})
+	}
+	return c
+}
+
+// release stops timer and cancels the context once iteration is finished
+func (c *iterationContext) release() {
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	c.cancel()
+}
+
+func (c *iterationContext) Done() <-chan struct{} {
+	if c.budget > 0 && atomic.AddInt64(&c.used, 1) == c.budget+1 {
+		c.abort(fmt.Errorf("sandbox: iteration exceeded instruction budget of %d", c.budget))
+	}
+	return c.Context.Done()
+}
+
+func (c *iterationContext) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	return c.Context.Err()
+}
+
+// abort cancels the context, err is reported by Err instead of context.Canceled
+func (c *iterationContext) abort(err error) {
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.mu.Unlock()
+	c.cancel()
+}
+
+// memoryWatcher checks heap of the process periodically while any iteration is running with a memory limit
+type memoryWatcher struct {
+	mu      *sync.Mutex
+	watches map[*iterationContext]uint64
+	chStop  chan struct{}
+}
+
+var defaultMemoryWatcher = &memoryWatcher{
+	mu:      &sync.Mutex{},
+	watches: map[*iterationContext]uint64{},
+}
+
+func (w *memoryWatcher) add(c *iterationContext, limit uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.watches) == 0 {
+		w.chStop = make(chan struct{})
+		go w.run(w.chStop)
+	}
+	w.watches[c] = limit
+}
+
+func (w *memoryWatcher) remove(c *iterationContext) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.watches[c]; !ok {
+		return
+	}
+	delete(w.watches, c)
+	if len(w.watches) == 0 {
+		close(w.chStop)
+	}
+}
+
+func (w *memoryWatcher) run(chStop chan struct{}) {
+	ticker := time.NewTicker(memoryCheckInterval)
+	defer ticker.Stop()
+	stats := &runtime.MemStats{}
+	for {
+		select {
+		case <-chStop:
+			return
+		case <-ticker.C:
+		}
+
+		runtime.ReadMemStats(stats)
+		w.mu.Lock()
+		for c, limit := range w.watches {
+			if stats.HeapAlloc > limit {
+				c.abort(fmt.Errorf("sandbox: heap of %d bytes exceeded memory limit of %d bytes", stats.HeapAlloc, limit))
+			}
+		}
+		w.mu.Unlock()
+	}
+}
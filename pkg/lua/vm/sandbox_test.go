@@ -0,0 +1,98 @@
+package vm_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	luacontext "github.com/joesonw/lte/pkg/lua/context"
+	libpool "github.com/joesonw/lte/pkg/lua/lib/pool"
+	luavm "github.com/joesonw/lte/pkg/lua/vm"
+	"github.com/joesonw/lte/pkg/stat"
+)
+
+func newSandboxVM(t *testing.T, sandbox *luavm.Sandbox, script string) *luavm.VM {
+	vm := luavm.New(zap.NewNop(), libpool.NewAsync(zap.NewNop(), 4, 0, 16), luacontext.NewGlobal(stat.Noop()), luavm.Parameters{
+		Filesystem: afero.NewMemMapFs(),
+		Sandbox:    sandbox,
+	})
+	t.Cleanup(vm.Stop)
+	proto, err := luavm.Compile(script, "main.lua")
+	assert.Nil(t, err)
+	assert.Nil(t, vm.Load(proto, "run"))
+	return vm
+}
+
+func TestSandboxStrip(t *testing.T) {
+	vm := newSandboxVM(t, &luavm.Sandbox{}, `
+		function run()
+			assert(os.execute == nil and os.exit == nil and os.getenv == nil and os.remove == nil)
+			assert(type(os.time()) == "number" and type(os.clock()) == "number")
+			assert(dofile == nil and loadfile == nil)
+			assert(require("os").execute == nil)
+		end
+	`)
+	assert.Nil(t, vm.Run(1))
+}
+
+func TestSandboxCallStack(t *testing.T) {
+	vm := newSandboxVM(t, &luavm.Sandbox{CallStackSize: 32}, `
+		local function deep(n) if n == 0 then return 0 end return 1 + deep(n - 1) end
+		function run(id) deep(id) end
+	`)
+	assert.Nil(t, vm.Run(16))
+	err := vm.Run(64)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "stack overflow")
+}
+
+func TestSandboxInstructionBudget(t *testing.T) {
+	vm := newSandboxVM(t, &luavm.Sandbox{InstructionBudget: 10000}, `
+		function run(id)
+			local n = 0
+			for i = 1, id do n = n + i end
+			spawn(function() for i = 1, id do n = n + i end end)
+		end
+	`)
+	assert.Nil(t, vm.Run(100))
+	// budget is counted across coroutines of an iteration and refilled by next one
+	err := vm.Run(4000)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "instruction budget")
+	assert.Nil(t, vm.Run(100))
+}
+
+func TestSandboxTimeout(t *testing.T) {
+	vm := newSandboxVM(t, &luavm.Sandbox{Timeout: time.Millisecond * 100}, `
+		function run(id)
+			if id == 1 then
+				while true do end
+			elseif id == 2 then
+				-- parked on a deferred which is never done in time
+				shared:pop("never", 1000)()
+			end
+		end
+	`)
+	for _, id := range []int64{1, 2} {
+		start := time.Now()
+		err := vm.Run(id)
+		assert.NotNil(t, err)
+		assert.Contains(t, err.Error(), "timeout")
+		assert.Less(t, int64(time.Since(start)), int64(time.Second))
+	}
+	assert.Nil(t, vm.Run(3))
+}
+
+func TestSandboxMemoryLimit(t *testing.T) {
+	vm := newSandboxVM(t, &luavm.Sandbox{MemoryLimit: 1}, `
+		function run()
+			while true do end
+		end
+	`)
+	err := vm.Run(1)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "memory limit")
+}
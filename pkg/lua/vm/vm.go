@@ -13,16 +13,20 @@ import (
 	"go.uber.org/zap"
 
 	luacontext "github.com/joesonw/lte/pkg/lua/context"
+	libasync "github.com/joesonw/lte/pkg/lua/lib/async"
+	libbarrier "github.com/joesonw/lte/pkg/lua/lib/barrier"
 	libbase "github.com/joesonw/lte/pkg/lua/lib/base"
 	libbuffer "github.com/joesonw/lte/pkg/lua/lib/buffer"
 	libbytes "github.com/joesonw/lte/pkg/lua/lib/bytes"
 	libcrypto "github.com/joesonw/lte/pkg/lua/lib/crypto"
+	libdata "github.com/joesonw/lte/pkg/lua/lib/data"
 	libfs "github.com/joesonw/lte/pkg/lua/lib/fs"
 	libhttp "github.com/joesonw/lte/pkg/lua/lib/http"
 	libjson "github.com/joesonw/lte/pkg/lua/lib/json"
 	libnet "github.com/joesonw/lte/pkg/lua/lib/net"
 	libpool "github.com/joesonw/lte/pkg/lua/lib/pool"
 	libproto "github.com/joesonw/lte/pkg/lua/lib/proto"
+	libshared "github.com/joesonw/lte/pkg/lua/lib/shared"
 	libtime "github.com/joesonw/lte/pkg/lua/lib/time"
 	libuuid "github.com/joesonw/lte/pkg/lua/lib/uuid"
 	libwebsocket "github.com/joesonw/lte/pkg/lua/lib/websocket"
@@ -47,12 +51,22 @@ type VM struct {
 	logger      *zap.Logger
 	releasePool *libpool.ReleasePool
 	asyncPool   *libpool.AsyncPool
+	scheduler   *libasync.Scheduler
 	fn          *lua.LFunction
 }
 
 type Parameters struct {
 	EnvVars    map[string]string
 	Filesystem afero.Fs
+	// HTTPClient is used by http module, a default client is used if nil
+	HTTPClient *http.Client
+	// ModulePath is package.path searched by require in Filesystem, libbase.DefaultModulePath if empty
+	ModulePath string
+	// Sandbox strips functions reaching the host and limits each iteration, scripts are trusted if nil
+	Sandbox *Sandbox
+	// StubNetwork makes network modules hand out inert placeholders instead of reaching network: http responses are
+	// empty, net and websocket connections read nothing and discard writes, grpc calls fail with "network is stubbed"
+	StubNetwork bool
 }
 
 func New(logger *zap.Logger, asyncPool *libpool.AsyncPool, global *luacontext.Global, params Parameters) *VM {
@@ -62,7 +76,7 @@ func New(logger *zap.Logger, asyncPool *libpool.AsyncPool, global *luacontext.Gl
 	releasePool := libpool.NewRelease(logger)
 	asyncPool.Start()
 
-	L := lua.NewState(lua.Options{
+	options := lua.Options{
 		CallStackSize:       0,
 		RegistrySize:        0,
 		RegistryMaxSize:     0,
@@ -70,9 +84,14 @@ func New(logger *zap.Logger, asyncPool *libpool.AsyncPool, global *luacontext.Gl
 		SkipOpenLibs:        true,
 		IncludeGoStackTrace: false,
 		MinimizeStackMemory: false,
-	})
+	}
+	if params.Sandbox != nil {
+		options = params.Sandbox.options()
+	}
+	L := lua.NewState(options)
 
 	luaCtx := luacontext.New(L, global, releasePool, asyncPool, logger)
+	luaCtx.SetStubNetwork(params.StubNetwork)
 
 	lua.OpenBase(L)
 	lua.OpenPackage(L)
@@ -80,20 +99,31 @@ func New(logger *zap.Logger, asyncPool *libpool.AsyncPool, global *luacontext.Gl
 	lua.OpenString(L)
 	lua.OpenTable(L)
 	lua.OpenOs(L)
+	if params.Sandbox != nil {
+		params.Sandbox.strip(L)
+	}
 
 	libjson.Open(L, luaCtx)
 	libbytes.Open(L, luaCtx)
 	libtime.Open(L, luaCtx)
-	libbase.Open(L, luaCtx, params.Filesystem)
+	libbase.Open(L, luaCtx, params.Filesystem, params.ModulePath)
+	libasync.Open(L, luaCtx)
 
 	libfs.Open(L, luaCtx, params.Filesystem)
-	libhttp.Open(L, luaCtx, &http.Client{})
+	libdata.Open(L, luaCtx, params.Filesystem)
+	httpClient := params.HTTPClient
+	if httpClient == nil {
+		httpClient = &http.Client{}
+	}
+	libhttp.Open(L, luaCtx, httpClient)
 	libproto.Open(L, luaCtx, params.Filesystem)
 	libwebsocket.Open(L, luaCtx)
 	libnet.Open(L, luaCtx)
 	libuuid.Open(L, luaCtx)
 	libcrypto.Open(L, luaCtx)
 	libbuffer.Open(L, luaCtx)
+	libshared.Open(L, luaCtx)
+	libbarrier.Open(L, luaCtx)
 
 	for k, v := range params.EnvVars {
 		L.Env.RawSetString(k, lua.LString(v))
@@ -107,20 +137,28 @@ func New(logger *zap.Logger, asyncPool *libpool.AsyncPool, global *luacontext.Gl
 		state:       L,
 		asyncPool:   asyncPool,
 		releasePool: releasePool,
+		scheduler:   libasync.NewScheduler(L),
 	}
 	return vm
 }
 
-func (vm *VM) Load(proto *lua.FunctionProto) error {
-	vm.state.Push(vm.state.NewFunctionFromProto(proto))
-	if err := vm.state.PCall(0, lua.MultRet, nil); err != nil {
+// Load executes chunk and binds global function exec which is called by Run, chunk is only executed if exec is empty
+func (vm *VM) Load(proto *lua.FunctionProto, exec string) error {
+	err := vm.limit(func() error {
+		vm.state.Push(vm.state.NewFunctionFromProto(proto))
+		return vm.state.PCall(0, lua.MultRet, nil)
+	})
+	if err != nil {
 		return err
 	}
+	if exec == "" {
+		return nil
+	}
 
-	val := vm.state.GetGlobal("run")
+	val := vm.state.GetGlobal(exec)
 	fn, ok := val.(*lua.LFunction)
 	if !ok {
-		return fmt.Errorf("expect global function run()")
+		return fmt.Errorf("expect global function %s()", exec)
 	}
 
 	vm.fn = fn
@@ -131,20 +169,54 @@ func (vm *VM) ID() int64 {
 	return vm.id
 }
 
+// Run calls bound function in a coroutine, it returns once the function and coroutines spawned by it are finished.
+// In sandbox the iteration is aborted once it exceeds any limit.
 func (vm *VM) Run(id int64) error {
-	vm.state.Push(vm.fn)
-	vm.state.Push(lua.LNumber(id))
-	return vm.state.PCall(1, 0, nil)
+	return vm.limit(func() error {
+		return vm.scheduler.Run(vm.fn, lua.LNumber(id))
+	})
+}
+
+// Call calls fn in a coroutine like Run, values returned by fn are returned
+func (vm *VM) Call(fn *lua.LFunction, args ...lua.LValue) ([]lua.LValue, error) {
+	var values []lua.LValue
+	err := vm.limit(func() error {
+		var err error
+		values, err = vm.scheduler.Call(fn, args...)
+		return err
+	})
+	return values, err
+}
+
+// limit calls f with limits of sandbox applied to the state
+func (vm *VM) limit(f func() error) error {
+	sandbox := vm.params.Sandbox
+	if sandbox == nil || !sandbox.limited() {
+		return f()
+	}
+
+	ctx := newIterationContext(sandbox)
+	defer ctx.release()
+	if sandbox.MemoryLimit > 0 {
+		defaultMemoryWatcher.add(ctx, sandbox.MemoryLimit)
+		defer defaultMemoryWatcher.remove(ctx)
+	}
+	vm.state.SetContext(ctx)
+	defer vm.state.RemoveContext()
+	return f()
 }
 
 func (vm *VM) LState() *lua.LState {
 	return vm.state
 }
 
+// AsyncPool returns pool running async tasks of the vm
+func (vm *VM) AsyncPool() *libpool.AsyncPool {
+	return vm.asyncPool
+}
+
 func (vm *VM) Reset() {
 	vm.releasePool.Clean()
-	vm.asyncPool.Stop()
-	vm.asyncPool.Start()
 }
 
 func (vm *VM) Stop() {
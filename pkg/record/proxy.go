@@ -0,0 +1,213 @@
+package record
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/joesonw/lte/pkg/convert"
+)
+
+// hopHeaders are meaningful only for a single connection, they are not forwarded
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Proxy-Authorization",
+	"Proxy-Authenticate",
+	"Keep-Alive",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// Proxy is a forward proxy recording requests passing through, https is intercepted by CONNECT with certificates
+// signed by CA
+type Proxy struct {
+	logger    *zap.Logger
+	ca        *CA
+	transport http.RoundTripper
+
+	mu       *sync.Mutex
+	requests []*convert.Request
+}
+
+// NewProxy creates a proxy, requests are sent upstream by transport, a transport without proxy is used if nil
+func NewProxy(logger *zap.Logger, ca *CA, transport http.RoundTripper) *Proxy {
+	if transport == nil {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.Proxy = nil
+		t.DisableCompression = true
+		transport = t
+	}
+	return &Proxy{
+		logger:    logger.With(zap.String("module", "record-proxy")),
+		ca:        ca,
+		transport: transport,
+		mu:        &sync.Mutex{},
+	}
+}
+
+// Requests returns requests recorded so far ordered by start time
+func (p *Proxy) Requests() []*convert.Request {
+	p.mu.Lock()
+	requests := make([]*convert.Request, len(p.requests))
+	copy(requests, p.requests)
+	p.mu.Unlock()
+	sort.SliceStable(requests, func(i, j int) bool {
+		return requests[i].StartedAt.Before(requests[j].StartedAt)
+	})
+	return requests
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect {
+		p.intercept(w, r)
+		return
+	}
+	if !r.URL.IsAbs() {
+		http.Error(w, "only proxy requests are served", http.StatusBadRequest)
+		return
+	}
+
+	res, err := p.roundTrip(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer res.Body.Close()
+	removeHopHeaders(res.Header)
+	for k, values := range res.Header {
+		for _, v := range values {
+			w.Header().Add(k, v)
+		}
+	}
+	w.WriteHeader(res.StatusCode)
+	if _, err := io.Copy(w, res.Body); err != nil {
+		p.logger.Warn("unable to copy response", zap.String("url", r.URL.String()), zap.Error(err))
+	}
+}
+
+// intercept terminates tls of a CONNECT tunnel and serves requests inside it
+func (p *Proxy) intercept(w http.ResponseWriter, r *http.Request) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "tunnel is not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, _, err := hijacker.Hijack()
+	if err != nil {
+		p.logger.Error("unable to hijack", zap.Error(err))
+		return
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		return
+	}
+
+	host := r.Host
+	hostname, port, err := net.SplitHostPort(host)
+	if err != nil {
+		hostname = host
+	} else if port == "443" {
+		host = hostname
+	}
+	tlsConn := tls.Server(conn, &tls.Config{
+		NextProtos: []string{"http/1.1"},
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			name := hello.ServerName
+			if name == "" {
+				name = hostname
+			}
+			return p.ca.Certificate(name)
+		},
+	})
+	defer tlsConn.Close()
+
+	br := bufio.NewReader(tlsConn)
+	for {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			if err != io.EOF {
+				p.logger.Debug("unable to read tunneled request", zap.String("host", host), zap.Error(err))
+			}
+			return
+		}
+		req.URL.Scheme = "https"
+		req.URL.Host = host
+
+		res, err := p.roundTrip(req)
+		if err != nil {
+			res = &http.Response{
+				StatusCode: http.StatusBadGateway,
+				ProtoMajor: 1,
+				ProtoMinor: 1,
+				Header:     http.Header{},
+				Body:       ioutil.NopCloser(strings.NewReader(err.Error())),
+				Close:      true,
+			}
+		}
+		removeHopHeaders(res.Header)
+		err = res.Write(tlsConn)
+		res.Body.Close()
+		if err != nil || req.Close || res.Close {
+			return
+		}
+	}
+}
+
+// roundTrip sends request upstream and records it
+func (p *Proxy) roundTrip(r *http.Request) (*http.Response, error) {
+	var body []byte
+	if r.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	out := r.Clone(r.Context())
+	out.RequestURI = ""
+	out.Body = ioutil.NopCloser(bytes.NewReader(body))
+	out.ContentLength = int64(len(body))
+	removeHopHeaders(out.Header)
+
+	recorded := &convert.Request{
+		Method:    out.Method,
+		URL:       out.URL.String(),
+		Header:    out.Header.Clone(),
+		Body:      body,
+		StartedAt: time.Now(),
+	}
+	res, err := p.transport.RoundTrip(out)
+	recorded.Duration = time.Since(recorded.StartedAt)
+	if err != nil {
+		p.logger.Warn("request failed", zap.String("method", out.Method), zap.String("url", recorded.URL), zap.Error(err))
+		return nil, err
+	}
+	recorded.ResponseType = res.Header.Get("Content-Type")
+
+	p.mu.Lock()
+	p.requests = append(p.requests, recorded)
+	p.mu.Unlock()
+	p.logger.Info("recorded", zap.String("method", out.Method), zap.String("url", recorded.URL), zap.Int("status", res.StatusCode))
+	return res, nil
+}
+
+func removeHopHeaders(header http.Header) {
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+}
@@ -0,0 +1,91 @@
+package record_test
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/joesonw/lte/pkg/convert"
+	luacontext "github.com/joesonw/lte/pkg/lua/context"
+	libpool "github.com/joesonw/lte/pkg/lua/lib/pool"
+	luavm "github.com/joesonw/lte/pkg/lua/vm"
+	"github.com/joesonw/lte/pkg/record"
+	"github.com/joesonw/lte/pkg/stat"
+)
+
+func TestRecord(t *testing.T) {
+	mu := &sync.Mutex{}
+	var received []string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		received = append(received, fmt.Sprintf("%s %s %s %s", r.Method, r.URL.RequestURI(), r.Header.Get("X-Token"), b))
+		mu.Unlock()
+		fmt.Fprint(w, "pong")
+	})
+	upstream := httptest.NewServer(handler)
+	defer upstream.Close()
+	secureUpstream := httptest.NewTLSServer(handler)
+	defer secureUpstream.Close()
+
+	ca, err := record.NewCA()
+	assert.Nil(t, err)
+	upstreamTransport := secureUpstream.Client().Transport.(*http.Transport).Clone()
+	proxy := record.NewProxy(zap.NewNop(), ca, upstreamTransport)
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	proxyURL, _ := url.Parse(proxyServer.URL)
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{RootCAs: ca.CertPool()},
+	}}
+
+	req, _ := http.NewRequest(http.MethodGet, upstream.URL+"/home?a=1", nil)
+	req.Header.Set("X-Token", "t1")
+	res, err := client.Do(req)
+	assert.Nil(t, err)
+	b, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, "pong", string(b))
+
+	res, err = client.Post(secureUpstream.URL+"/orders", "application/json", strings.NewReader(`{"id":1}`))
+	assert.Nil(t, err)
+	b, _ = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, "pong", string(b))
+
+	requests := proxy.Requests()
+	assert.Equal(t, 2, len(requests))
+	assert.Equal(t, secureUpstream.URL+"/orders", requests[1].URL)
+
+	out := &bytes.Buffer{}
+	assert.Nil(t, convert.Generate(out, convert.GroupByIdle(requests, 0), convert.Options{}))
+	assert.Contains(t, out.String(), `group("step 2", function()`)
+
+	// replay the script without proxy
+	mu.Lock()
+	received = nil
+	mu.Unlock()
+	vm := luavm.New(zap.NewNop(), libpool.NewAsync(zap.NewNop(), 4, 0, 16), luacontext.NewGlobal(stat.Noop()), luavm.Parameters{
+		Filesystem: afero.NewMemMapFs(),
+		HTTPClient: secureUpstream.Client(),
+	})
+	defer vm.Stop()
+	proto, err := luavm.Compile(out.String(), "main.lua")
+	assert.Nil(t, err)
+	assert.Nil(t, vm.Load(proto, "run"))
+	assert.Nil(t, vm.Run(1))
+	assert.Equal(t, []string{"GET /home?a=1 t1 ", `POST /orders  {"id":1}`}, received)
+}
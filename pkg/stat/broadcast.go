@@ -0,0 +1,84 @@
+package stat
+
+import (
+	"sync"
+)
+
+type subscriber struct {
+	ch     chan *Stat
+	chDone chan struct{}
+	once   *sync.Once
+}
+
+// Broadcaster is a Reporter fans stats out to all subscribers, it blocks when a subscriber is falling behind
+type Broadcaster struct {
+	mu          *sync.RWMutex
+	bufferSize  int
+	idCounter   int64
+	subscribers map[int64]*subscriber
+	finished    bool
+}
+
+func NewBroadcaster(bufferSize int) *Broadcaster {
+	return &Broadcaster{
+		mu:          &sync.RWMutex{},
+		bufferSize:  bufferSize,
+		subscribers: map[int64]*subscriber{},
+	}
+}
+
+// Subscribe returns a channel receives stats reported from now on, the channel is closed once Finish is called.
+// The returned function has to be called when the subscriber is no longer interested.
+func (b *Broadcaster) Subscribe() (<-chan *Stat, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s := &subscriber{
+		ch:     make(chan *Stat, b.bufferSize),
+		chDone: make(chan struct{}),
+		once:   &sync.Once{},
+	}
+	if b.finished {
+		close(s.ch)
+		return s.ch, func() {}
+	}
+
+	b.idCounter++
+	id := b.idCounter
+	b.subscribers[id] = s
+	return s.ch, func() {
+		s.once.Do(func() {
+			close(s.chDone)
+		})
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.subscribers, id)
+	}
+}
+
+func (b *Broadcaster) Report(stats ...*Stat) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, s := range b.subscribers {
+		for _, st := range stats {
+			select {
+			case s.ch <- st:
+			case <-s.chDone:
+			}
+		}
+	}
+}
+
+func (b *Broadcaster) Finish() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.finished {
+		return nil
+	}
+	b.finished = true
+	for id, s := range b.subscribers {
+		close(s.ch)
+		delete(b.subscribers, id)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package stat
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+)
+
+type jsonStat struct {
+	Name      string             `json:"name"`
+	Timestamp int64              `json:"timestamp"`
+	Tags      map[string]string  `json:"tags"`
+	Fields    map[string]float64 `json:"fields"`
+}
+
+// JSON writes a JSON object per stat per line, w is closed on Finish
+func JSON(w io.WriteCloser) Reporter {
+	return &jsonReporter{
+		mu:  &sync.Mutex{},
+		w:   w,
+		enc: json.NewEncoder(w),
+	}
+}
+
+type jsonReporter struct {
+	mu  *sync.Mutex
+	w   io.WriteCloser
+	enc *json.Encoder
+	err error
+}
+
+func (r *jsonReporter) Report(stats ...*Stat) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, s := range stats {
+		if r.err != nil {
+			return
+		}
+		r.err = r.enc.Encode(&jsonStat{
+			Name:      s.Name,
+			Timestamp: s.Timestamp.UnixNano(),
+			Tags:      s.Tags,
+			Fields:    s.Fields,
+		})
+	}
+}
+
+func (r *jsonReporter) Finish() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.w.Close(); err != nil && r.err == nil {
+		r.err = err
+	}
+	return r.err
+}
@@ -0,0 +1,25 @@
+package stat
+
+import (
+	"go.uber.org/multierr"
+)
+
+func Multi(reporters ...Reporter) Reporter {
+	return multi(reporters)
+}
+
+type multi []Reporter
+
+func (m multi) Report(stats ...*Stat) {
+	for _, r := range m {
+		r.Report(stats...)
+	}
+}
+
+func (m multi) Finish() error {
+	var errs []error
+	for _, r := range m {
+		errs = append(errs, r.Finish())
+	}
+	return multierr.Combine(errs...)
+}
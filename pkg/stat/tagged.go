@@ -0,0 +1,31 @@
+package stat
+
+// Tagged adds tags to every stat before reporting to r, tags already set on a stat are kept
+func Tagged(r Reporter, tags map[string]string) Reporter {
+	if len(tags) == 0 {
+		return r
+	}
+	return &tagged{
+		Reporter: r,
+		tags:     tags,
+	}
+}
+
+type tagged struct {
+	Reporter
+	tags map[string]string
+}
+
+func (t *tagged) Report(stats ...*Stat) {
+	result := make([]*Stat, len(stats))
+	for i, s := range stats {
+		s = s.Clone()
+		for k, v := range t.tags {
+			if _, ok := s.Tags[k]; !ok {
+				s.Tag(k, v)
+			}
+		}
+		result[i] = s
+	}
+	t.Reporter.Report(result...)
+}
@@ -0,0 +1,236 @@
+package stat
+
+import (
+	"math"
+	"math/rand"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var thresholdPattern = regexp.MustCompile(`^\s*(count|sum|avg|min|max|med|rate|p\(\s*([0-9.]+)\s*\))\s*(<=|>=|==|!=|<|>)\s*(\S+)\s*$`)
+
+// Threshold is a pass/fail criteria on a stat field, e.g. metric "http.duration_ns" with expression "p(95) < 200ms"
+type Threshold struct {
+	Metric     string
+	Expression string
+
+	aggregation string
+	percentile  float64
+	op          string
+	value       float64
+}
+
+// ParseThreshold parses metric in form of "<stat name>.<field>" and expression in form of "<aggregation> <op> <value>".
+// Aggregation is one of count, sum, avg, min, max, med, rate (ratio of non-zero values) and p(N).
+// Value is either a number or a duration, which is compared in nanoseconds.
+func ParseThreshold(metric, expression string) (*Threshold, error) {
+	i := strings.LastIndex(metric, ".")
+	if i <= 0 || i == len(metric)-1 {
+		return nil, errors.Errorf("metric \"%s\" has to be in form of <name>.<field>", metric)
+	}
+
+	matches := thresholdPattern.FindStringSubmatch(expression)
+	if matches == nil {
+		return nil, errors.Errorf("expression \"%s\" has to be in form of <aggregation> <op> <value>", expression)
+	}
+
+	t := &Threshold{
+		Metric:      metric,
+		Expression:  expression,
+		aggregation: matches[1],
+		op:          matches[3],
+	}
+	if matches[2] != "" {
+		p, err := strconv.ParseFloat(matches[2], 64)
+		if err != nil || p < 0 || p > 100 {
+			return nil, errors.Errorf("percentile \"%s\" has to be between 0 and 100", matches[2])
+		}
+		t.aggregation = "p"
+		t.percentile = p
+	}
+
+	value, err := strconv.ParseFloat(matches[4], 64)
+	if err != nil {
+		d, derr := time.ParseDuration(matches[4])
+		if derr != nil {
+			return nil, errors.Errorf("value \"%s\" is neither a number nor a duration", matches[4])
+		}
+		value = float64(d.Nanoseconds())
+	}
+	t.value = value
+	return t, nil
+}
+
+func (t *Threshold) String() string {
+	return t.Metric + ": " + t.Expression
+}
+
+// Aggregate computes aggregation of values, NaN if there is no value
+func (t *Threshold) Aggregate(values []float64) float64 {
+	s := newSummary(len(values))
+	for _, v := range values {
+		s.add(v)
+	}
+	return t.aggregate(s)
+}
+
+func (t *Threshold) aggregate(s *summary) float64 {
+	if t.aggregation == "count" {
+		return float64(s.count)
+	}
+	if s.count == 0 {
+		return math.NaN()
+	}
+
+	switch t.aggregation {
+	case "sum":
+		return s.sum
+	case "avg":
+		return s.sum / float64(s.count)
+	case "rate":
+		return float64(s.nonZero) / float64(s.count)
+	case "min":
+		return s.min
+	case "max":
+		return s.max
+	}
+
+	sorted := make([]float64, len(s.sample))
+	copy(sorted, s.sample)
+	sort.Float64s(sorted)
+	if t.aggregation == "med" {
+		return percentile(sorted, 50)
+	}
+	return percentile(sorted, t.percentile)
+}
+
+// Check returns if aggregated value satisfies the threshold, it never does if there is no value to aggregate
+func (t *Threshold) Check(actual float64) bool {
+	if math.IsNaN(actual) {
+		return false
+	}
+	switch t.op {
+	case "<":
+		return actual < t.value
+	case "<=":
+		return actual <= t.value
+	case ">":
+		return actual > t.value
+	case ">=":
+		return actual >= t.value
+	case "==":
+		return actual == t.value
+	default:
+		return actual != t.value
+	}
+}
+
+// percentile interpolates linearly between closest ranks of sorted values
+func percentile(sorted []float64, p float64) float64 {
+	rank := p / 100 * float64(len(sorted)-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+	return sorted[lower] + (sorted[upper]-sorted[lower])*(rank-float64(lower))
+}
+
+// summary keeps exact count, sum, extremes and non-zero count of values, percentiles are computed from a uniform sample
+// of at most size values, so memory does not grow with a long test
+type summary struct {
+	count   int64
+	nonZero int64
+	sum     float64
+	min     float64
+	max     float64
+	size    int
+	sample  []float64
+}
+
+func newSummary(size int) *summary {
+	return &summary{size: size}
+}
+
+func (s *summary) add(v float64) {
+	s.count++
+	s.sum += v
+	if v != 0 {
+		s.nonZero++
+	}
+	if s.count == 1 || v < s.min {
+		s.min = v
+	}
+	if s.count == 1 || v > s.max {
+		s.max = v
+	}
+
+	// reservoir sampling, each value is kept with probability size/count
+	if len(s.sample) < s.size {
+		s.sample = append(s.sample, v)
+	} else if i := rand.Int63n(s.count); i < int64(s.size) {
+		s.sample[i] = v
+	}
+}
+
+type ThresholdResult struct {
+	Threshold *Threshold
+	Actual    float64
+	Passed    bool
+}
+
+// thresholdSampleSize bounds values kept per metric for percentiles, which are estimated once there are more values
+const thresholdSampleSize = 10000
+
+// ThresholdReporter collects fields referenced by thresholds, results are available after all stats are reported.
+// Count, sum, avg, min, max and rate are exact, med and p(N) are estimated from a sample of thresholdSampleSize values
+type ThresholdReporter struct {
+	mu         *sync.Mutex
+	thresholds []*Threshold
+	values     map[string]*summary
+}
+
+func NewThresholdReporter(thresholds []*Threshold) *ThresholdReporter {
+	values := map[string]*summary{}
+	for _, t := range thresholds {
+		values[t.Metric] = newSummary(thresholdSampleSize)
+	}
+	return &ThresholdReporter{
+		mu:         &sync.Mutex{},
+		thresholds: thresholds,
+		values:     values,
+	}
+}
+
+func (r *ThresholdReporter) Report(stats ...*Stat) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, s := range stats {
+		for field, value := range s.Fields {
+			metric := s.Name + "." + field
+			if values, ok := r.values[metric]; ok {
+				values.add(value)
+			}
+		}
+	}
+}
+
+func (r *ThresholdReporter) Finish() error { return nil }
+
+func (r *ThresholdReporter) Results() []ThresholdResult {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	results := make([]ThresholdResult, len(r.thresholds))
+	for i, t := range r.thresholds {
+		actual := t.aggregate(r.values[t.Metric])
+		results[i] = ThresholdResult{
+			Threshold: t,
+			Actual:    actual,
+			Passed:    t.Check(actual),
+		}
+	}
+	return results
+}
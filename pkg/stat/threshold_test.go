@@ -0,0 +1,97 @@
+package stat_test
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/joesonw/lte/pkg/stat"
+)
+
+func TestParseThreshold(t *testing.T) {
+	for _, tc := range []struct {
+		metric     string
+		expression string
+		ok         bool
+	}{
+		{"http.duration_ns", "p(95) < 200ms", true},
+		{"http.success", "rate>=0.99", true},
+		{"run.cost", "count == 10", true},
+		{"run", "count == 10", false},
+		{"run.cost", "p(101) < 1", false},
+		{"run.cost", "mean < 1", false},
+		{"run.cost", "avg < fast", false},
+	} {
+		_, err := stat.ParseThreshold(tc.metric, tc.expression)
+		if tc.ok {
+			assert.Nil(t, err, tc.expression)
+		} else {
+			assert.NotNil(t, err, tc.expression)
+		}
+	}
+}
+
+func TestThresholdAggregate(t *testing.T) {
+	values := []float64{1, 2, 3, 4, 0}
+	for expression, expected := range map[string]float64{
+		"count < 0":  5,
+		"sum < 0":    10,
+		"avg < 0":    2,
+		"min < 0":    0,
+		"max < 0":    4,
+		"med < 0":    2,
+		"p(75) < 0":  3,
+		"p(90) < 0":  3.6,
+		"rate < 0":   0.8,
+		"p(100) < 0": 4,
+	} {
+		th, err := stat.ParseThreshold("a.b", expression)
+		assert.Nil(t, err)
+		assert.InDelta(t, expected, th.Aggregate(values), 1e-9, expression)
+	}
+
+	th, _ := stat.ParseThreshold("a.b", "avg < 1")
+	assert.True(t, math.IsNaN(th.Aggregate(nil)))
+	assert.False(t, th.Check(th.Aggregate(nil)))
+}
+
+func TestThresholdReporter(t *testing.T) {
+	latency, _ := stat.ParseThreshold("http.duration_ns", "max < 200ms")
+	success, _ := stat.ParseThreshold("http.success", "rate > 0.9")
+	r := stat.NewThresholdReporter([]*stat.Threshold{latency, success})
+
+	r.Report(
+		stat.New("http").IntField("success", 1).Int64Field("duration_ns", (time.Millisecond*100).Nanoseconds()),
+		stat.New("http").IntField("success", 0).Int64Field("duration_ns", (time.Millisecond*300).Nanoseconds()),
+		stat.New("run").Int64Field("duration_ns", 0),
+	)
+
+	results := r.Results()
+	assert.Equal(t, 2, len(results))
+	assert.Equal(t, float64((time.Millisecond * 300).Nanoseconds()), results[0].Actual)
+	assert.False(t, results[0].Passed)
+	assert.Equal(t, 0.5, results[1].Actual)
+	assert.False(t, results[1].Passed)
+}
+
+func TestThresholdReporterSample(t *testing.T) {
+	var thresholds []*stat.Threshold
+	for _, expression := range []string{"count < 0", "avg < 0", "min < 0", "max < 0", "p(90) < 0"} {
+		th, _ := stat.ParseThreshold("run.cost", expression)
+		thresholds = append(thresholds, th)
+	}
+	r := stat.NewThresholdReporter(thresholds)
+	// more values than kept for percentiles
+	for i := 1; i <= 100000; i++ {
+		r.Report(stat.New("run").IntField("cost", i))
+	}
+
+	results := r.Results()
+	assert.Equal(t, float64(100000), results[0].Actual)
+	assert.Equal(t, 50000.5, results[1].Actual)
+	assert.Equal(t, float64(1), results[2].Actual)
+	assert.Equal(t, float64(100000), results[3].Actual)
+	assert.InDelta(t, 90000, results[4].Actual, 2000)
+}
@@ -55,7 +55,8 @@ func NewAferoFsByPath(path string) (afero.Fs, error) {
 		if err := afero.WriteReader(fs, "/"+filepath.Base(path), file); err != nil {
 			return nil, errors.Wrap(err, "unable to read "+path)
 		}
-		return fs, nil
+		// resolve both relative and absolute paths against root
+		return afero.NewBasePathFs(fs, "/"), nil
 	}
 
 	return nil, errors.New("currently only .zip, .tar, .tar.gz are supported")
@@ -2,6 +2,7 @@ package util
 
 import (
 	"context"
+	"errors"
 	"time"
 )
 
@@ -16,3 +17,35 @@ func OptionalTimeoutContext(ctx context.Context, timeout time.Duration) (context
 	}
 	return ctx, cancel
 }
+
+// IsCanceled returns if err is caused by cancellation of ctx, rather than its deadline
+func IsCanceled(ctx context.Context, err error) bool {
+	return err != nil && errors.Is(ctx.Err(), context.Canceled)
+}
+
+type deadliner interface {
+	SetDeadline(t time.Time) error
+}
+
+// InterruptOnDone makes blocking io of v return once ctx is done, if v supports deadlines (e.g. net.Conn).
+// stop has to be called once io is finished, v is never interrupted after it returns, even if ctx is done right after.
+func InterruptOnDone(ctx context.Context, v interface{}) (stop func()) {
+	d, ok := v.(deadliner)
+	if !ok {
+		return func() {}
+	}
+	chStop := make(chan struct{})
+	chDone := make(chan struct{})
+	go func() {
+		defer close(chDone)
+		select {
+		case <-ctx.Done():
+			_ = d.SetDeadline(time.Unix(1, 0))
+		case <-chStop:
+		}
+	}()
+	return func() {
+		close(chStop)
+		<-chDone
+	}
+}
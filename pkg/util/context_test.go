@@ -0,0 +1,39 @@
+package util_test
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/joesonw/lte/pkg/util"
+)
+
+type deadlineCounter struct {
+	n int64
+}
+
+func (d *deadlineCounter) SetDeadline(time.Time) error {
+	atomic.AddInt64(&d.n, 1)
+	return nil
+}
+
+func TestInterruptOnDone(t *testing.T) {
+	d := &deadlineCounter{}
+	for i := 0; i < 1000; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		util.InterruptOnDone(ctx, d)()
+		cancel()
+	}
+	assert.Equal(t, int64(0), atomic.LoadInt64(&d.n))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stop := util.InterruptOnDone(ctx, d)
+	cancel()
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt64(&d.n) == 1
+	}, time.Second, time.Millisecond)
+	stop()
+}
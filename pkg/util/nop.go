@@ -0,0 +1,81 @@
+package util
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// ErrNetworkStubbed is returned instead of reaching network while it is stubbed, e.g. by grpc connections
+var ErrNetworkStubbed = errors.New("network is stubbed")
+
+var _ net.Conn = (*NopConn)(nil)
+
+// NopConn is an inert connection placeholding a stubbed one, reads end at once and writes are discarded
+type NopConn struct {
+	Network string
+	Addr    string
+}
+
+func (c *NopConn) Read([]byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (c *NopConn) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (c *NopConn) Close() error {
+	return nil
+}
+
+func (c *NopConn) LocalAddr() net.Addr {
+	return nopAddr{network: c.Network}
+}
+
+func (c *NopConn) RemoteAddr() net.Addr {
+	return nopAddr{network: c.Network, addr: c.Addr}
+}
+
+func (c *NopConn) SetDeadline(time.Time) error {
+	return nil
+}
+
+func (c *NopConn) SetReadDeadline(time.Time) error {
+	return nil
+}
+
+func (c *NopConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+type nopAddr struct {
+	network string
+	addr    string
+}
+
+func (a nopAddr) Network() string {
+	return a.network
+}
+
+func (a nopAddr) String() string {
+	return a.addr
+}
+
+// NopTransport answers every request with an empty 200 response, placeholding a stubbed http client
+type NopTransport struct{}
+
+func (NopTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{
+		Status:     "200 OK",
+		StatusCode: http.StatusOK,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		Body:       http.NoBody,
+		Request:    req,
+	}, nil
+}
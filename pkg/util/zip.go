@@ -0,0 +1,48 @@
+package util
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// ZipDirectory archives all files under dir, paths inside the archive are relative to dir
+func ZipDirectory(dir string) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	w := zip.NewWriter(buf)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		fw, err := w.Create(filepath.ToSlash(rel))
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(fw, f)
+		return err
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to archive "+dir)
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, errors.Wrap(err, "unable to archive "+dir)
+	}
+	return buf.Bytes(), nil
+}